@@ -9,7 +9,8 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey     key = "user"
+	apiTokenKey key = "api_token"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -24,3 +25,20 @@ func User(ctx context.Context) *models.User {
 	}
 	return user
 }
+
+// WithAPIToken stores the personal API token the request was authenticated
+// with.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// APIToken returns the personal API token of the request, or nil when the
+// request was not authenticated with one.
+func APIToken(ctx context.Context) *models.APIToken {
+	val := ctx.Value(apiTokenKey)
+	token, ok := val.(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
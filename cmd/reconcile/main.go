@@ -0,0 +1,74 @@
+// Command reconcile imports images that were uploaded before image metadata
+// was stored in Postgres, and reports images that only exist in one of the
+// database or the storage.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"lenslocked/models"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be imported without writing anything")
+	flag.Parse()
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	storage, err := models.NewStorage(models.StorageConfig{
+		Driver:    os.Getenv("STORAGE_DRIVER"),
+		ImagesDir: os.Getenv("IMAGES_DIR"),
+		S3: models.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	galleryService := &models.GalleryService{DB: db, Storage: storage}
+
+	report, err := galleryService.Reconcile(*dryRun)
+	if err != nil {
+		panic(err)
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d images\n", verb, len(report.Imported))
+	for _, key := range report.Imported {
+		fmt.Println("  ", key)
+	}
+	fmt.Printf("Files that could not be imported: %d\n", len(report.OrphanFiles))
+	for _, key := range report.OrphanFiles {
+		fmt.Println("  ", key)
+	}
+	fmt.Printf("Images without a file: %d\n", len(report.OrphanRows))
+	for _, image := range report.OrphanRows {
+		fmt.Printf("   %s (image %d, gallery %d)\n", image.Path, image.ID, image.GalleryID)
+	}
+}
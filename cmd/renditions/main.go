@@ -0,0 +1,77 @@
+// Command renditions generates the resized renditions of images that were
+// uploaded before renditions existed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"lenslocked/models"
+)
+
+func main() {
+	force := flag.Bool("force", false, "regenerate renditions even if they already exist")
+	flag.Parse()
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	storage, err := models.NewStorage(models.StorageConfig{
+		Driver:    os.Getenv("STORAGE_DRIVER"),
+		ImagesDir: os.Getenv("IMAGES_DIR"),
+		S3: models.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	galleryService := &models.GalleryService{DB: db, Storage: storage}
+
+	images, err := galleryService.AllImages()
+	if err != nil {
+		panic(err)
+	}
+	var generated, failed int
+	for _, image := range images {
+		if !*force {
+			done, err := galleryService.HasRenditions(image)
+			if err != nil {
+				panic(err)
+			}
+			if done {
+				continue
+			}
+		}
+		err = galleryService.GenerateRenditions(image)
+		if err != nil {
+			fmt.Printf("%s: %v\n", image.Path, err)
+			failed++
+			continue
+		}
+		generated++
+	}
+	fmt.Printf("Generated renditions for %d images, %d failed\n", generated, failed)
+}
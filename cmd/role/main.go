@@ -0,0 +1,52 @@
+// Command role changes the role of a user. It is how the first admin is made,
+// later ones can be promoted from the admin pages.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"lenslocked/models"
+)
+
+func main() {
+	email := flag.String("email", "", "email address of the user")
+	role := flag.String("role", string(models.RoleAdmin), "role to give the user: user, moderator or admin")
+	flag.Parse()
+	if *email == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	userService := &models.UserService{DB: db}
+	user, err := userService.ByEmail(*email)
+	if err != nil {
+		log.Fatalf("find user %s: %v", *email, err)
+	}
+	err = userService.SetRole(user.ID, models.Role(*role))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s is now %s\n", user.Email, *role)
+}
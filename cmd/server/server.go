@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,6 +19,7 @@ import (
 	"lenslocked/controllers"
 	"lenslocked/migrations"
 	"lenslocked/models"
+	"lenslocked/openapi"
 	"lenslocked/static"
 	"lenslocked/templates"
 	"lenslocked/views"
@@ -36,7 +40,24 @@ type config struct {
 	}
 	Server struct {
 		Address string
+		// URL is the scheme, host and port users reach the site at.
+		URL string
 	}
+	Storage   models.StorageConfig
+	Galleries struct {
+		AccessKey string
+	}
+	RateLimit models.RateLimitConfig
+	Passwords struct {
+		MinLength   int
+		BreachedDir string
+		Hash        models.PasswordHashConfig
+	}
+	Passkeys struct {
+		Origin string
+		RPID   string
+	}
+	OIDC []*models.OIDCProvider
 }
 
 func loadEnvConfig() (config, error) {
@@ -74,10 +95,117 @@ func loadEnvConfig() (config, error) {
 
 	// TODO: Read the server values from an ENV variable
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	cfg.Server.URL = strings.TrimSuffix(os.Getenv("SITE_URL"), "/")
+	if cfg.Server.URL == "" {
+		cfg.Server.URL = "http://" + cfg.Server.Address
+	}
+
+	cfg.Galleries.AccessKey = os.Getenv("GALLERY_ACCESS_KEY")
+	if cfg.Galleries.AccessKey == "" {
+		cfg.Galleries.AccessKey = deriveKey(cfg.CSRF.Key, "gallery access")
+	}
+
+	cfg.Storage.Driver = os.Getenv("STORAGE_DRIVER")
+	cfg.Storage.ImagesDir = os.Getenv("IMAGES_DIR")
+	cfg.Storage.S3 = models.S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+	}
+
+	cfg.RateLimit.Driver = os.Getenv("RATE_LIMIT_STORE")
+	cfg.RateLimit.Redis.Addr = os.Getenv("REDIS_ADDR")
+	cfg.RateLimit.Redis.Password = os.Getenv("REDIS_PASSWORD")
+	if db := os.Getenv("REDIS_DB"); db != "" {
+		cfg.RateLimit.Redis.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		cfg.Passwords.MinLength, err = strconv.Atoi(minLength)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Passwords.BreachedDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+	cfg.Passwords.Hash.Algorithm = os.Getenv("PASSWORD_HASH")
+	if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+		cfg.Passwords.Hash.Bcrypt.Cost, err = strconv.Atoi(cost)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if memory := os.Getenv("ARGON2ID_MEMORY"); memory != "" {
+		m, err := strconv.ParseUint(memory, 10, 32)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Passwords.Hash.Argon2id.Memory = uint32(m)
+	}
+	if passes := os.Getenv("ARGON2ID_TIME"); passes != "" {
+		t, err := strconv.ParseUint(passes, 10, 32)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Passwords.Hash.Argon2id.Time = uint32(t)
+	}
+	if threads := os.Getenv("ARGON2ID_THREADS"); threads != "" {
+		p, err := strconv.ParseUint(threads, 10, 8)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Passwords.Hash.Argon2id.Threads = uint8(p)
+	}
+
+	cfg.Passkeys.Origin = os.Getenv("PASSKEY_ORIGIN")
+	if cfg.Passkeys.Origin == "" {
+		cfg.Passkeys.Origin = cfg.Server.URL
+	}
+	cfg.Passkeys.RPID = os.Getenv("PASSKEY_RP_ID")
+
+	// Every identity provider in OIDC_PROVIDERS is configured by the
+	// variables prefixed with its name, e.g. OIDC_ACME_ISSUER for acme.
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &models.OIDCProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return cfg, fmt.Errorf("oidc provider %s: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = name
+		}
+		if provider.RedirectURL == "" {
+			provider.RedirectURL = cfg.Server.URL + "/auth/" + name + "/callback"
+		}
+		cfg.OIDC = append(cfg.OIDC, provider)
+	}
 
 	return cfg, nil
 }
 
+// deriveKey derives a key for the purpose in label from key, so that one
+// secret doesn't end up signing unrelated things.
+func deriveKey(key, label string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(label))
+	return string(mac.Sum(nil))
+}
+
 func main() {
 
 	cfg, err := loadEnvConfig()
@@ -105,17 +233,57 @@ func run(cfg config) {
 		panic(err)
 	}
 
-	usersService := &models.UserService{DB: db}
+	passwordPolicy := models.PasswordPolicy{MinLength: cfg.Passwords.MinLength}
+	if cfg.Passwords.BreachedDir != "" {
+		passwordPolicy.Breached, err = models.LoadBreachedPasswords(cfg.Passwords.BreachedDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+	passwordHasher, err := models.NewPasswordHasher(cfg.Passwords.Hash)
+	if err != nil {
+		panic(err)
+	}
+	usersService := &models.UserService{DB: db, PasswordPolicy: passwordPolicy, Hasher: passwordHasher}
 	sessionService := &models.SessionService{DB: db}
 	pwResetService := &models.PasswordResetService{DB: db}
 	emailService := models.NewEmailService(cfg.SMTP)
-	galleryService := &models.GalleryService{DB: db}
+	storage, err := models.NewStorage(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+	galleryService := &models.GalleryService{DB: db, Storage: storage}
+	shareLinkService := &models.ShareLinkService{DB: db}
+	galleryMemberService := &models.GalleryMemberService{DB: db}
+	twoFactorService := &models.TwoFactorService{DB: db}
+	emailVerificationService := &models.EmailVerificationService{DB: db}
+	apiTokenService := &models.APITokenService{DB: db}
+	loginThrottleService := &models.LoginThrottleService{DB: db}
+	accountDeletionService := &models.AccountDeletionService{DB: db, GalleryService: galleryService}
+	accountExportService := &models.AccountExportService{DB: db, GalleryService: galleryService}
+	emailChangeService := &models.EmailChangeService{DB: db}
+	magicLinkService := &models.MagicLinkService{DB: db}
+	passkeyService := &models.PasskeyService{DB: db, Origin: cfg.Passkeys.Origin, RPID: cfg.Passkeys.RPID}
+	oidcService := &models.OIDCService{DB: db, Providers: map[string]*models.OIDCProvider{}}
+	for _, provider := range cfg.OIDC {
+		oidcService.Providers[provider.Name] = provider
+	}
 
 	usersC := controllers.Users{
-		UserService:          usersService,
-		SessionService:       sessionService,
-		PasswordResetService: pwResetService,
-		EmailService:         emailService,
+		UserService:              usersService,
+		SessionService:           sessionService,
+		PasswordResetService:     pwResetService,
+		EmailService:             emailService,
+		TwoFactorService:         twoFactorService,
+		EmailVerificationService: emailVerificationService,
+		APITokenService:          apiTokenService,
+		LoginThrottleService:     loginThrottleService,
+		AccountDeletionService:   accountDeletionService,
+		AccountExportService:     accountExportService,
+		EmailChangeService:       emailChangeService,
+		MagicLinkService:         magicLinkService,
+		PasskeyService:           passkeyService,
+		OIDCService:              oidcService,
 	}
 
 	usersC.Templates.New = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "signup.gohtml"))
@@ -124,15 +292,112 @@ func run(cfg config) {
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "forgot-pw.gohtml"))
 	usersC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "check-your-email.gohtml"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "reset-pw.gohtml"))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "sessions.gohtml"))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "two-factor.gohtml"))
+	usersC.Templates.TwoFactorSetup = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "two-factor-setup.gohtml"))
+	usersC.Templates.RecoveryCodes = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "recovery-codes.gohtml"))
+	usersC.Templates.SignInTwoFactor = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "signin-2fa.gohtml"))
+	usersC.Templates.VerifyEmail = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "verify-email.gohtml"))
+	usersC.Templates.APITokens = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "api-tokens.gohtml"))
+	usersC.Templates.DeleteAccount = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "delete-account.gohtml"))
+	usersC.Templates.AccountDeleted = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "account-deleted.gohtml"))
+	usersC.Templates.AccountExport = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "account-export.gohtml"))
+	usersC.Templates.ChangeEmail = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "change-email.gohtml"))
+	usersC.Templates.ConfirmEmailChange = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "confirm-email-change.gohtml"))
+	usersC.Templates.EmailChanged = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "email-changed.gohtml"))
+	usersC.Templates.ChangePassword = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "change-password.gohtml"))
+	usersC.Templates.MagicLink = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "magic-link.gohtml"))
+	usersC.Templates.ConfirmMagicLink = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "confirm-magic-link.gohtml"))
+	usersC.Templates.Passkeys = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "passkeys.gohtml"))
+
+	rateLimitStore, err := models.NewRateLimitStore(cfg.RateLimit)
+	if err != nil {
+		panic(err)
+	}
 
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:       galleryService,
+		ShareLinkService:     shareLinkService,
+		GalleryMemberService: galleryMemberService,
+		EmailService:         emailService,
+		AccessKey:            []byte(cfg.Galleries.AccessKey),
+	}
+
+	galleriesC.PasswordAttempts = &controllers.AttemptLimiter{
+		Name:  "gallery-password",
+		Store: rateLimitStore,
+		Limit: models.RateLimit{Requests: 5, Period: 15 * time.Minute},
 	}
 
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/new.gohtml"))
 	galleriesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/edit.gohtml"))
 	galleriesC.Templates.Index = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/index.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/show.gohtml"))
+	galleriesC.Templates.Public = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/public.gohtml"))
+	galleriesC.Templates.Password = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/password.gohtml"))
+	galleriesC.Templates.Invitation = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/invitation.gohtml"))
+
+	adminC := controllers.Admin{
+		UserService:    usersService,
+		SessionService: sessionService,
+		GalleryService: galleryService,
+	}
+	adminC.Templates.Users = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "admin/users.gohtml"))
+	adminC.Templates.Galleries = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "admin/galleries.gohtml"))
+
+	apiC := controllers.API{
+		UserService:            usersService,
+		SessionService:         sessionService,
+		TwoFactorService:       twoFactorService,
+		GalleryService:         galleryService,
+		GalleryMemberService:   galleryMemberService,
+		APITokenService:        apiTokenService,
+		LoginThrottleService:   loginThrottleService,
+		EmailService:           emailService,
+		AccountDeletionService: accountDeletionService,
+	}
+
+	rateLimitedTpl := views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "rate-limited.gohtml"))
+	signInLimit := controllers.RateLimit{
+		Name:     "signin",
+		Store:    rateLimitStore,
+		Limit:    models.RateLimit{Requests: 10, Period: time.Minute},
+		Template: rateLimitedTpl,
+	}
+	signUpLimit := controllers.RateLimit{
+		Name:     "signup",
+		Store:    rateLimitStore,
+		Limit:    models.RateLimit{Requests: 5, Period: time.Hour},
+		Template: rateLimitedTpl,
+	}
+	// Every one of these requests sends an email.
+	emailLimit := controllers.RateLimit{
+		Name:     "email",
+		Store:    rateLimitStore,
+		Limit:    models.RateLimit{Requests: 5, Period: time.Hour},
+		Key:      controllers.KeyByUser,
+		Template: rateLimitedTpl,
+	}
+	uploadLimit := controllers.RateLimit{
+		Name:     "upload",
+		Store:    rateLimitStore,
+		Limit:    models.RateLimit{Requests: 60, Period: time.Minute},
+		Key:      controllers.KeyByUser,
+		Template: rateLimitedTpl,
+	}
+	apiLimit := controllers.RateLimit{
+		Name:  "api",
+		Store: rateLimitStore,
+		Limit: models.RateLimit{Requests: 300, Period: time.Minute},
+		// The limit is applied after API.SetUser, so requests are counted
+		// per token it resolved and invalid tokens per IP address.
+		Key: controllers.KeyByToken,
+	}
+	apiSignInLimit := controllers.RateLimit{
+		Name:  "api-signin",
+		Store: rateLimitStore,
+		Limit: models.RateLimit{Requests: 10, Period: time.Minute},
+	}
 
 	umw := controllers.UserMiddleware{
 		SessionService: sessionService,
@@ -145,6 +410,7 @@ func run(cfg config) {
 	)
 
 	r := chi.NewRouter()
+	r.Use(apiC.SkipCSRF)
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
 	r.Use(middleware.Logger)
@@ -154,39 +420,120 @@ func run(cfg config) {
 	r.Get("/faq", controllers.FAQ(views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "faq.gohtml"))))
 
 	r.Get("/signup", usersC.New)
-	r.Post("/signup", usersC.Create)
+	r.With(signUpLimit.Middleware).Post("/signup", usersC.Create)
 	r.Get("/signin", usersC.SignIn)
-	r.Post("/signin", usersC.ProcessSignIn)
+	r.With(signInLimit.Middleware).Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/2fa", usersC.SignInTwoFactor)
+	r.With(signInLimit.Middleware).Post("/signin/2fa", usersC.ProcessSignInTwoFactor)
+	r.Get("/signin/link", usersC.MagicLink)
+	r.With(emailLimit.Middleware).Post("/signin/link", usersC.ProcessMagicLink)
+	r.Get("/signin/link/confirm", usersC.ConfirmMagicLink)
+	r.With(signInLimit.Middleware).Post("/signin/link/confirm", usersC.ProcessConfirmMagicLink)
+	r.With(signInLimit.Middleware).Post("/signin/passkey/options", usersC.BeginPasskeySignIn)
+	r.With(signInLimit.Middleware).Post("/signin/passkey", usersC.FinishPasskeySignIn)
+	r.With(signInLimit.Middleware).Get("/auth/{provider}/login", usersC.OIDCLogin)
+	r.With(signInLimit.Middleware).Get("/auth/{provider}/callback", usersC.OIDCCallback)
 	r.Post("/signout", usersC.ProcessSignOut)
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", ipLog(usersC.CurrentUser))
+		r.Get("/email", usersC.ChangeEmail)
+		r.With(emailLimit.Middleware).Post("/email", usersC.ProcessChangeEmail)
+		r.Get("/password", usersC.ChangePassword)
+		r.With(signInLimit.Middleware).Post("/password", usersC.ProcessChangePassword)
+		r.Get("/passkeys", usersC.Passkeys)
+		r.Post("/passkeys/options", usersC.BeginPasskeyRegistration)
+		r.Post("/passkeys", usersC.FinishPasskeyRegistration)
+		r.Post("/passkeys/{id}/delete", usersC.DeletePasskey)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/delete-others", usersC.RevokeOtherSessions)
+		r.Post("/sessions/{id}/delete", usersC.RevokeSession)
+		r.Get("/2fa", usersC.TwoFactor)
+		r.Post("/2fa/setup", usersC.SetupTwoFactor)
+		r.Post("/2fa/confirm", usersC.ConfirmTwoFactor)
+		r.Post("/2fa/disable", usersC.DisableTwoFactor)
+		r.Get("/verify-email", usersC.VerifyEmail)
+		r.With(emailLimit.Middleware).Post("/verify-email", usersC.ResendVerification)
+		r.Get("/tokens", usersC.APITokens)
+		r.Post("/tokens", usersC.CreateAPIToken)
+		r.Post("/tokens/{id}/delete", usersC.RevokeAPIToken)
+		r.Get("/export", usersC.AccountExport)
+		r.With(emailLimit.Middleware).Post("/export", usersC.RequestAccountExport)
+		r.Get("/export/download", usersC.DownloadAccountExport)
+		r.Get("/delete", usersC.DeleteAccount)
+		r.Post("/delete", usersC.ProcessDeleteAccount)
 	})
 	r.Get("/forgot-pw", usersC.ForgotPassword)
-	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
+	r.With(emailLimit.Middleware).Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.Get("/reset-pw", usersC.ResetPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/verify-email", usersC.ProcessVerifyEmail)
+	r.Get("/confirm-email", usersC.ConfirmEmailChange)
+	r.Post("/confirm-email", usersC.ProcessConfirmEmailChange)
+	r.Get("/undo-email-change", usersC.UndoEmailChange)
+	r.Post("/undo-email-change", usersC.ProcessUndoEmailChange)
 
+	r.Get("/explore", galleriesC.Public)
+	r.Get("/g/{slug}", galleriesC.ShowBySlug)
+	r.Get("/g/{slug}/images/{filename}", galleriesC.ImageBySlug)
+	r.Post("/g/{slug}/unlock", galleriesC.UnlockBySlug)
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Post("/{id}/unlock", galleriesC.Unlock)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
-			r.Get("/new", galleriesC.New)
-			r.Post("/", galleriesC.Create)
+			r.With(umw.RequireVerifiedUser).Get("/new", galleriesC.New)
+			r.With(umw.RequireVerifiedUser).Post("/", galleriesC.Create)
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
-			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.With(umw.RequireVerifiedUser, uploadLimit.Middleware).Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+			r.Post("/{id}/share-links/{linkID}/delete", galleriesC.DeleteShareLink)
+			r.Post("/{id}/protect", galleriesC.Protect)
+			r.Post("/{id}/unprotect", galleriesC.Unprotect)
+			r.With(emailLimit.Middleware).Post("/{id}/members", galleriesC.InviteMember)
+			r.Post("/{id}/members/{memberID}/delete", galleriesC.RemoveMember)
+			r.Post("/{id}/invitations/{invitationID}/delete", galleriesC.CancelInvitation)
 		})
 	})
+	r.Route("/invitations", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", galleriesC.Invitation)
+		r.Post("/", galleriesC.AcceptInvitation)
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequirePermission(models.PermissionManageUsers))
+			r.Get("/users", adminC.Users)
+			r.Post("/users/{id}/suspend", adminC.SuspendUser)
+			r.Post("/users/{id}/unsuspend", adminC.UnsuspendUser)
+			r.Post("/users/{id}/signout", adminC.SignOutUser)
+			r.Post("/users/{id}/role", adminC.SetUserRole)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequirePermission(models.PermissionModerateGalleries))
+			r.Get("/galleries", adminC.Galleries)
+			r.Post("/galleries/{id}/take-down", adminC.TakeDownGallery)
+			r.Post("/galleries/{id}/restore", adminC.RestoreGallery)
+		})
+	})
+
+	r.Get("/api/openapi.json", controllers.OpenAPISpec(openapi.Spec))
+	apiRoutes(r, apiC, apiLimit, apiSignInLimit)
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
 
+	go purgeAccounts(accountDeletionService, time.Hour)
+	go exportAccounts(accountExportService, usersService, emailService, time.Minute)
+
 	log.Printf("Starting server on %s...\n", cfg.Server.Address)
 	err = http.ListenAndServe(":3000", r)
 	if err != nil {
@@ -194,6 +541,75 @@ func run(cfg config) {
 	}
 }
 
+// apiRoutes registers the JSON API below /api/v1. It is kept apart from run so
+// that the tests can check the routes against the OpenAPI spec.
+func apiRoutes(r chi.Router, apiC controllers.API, apiLimit, apiSignInLimit controllers.RateLimit) {
+	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(apiC.SetUser)
+		r.Use(apiLimit.Middleware)
+		r.Use(apiC.RequireValidToken)
+		r.NotFound(apiC.NotFound)
+		r.MethodNotAllowed(apiC.MethodNotAllowed)
+		r.With(apiSignInLimit.Middleware).Post("/auth/tokens", apiC.CreateToken)
+		r.With(apiSignInLimit.Middleware).Post("/auth/tokens/2fa", apiC.CompleteTwoFactor)
+		r.Group(func(r chi.Router) {
+			r.Use(apiC.RequireUser)
+			r.Delete("/auth/tokens/current", apiC.DeleteToken)
+			r.Get("/users/me", apiC.CurrentUser)
+			r.Group(func(r chi.Router) {
+				r.Use(apiC.RequireScope(models.ScopeReadGalleries))
+				r.Get("/galleries", apiC.Galleries)
+				r.Get("/galleries/{id}", apiC.Gallery)
+				r.Get("/galleries/{id}/images", apiC.Images)
+				r.Get("/galleries/{id}/images/{filename}", apiC.Image)
+				r.Get("/galleries/{id}/images/{filename}/content", apiC.ImageContent)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(apiC.RequireScope(models.ScopeWriteGalleries))
+				r.Post("/galleries", apiC.CreateGallery)
+				r.Patch("/galleries/{id}", apiC.UpdateGallery)
+				r.Delete("/galleries/{id}", apiC.DeleteGallery)
+				r.Delete("/galleries/{id}/images/{filename}", apiC.DeleteImage)
+			})
+			r.With(apiC.RequireScope(models.ScopeUploadImages)).Post("/galleries/{id}/images", apiC.UploadImages)
+		})
+	})
+}
+
+// purgeAccounts deletes the accounts whose grace period is over, checking
+// again every interval.
+func purgeAccounts(service *models.AccountDeletionService, interval time.Duration) {
+	for {
+		purged, err := service.Purge()
+		if err != nil {
+			log.Println(err)
+		}
+		if purged > 0 {
+			log.Printf("Deleted %d accounts\n", purged)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// exportAccounts builds the data exports users asked for and deletes the ones
+// that expired, checking again every interval.
+func exportAccounts(exports *models.AccountExportService, users *models.UserService, emailService *models.EmailService, interval time.Duration) {
+	for {
+		built, err := controllers.BuildAccountExports(exports, users, emailService)
+		if err != nil {
+			log.Println(err)
+		}
+		if built > 0 {
+			log.Printf("Built %d account exports\n", built)
+		}
+		_, err = exports.Purge()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
 // excercise middleware:
 
 func ipLog(next http.HandlerFunc) http.HandlerFunc {
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/controllers"
+	"lenslocked/openapi"
+)
+
+// TestAPIRoutesMatchSpec keeps the OpenAPI spec from silently falling behind
+// the routes of the API.
+func TestAPIRoutesMatchSpec(t *testing.T) {
+	r := chi.NewRouter()
+	apiRoutes(r, controllers.API{}, controllers.RateLimit{}, controllers.RateLimit{})
+	err := openapi.CheckRoutes(r, "/api/v1/")
+	if err != nil {
+		t.Errorf("the OpenAPI spec does not match the API routes:\n%v", err)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := deriveKey("csrf key", "gallery access")
+	if key == "csrf key" || len(key) != 32 {
+		t.Errorf("deriveKey() = %x, want 32 bytes other than the key", key)
+	}
+	if key != deriveKey("csrf key", "gallery access") {
+		t.Errorf("deriveKey() is not deterministic")
+	}
+	if key == deriveKey("csrf key", "something else") {
+		t.Errorf("deriveKey() gives the same key for different labels")
+	}
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// DeleteAccount asks the user to confirm they want to delete their account.
+func (u Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	u.Templates.DeleteAccount.Execute(w, r, nil)
+}
+
+// ProcessDeleteAccount marks the account for deletion once the user confirmed
+// it with their password, and signs them out everywhere.
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			err = apperrors.Public(err, "The password you entered is incorrect.")
+			u.Templates.DeleteAccount.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	deletesAt, err := u.AccountDeletionService.Request(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieSession)
+	var data struct {
+		DeletesAt time.Time
+	}
+	data.DeletesAt = deletesAt
+	// The user is signed out now, the page should not show them as signed in.
+	r = r.WithContext(appctx.WithUser(r.Context(), nil))
+	u.Templates.AccountDeleted.Execute(w, r, data)
+}
+
+// cancelAccountDeletion is called whenever a user signs in, as signing in
+// during the grace period cancels the deletion of the account. It reports
+// whether there was a deletion to cancel.
+func cancelAccountDeletion(service *models.AccountDeletionService, userID int) bool {
+	cancelled, err := service.Cancel(userID)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return cancelled
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lenslocked/appctx"
+	"lenslocked/models"
+)
+
+// AccountExport shows the latest data export of the user and lets them ask
+// for a new one.
+func (u Users) AccountExport(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	export, err := u.AccountExportService.Latest(user.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Requested   bool
+		InProgress  bool
+		Ready       bool
+		Failed      bool
+		RequestedAt time.Time
+		ExpiresAt   time.Time
+		Size        string
+	}
+	if export != nil && !export.Expired(time.Now()) {
+		data.Requested = true
+		data.InProgress = export.InProgress()
+		data.Ready = export.Status == models.ExportReady
+		data.Failed = export.Status == models.ExportFailed
+		data.RequestedAt = export.RequestedAt
+		data.ExpiresAt = export.ExpiresAt.Time
+		data.Size = fmt.Sprintf("%.1f MB", float64(export.Size.Int64)/(1<<20))
+	}
+	u.Templates.AccountExport.Execute(w, r, data)
+}
+
+func (u Users) RequestAccountExport(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	_, err := u.AccountExportService.Request(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/export", http.StatusFound)
+}
+
+// DownloadAccountExport sends the archive of the latest export, as long as it
+// has not expired.
+func (u Users) DownloadAccountExport(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	export, err := u.AccountExportService.Latest(user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, "/users/me/export", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	contents, info, err := u.AccountExportService.Open(export)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Redirect(w, r, "/users/me/export", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+	filename := "lenslocked-export-" + export.RequestedAt.Format("2006-01-02") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if info.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	_, err = io.Copy(w, contents)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// BuildAccountExports builds every export that is waiting, and emails the
+// users once their export can be downloaded. It returns how many exports
+// were built.
+func BuildAccountExports(exports *models.AccountExportService, users *models.UserService, emailService *models.EmailService) (int, error) {
+	var built int
+	for {
+		export, err := exports.Next()
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				return built, nil
+			}
+			return built, err
+		}
+		err = exports.Build(export)
+		if err != nil {
+			// The export is marked as failed, the next one may work.
+			fmt.Println(err)
+			continue
+		}
+		built++
+		user, err := users.ByID(export.UserID)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		// TODO: Make the url here configurable
+		err = emailService.AccountExportReady(user.Email, "https://www.lenslocked.com/users/me/export", export.ExpiresAt.Time)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
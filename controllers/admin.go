@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// Admin lets staff manage users and moderate galleries. Every handler expects
+// the RequirePermission middleware in front of it.
+type Admin struct {
+	Templates struct {
+		Users     Template
+		Galleries Template
+	}
+	UserService    *models.UserService
+	SessionService *models.SessionService
+	GalleryService *models.GalleryService
+}
+
+// adminPagination links to the pages next to the one being shown.
+type adminPagination struct {
+	Page     int
+	Pages    int
+	Previous int
+	Next     int
+}
+
+func newAdminPagination(page models.Page, total int) adminPagination {
+	pagination := adminPagination{
+		Page:  page.Number,
+		Pages: page.Pages(total),
+	}
+	if page.Number > 1 {
+		pagination.Previous = page.Number - 1
+	}
+	if page.Number < pagination.Pages {
+		pagination.Next = page.Number + 1
+	}
+	return pagination
+}
+
+func adminPage(r *http.Request) models.Page {
+	number, _ := strconv.Atoi(r.FormValue("page"))
+	return models.NewPage(number, models.DefaultPageSize)
+}
+
+func (a Admin) Users(w http.ResponseWriter, r *http.Request) {
+	a.renderUsers(w, r)
+}
+
+func (a Admin) renderUsers(w http.ResponseWriter, r *http.Request, errs ...error) {
+	type User struct {
+		ID        int
+		Email     string
+		Role      models.Role
+		Verified  bool
+		Suspended bool
+		// Manageable is false for the current user, who can't suspend
+		// themselves or change their own role.
+		Manageable bool
+	}
+	current := appctx.User(r.Context())
+	page := adminPage(r)
+	users, total, err := a.UserService.Page(page)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Users      []User
+		Roles      []models.Role
+		Pagination adminPagination
+	}
+	for _, user := range users {
+		data.Users = append(data.Users, User{
+			ID:         user.ID,
+			Email:      user.Email,
+			Role:       user.Role,
+			Verified:   user.Verified(),
+			Suspended:  user.Suspended(),
+			Manageable: models.CanManageUser(current, &user),
+		})
+	}
+	data.Roles = []models.Role{models.RoleUser, models.RoleModerator, models.RoleAdmin}
+	data.Pagination = newAdminPagination(page, total)
+	a.Templates.Users.Execute(w, r, data, errs...)
+}
+
+// userByID looks up the user in the URL and makes sure the current user can
+// manage them.
+func (a Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+	user, err := a.UserService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	if !models.CanManageUser(appctx.User(r.Context()), user) {
+		http.Error(w, "You are not authorized to manage this user", http.StatusForbidden)
+		return nil, fmt.Errorf("user can not manage user %d", user.ID)
+	}
+	return user, nil
+}
+
+func (a Admin) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	err = a.UserService.Suspend(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/users")
+}
+
+func (a Admin) UnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	err = a.UserService.Unsuspend(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/users")
+}
+
+// SignOutUser deletes every session of the user. Their API tokens keep
+// working, the user can revoke those themselves.
+func (a Admin) SignOutUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	err = a.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/users")
+}
+
+func (a Admin) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	err = a.UserService.SetRole(user.ID, models.Role(r.FormValue("role")))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRole) {
+			err = apperrors.Public(err, "That role does not exist.")
+			w.WriteHeader(http.StatusBadRequest)
+			a.renderUsers(w, r, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/users")
+}
+
+func (a Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID         int
+		Title      string
+		OwnerEmail string
+		Visibility models.Visibility
+		TakenDown  bool
+	}
+	page := adminPage(r)
+	galleries, total, err := a.GalleryService.Page(page)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Galleries  []Gallery
+		Pagination adminPagination
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			OwnerEmail: gallery.OwnerEmail,
+			Visibility: gallery.Visibility,
+			TakenDown:  gallery.TakenDown(),
+		})
+	}
+	data.Pagination = newAdminPagination(page, total)
+	a.Templates.Galleries.Execute(w, r, data)
+}
+
+func (a Admin) TakeDownGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = a.GalleryService.TakeDown(id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/galleries")
+}
+
+func (a Admin) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = a.GalleryService.Restore(id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirectToAdminPage(w, r, "/admin/galleries")
+}
+
+// redirectToAdminPage sends staff back to the page of the list they acted on.
+func redirectToAdminPage(w http.ResponseWriter, r *http.Request, path string) {
+	if page, err := strconv.Atoi(r.FormValue("page")); err == nil && page > 1 {
+		path = fmt.Sprintf("%s?page=%d", path, page)
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
@@ -0,0 +1,411 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// API serves the JSON API under /api/v1. Clients authenticate with a bearer
+// token in the Authorization header instead of the session cookie, which is
+// why API requests don't go through the CSRF checks. The bearer token is
+// either a session token from CreateToken or a personal API token.
+type API struct {
+	UserService            *models.UserService
+	SessionService         *models.SessionService
+	TwoFactorService       *models.TwoFactorService
+	GalleryService         *models.GalleryService
+	GalleryMemberService   *models.GalleryMemberService
+	APITokenService        *models.APITokenService
+	LoginThrottleService   *models.LoginThrottleService
+	EmailService           *models.EmailService
+	AccountDeletionService *models.AccountDeletionService
+}
+
+// maxAPIBodyBytes limits the size of JSON request bodies.
+const maxAPIBodyBytes = 1 << 20
+
+type apiErrorBody struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiList struct {
+	Data       any           `json:"data"`
+	Pagination apiPagination `json:"pagination"`
+}
+
+type apiPagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// SkipCSRF lets requests to the API through the CSRF middleware, it has to be
+// used before it. This is safe because the API ignores the session cookie.
+func (a API) SkipCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type apiContextKey string
+
+const (
+	invalidTokenKey apiContextKey = "invalid_token"
+	// tokenIDKey identifies the session or personal API token the request
+	// was authenticated with, for KeyByToken.
+	tokenIDKey apiContextKey = "token_id"
+)
+
+// SetUser replaces the user found by the session cookie with the user the
+// bearer token belongs to, if any. Requests with a token that is invalid are
+// left without a user, RequireValidToken rejects them. Keeping the two apart
+// lets the rate limit between them count those requests per IP address.
+func (a API) SetUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *models.User
+		var apiToken *models.APIToken
+		ctx := r.Context()
+		token, ok := bearerToken(r)
+		if ok {
+			var err error
+			var tokenID string
+			if models.IsAPIToken(token) {
+				user, apiToken, err = a.APITokenService.User(token)
+				if err == nil {
+					tokenID = fmt.Sprintf("api-token:%d", apiToken.ID)
+				}
+			} else {
+				var session *models.Session
+				user, session, err = a.SessionService.UserSession(token)
+				if err == nil {
+					tokenID = fmt.Sprintf("session:%d", session.ID)
+				}
+			}
+			if err != nil {
+				ctx = context.WithValue(ctx, invalidTokenKey, err)
+			} else {
+				ctx = context.WithValue(ctx, tokenIDKey, tokenID)
+			}
+		}
+		ctx = appctx.WithUser(ctx, user)
+		ctx = appctx.WithAPIToken(ctx, apiToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireValidToken responds with a 401 to requests SetUser couldn't
+// authenticate the bearer token of.
+func (a API) RequireValidToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err, ok := r.Context().Value(invalidTokenKey).(error); ok {
+			err = apperrors.Public(err, "The access token is invalid or expired.")
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a API) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := appctx.User(r.Context())
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			err := apperrors.Public(fmt.Errorf("missing bearer token"), "Authentication required.")
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope must be used after RequireUser. Requests made with a personal
+// API token need the scope, session tokens can do anything the user can.
+func (a API) RequireScope(scope models.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiToken := appctx.APIToken(r.Context())
+			if apiToken != nil && !apiToken.Scopes.Has(scope) {
+				msg := fmt.Sprintf("This token is missing the %s scope.", scope)
+				err := apperrors.Public(fmt.Errorf("api token %d lacks scope %s", apiToken.ID, scope), msg)
+				writeAPIError(w, http.StatusForbidden, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OpenAPISpec serves the OpenAPI document describing the API.
+func OpenAPISpec(spec []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
+
+func (a API) NotFound(w http.ResponseWriter, r *http.Request) {
+	err := apperrors.Public(fmt.Errorf("no api route for %s", r.URL.Path), "Not found.")
+	writeAPIError(w, http.StatusNotFound, err)
+}
+
+func (a API) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	err := apperrors.Public(fmt.Errorf("method %s not allowed for %s", r.Method, r.URL.Path), "Method not allowed.")
+	writeAPIError(w, http.StatusMethodNotAllowed, err)
+}
+
+// CreateToken signs a user in with their email and password and returns a
+// bearer token. Users with two-factor authentication get a challenge that has
+// to be completed with CompleteTwoFactor instead.
+func (a API) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	err := a.LoginThrottleService.Check(body.Email, clientIP(r))
+	if err != nil {
+		if errors.Is(err, models.ErrLoginLocked) {
+			err = apperrors.Public(err, loginLockedMessage)
+			writeAPIError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user, err := a.UserService.Authenticate(body.Email, body.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			recordFailedLogin(a.LoginThrottleService, a.EmailService, r, body.Email)
+			err = apperrors.Public(err, "The email address or password is incorrect.")
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if errors.Is(err, models.ErrAccountSuspended) {
+			err = apperrors.Public(err, accountSuspendedMessage)
+			writeAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	twoFactor, err := a.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if twoFactor {
+		challenge, err := a.TwoFactorService.CreateChallenge(user.ID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			Challenge         string `json:"challenge"`
+		}{true, challenge.Token})
+		return
+	}
+	err = a.LoginThrottleService.Unlock(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	a.writeToken(w, r, user.ID)
+}
+
+func (a API) CompleteTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	userID, err := a.TwoFactorService.CompleteChallenge(body.Challenge, body.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCode):
+			recordFailedTwoFactor(a.LoginThrottleService, a.EmailService, a.UserService, r, userID)
+			err = apperrors.Public(err, "That code is not valid.")
+			writeAPIError(w, http.StatusUnauthorized, err)
+		case errors.Is(err, models.ErrChallengeExpired):
+			err = apperrors.Public(err, "The challenge expired, please sign in again.")
+			writeAPIError(w, http.StatusUnauthorized, err)
+		default:
+			writeAPIError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	err = unlockLogin(a.LoginThrottleService, a.UserService, r, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrLoginLocked) {
+			err = apperrors.Public(err, loginLockedMessage)
+			writeAPIError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeToken(w, r, userID)
+}
+
+func (a API) writeToken(w http.ResponseWriter, r *http.Request, userID int) {
+	session, err := a.SessionService.Create(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		if errors.Is(err, models.ErrAccountSuspended) {
+			writeAPIError(w, http.StatusForbidden, apperrors.Public(err, accountSuspendedMessage))
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cancelAccountDeletion(a.AccountDeletionService, userID)
+	writeJSON(w, http.StatusCreated, struct {
+		Token     string    `json:"token"`
+		TokenType string    `json:"token_type"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{session.Token, "Bearer", session.ExpiresAt})
+}
+
+// DeleteToken signs out the token used for the request. Personal API tokens
+// are revoked.
+func (a API) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if apiToken := appctx.APIToken(r.Context()); apiToken != nil {
+		err = a.APITokenService.Delete(apiToken.UserID, apiToken.ID)
+	} else {
+		token, _ := bearerToken(r)
+		err = a.SessionService.Delete(token)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a API) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	writeJSON(w, http.StatusOK, apiUserFrom(user))
+}
+
+type apiUser struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+func apiUserFrom(user *models.User) apiUser {
+	return apiUser{
+		ID:       user.ID,
+		Email:    user.Email,
+		Verified: user.Verified(),
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>"
+// header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeAPIError responds with a JSON error body. Like the HTML templates it
+// only shows the message of public errors, everything else is logged and
+// reported as "Something went wrong.".
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	message := "Something went wrong."
+	var pubErr interface{ Public() string }
+	if errors.As(err, &pubErr) {
+		message = pubErr.Public()
+	} else {
+		fmt.Println(err)
+	}
+	writeJSON(w, status, apiErrorBody{
+		Error: apiErrorDetail{Status: status, Message: message},
+	})
+}
+
+// readJSON decodes the JSON request body into v. It responds with an error
+// and returns false if the body is not valid.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		err = apperrors.Public(err, "The request body is not valid JSON.")
+		writeAPIError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// readPage reads the page and per_page query parameters.
+func readPage(w http.ResponseWriter, r *http.Request) (models.Page, bool) {
+	var number, size int
+	var err error
+	if v := r.URL.Query().Get("page"); v != "" {
+		number, err = strconv.Atoi(v)
+		if err != nil || number < 1 {
+			err = apperrors.Public(fmt.Errorf("invalid page %q", v), "page must be a positive number.")
+			writeAPIError(w, http.StatusBadRequest, err)
+			return models.Page{}, false
+		}
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 {
+			err = apperrors.Public(fmt.Errorf("invalid per_page %q", v), "per_page must be a positive number.")
+			writeAPIError(w, http.StatusBadRequest, err)
+			return models.Page{}, false
+		}
+	}
+	return models.NewPage(number, size), true
+}
+
+func writeAPIList(w http.ResponseWriter, data any, page models.Page, total int) {
+	writeJSON(w, http.StatusOK, apiList{
+		Data: data,
+		Pagination: apiPagination{
+			Page:       page.Number,
+			PerPage:    page.Size,
+			Total:      total,
+			TotalPages: page.Pages(total),
+		},
+	})
+}
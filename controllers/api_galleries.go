@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+type apiGallery struct {
+	ID                int               `json:"id"`
+	Title             string            `json:"title"`
+	Visibility        models.Visibility `json:"visibility"`
+	PasswordProtected bool              `json:"password_protected"`
+	ImagesURL         string            `json:"images_url"`
+}
+
+func apiGalleryFrom(gallery models.Gallery) apiGallery {
+	return apiGallery{
+		ID:                gallery.ID,
+		Title:             gallery.Title,
+		Visibility:        gallery.Visibility,
+		PasswordProtected: gallery.HasPassword(),
+		ImagesURL:         fmt.Sprintf("/api/v1/galleries/%d/images", gallery.ID),
+	}
+}
+
+type apiImage struct {
+	Filename    string    `json:"filename"`
+	Caption     string    `json:"caption"`
+	Position    int       `json:"position"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	ContentURL  string    `json:"content_url"`
+}
+
+func apiImageFrom(image models.Image) apiImage {
+	return apiImage{
+		Filename:    image.Filename,
+		Caption:     image.Caption,
+		Position:    image.Position,
+		ContentType: image.ContentType,
+		Size:        image.Size,
+		Width:       image.Width,
+		Height:      image.Height,
+		UploadedAt:  image.UploadedAt,
+		ContentURL:  fmt.Sprintf("/api/v1/galleries/%d/images/%s/content", image.GalleryID, url.PathEscape(image.Filename)),
+	}
+}
+
+// Galleries lists the galleries of the current user.
+func (a API) Galleries(w http.ResponseWriter, r *http.Request) {
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+	user := appctx.User(r.Context())
+	galleries, total, err := a.GalleryService.ByUserIDPage(user.ID, page)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	data := make([]apiGallery, 0, len(galleries))
+	for _, gallery := range galleries {
+		data = append(data, apiGalleryFrom(gallery))
+	}
+	writeAPIList(w, data, page, total)
+}
+
+func (a API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	if !user.Verified() {
+		writeAPIError(w, http.StatusForbidden, errUnverified())
+		return
+	}
+	var body struct {
+		Title string `json:"title"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	gallery, err := a.GalleryService.Create(body.Title, user.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiGalleryFrom(*gallery))
+}
+
+func (a API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionView)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, apiGalleryFrom(*gallery))
+}
+
+// UpdateGallery changes the fields present in the request body, leaving the
+// others as they are.
+func (a API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionManage)
+	if !ok {
+		return
+	}
+	var body struct {
+		Title      *string            `json:"title"`
+		Visibility *models.Visibility `json:"visibility"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if body.Title != nil {
+		gallery.Title = *body.Title
+	}
+	if body.Visibility != nil {
+		gallery.Visibility = *body.Visibility
+	}
+	if gallery.Visibility == models.VisibilityPublic && !appctx.User(r.Context()).Verified() {
+		writeAPIError(w, http.StatusForbidden, errUnverified())
+		return
+	}
+	err := a.GalleryService.Update(gallery)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidVisibility) {
+			err = apperrors.Public(err, "visibility must be private, unlisted or public.")
+			writeAPIError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiGalleryFrom(*gallery))
+}
+
+func (a API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionManage)
+	if !ok {
+		return
+	}
+	err := a.GalleryService.Delete(gallery.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionView)
+	if !ok {
+		return
+	}
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+	images, total, err := a.GalleryService.ImagesPage(gallery.ID, page)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	data := make([]apiImage, 0, len(images))
+	for _, image := range images {
+		data = append(data, apiImageFrom(image))
+	}
+	writeAPIList(w, data, page, total)
+}
+
+func (a API) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionView)
+	if !ok {
+		return
+	}
+	image, ok := a.image(w, r, gallery)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, apiImageFrom(image))
+}
+
+// ImageContent serves the image itself, or one of its renditions when the size
+// query parameter is set.
+func (a API) ImageContent(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionView)
+	if !ok {
+		return
+	}
+	image, ok := a.image(w, r, gallery)
+	if !ok {
+		return
+	}
+	var contents io.ReadCloser
+	var info *models.ObjectInfo
+	var err error
+	if size := r.URL.Query().Get("size"); size != "" {
+		rendition, ok := models.RenditionByName(size)
+		if !ok {
+			err = apperrors.Public(fmt.Errorf("unknown rendition %q", size), "size must be thumb, medium or large.")
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		contents, info, err = a.GalleryService.OpenRendition(image, rendition)
+	} else {
+		contents, info, err = a.GalleryService.OpenImage(image)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer contents.Close()
+	streamImage(w, r, image, contents, info)
+}
+
+// UploadImages adds the files sent in the images field of a multipart form to
+// the gallery.
+func (a API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	if !appctx.User(r.Context()).Verified() {
+		writeAPIError(w, http.StatusForbidden, errUnverified())
+		return
+	}
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionEditImages)
+	if !ok {
+		return
+	}
+	err := r.ParseMultipartForm(5 << 20)
+	if err != nil {
+		err = apperrors.Public(err, "The request body must be a multipart form.")
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	fileHeaders := r.MultipartForm.File["images"]
+	if len(fileHeaders) == 0 {
+		err = apperrors.Public(fmt.Errorf("no images uploaded"), "Upload at least one file in the images field.")
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	data := make([]apiImage, 0, len(fileHeaders))
+	for _, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer file.Close()
+
+		image, err := a.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		if err != nil {
+			var fileErr models.FileError
+			if errors.As(err, &fileErr) {
+				writeAPIError(w, http.StatusUnprocessableEntity, apperrors.Public(err, fileErrorMessage(fileHeader.Filename, fileErr)))
+				return
+			}
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		data = append(data, apiImageFrom(*image))
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Data []apiImage `json:"data"`
+	}{data})
+}
+
+func (a API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.galleryByID(w, r, models.GalleryPermissionEditImages)
+	if !ok {
+		return
+	}
+	image, ok := a.image(w, r, gallery)
+	if !ok {
+		return
+	}
+	err := a.GalleryService.DeleteImage(gallery.ID, image.Filename)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// galleryByID looks up the gallery in the URL and makes sure the user has the
+// permission in it. Galleries the user can't see are reported as not found.
+// Password protected galleries can only be used by those who can skip the
+// password, as the API has no way to enter it.
+func (a API) galleryByID(w http.ResponseWriter, r *http.Request, p models.GalleryPermission) (*models.Gallery, bool) {
+	notFound := apperrors.Public(models.ErrNotFound, "Gallery not found.")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, notFound)
+		return nil, false
+	}
+	gallery, err := a.GalleryService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			writeAPIError(w, http.StatusNotFound, notFound)
+			return nil, false
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	user := appctx.User(r.Context())
+	role, err := a.GalleryMemberService.Role(user, gallery)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if !models.CanViewGallery(user, gallery, role) || (gallery.HasPassword() && !models.CanSkipGalleryPassword(user, gallery, role)) {
+		writeAPIError(w, http.StatusNotFound, notFound)
+		return nil, false
+	}
+	if p != models.GalleryPermissionView && !models.CanInGallery(user, gallery, role, p) {
+		err = apperrors.Public(fmt.Errorf("user lacks gallery permission %s", p), "You are not authorized to edit this gallery.")
+		writeAPIError(w, http.StatusForbidden, err)
+		return nil, false
+	}
+	return gallery, true
+}
+
+func (a API) image(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (models.Image, bool) {
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	image, err := a.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = apperrors.Public(err, "Image not found.")
+			writeAPIError(w, http.StatusNotFound, err)
+			return models.Image{}, false
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return models.Image{}, false
+	}
+	return image, true
+}
+
+func errUnverified() error {
+	return apperrors.Public(fmt.Errorf("email address not verified"), "Verify your email address first.")
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+func (u Users) APITokens(w http.ResponseWriter, r *http.Request) {
+	u.renderAPITokens(w, r, "")
+}
+
+// renderAPITokens renders the personal API tokens of the user. newToken is only
+// set right after a token is created, as it is the only time it is available.
+func (u Users) renderAPITokens(w http.ResponseWriter, r *http.Request, newToken string, errs ...error) {
+	user := appctx.User(r.Context())
+	tokens, err := u.APITokenService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	type Token struct {
+		ID         int
+		Name       string
+		Scopes     string
+		CreatedAt  time.Time
+		ExpiresAt  *time.Time
+		LastUsedAt *time.Time
+		Expired    bool
+	}
+	var data struct {
+		Tokens   []Token
+		Scopes   []models.Scope
+		NewToken string
+	}
+	data.Scopes = models.AllScopes
+	data.NewToken = newToken
+	for _, token := range tokens {
+		t := Token{
+			ID:        token.ID,
+			Name:      token.Name,
+			Scopes:    token.Scopes.String(),
+			CreatedAt: token.CreatedAt,
+		}
+		if token.ExpiresAt.Valid {
+			t.ExpiresAt = &token.ExpiresAt.Time
+			t.Expired = token.ExpiresAt.Time.Before(time.Now())
+		}
+		if token.LastUsedAt.Valid {
+			t.LastUsedAt = &token.LastUsedAt.Time
+		}
+		data.Tokens = append(data.Tokens, t)
+	}
+	u.Templates.APITokens.Execute(w, r, data, errs...)
+}
+
+func (u Users) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		err = apperrors.Public(fmt.Errorf("api token without name"), "Give the token a name.")
+		u.renderAPITokens(w, r, "", err)
+		return
+	}
+	var scopes models.Scopes
+	for _, scope := range r.Form["scopes"] {
+		scopes = append(scopes, models.Scope(scope))
+	}
+	var duration time.Duration
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	}
+	token, err := u.APITokenService.Create(user.ID, name, scopes, duration)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidScope) {
+			err = apperrors.Public(err, "Pick at least one valid scope.")
+			u.renderAPITokens(w, r, "", err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.renderAPITokens(w, r, token.Token)
+}
+
+func (u Users) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.APITokenService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
+}
@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 const CookieSession = "session"
@@ -35,3 +39,27 @@ func deleteCookie(w http.ResponseWriter, name string) {
 	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
+
+// signCookieValue appends an HMAC of value and payload to value, so that it
+// can be checked with verifyCookieValue. payload is not stored in the cookie,
+// it only has to be known again when verifying.
+func signCookieValue(key []byte, value, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value + "|" + payload))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookieValue returns the value signed with signCookieValue, if the
+// signature is valid for the payload.
+func verifyCookieValue(key []byte, signed, payload string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	expected := signCookieValue(key, value, payload)
+	if !hmac.Equal([]byte(expected), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/migrations"
+	"lenslocked/models"
+	"lenslocked/rand"
+)
+
+// testDB connects to the Postgres database in LENSLOCKED_TEST_DATABASE and
+// migrates it. Tests that need a database are skipped when it isn't set, the
+// same way as in the models package.
+func testDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	dsn := os.Getenv("LENSLOCKED_TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("LENSLOCKED_TEST_DATABASE is not set")
+	}
+	db, err := sqlx.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testUser creates a user with a unique email address. The user, and with it
+// everything that belongs to them, is deleted when the test ends.
+func testUser(t *testing.T, db *sqlx.DB) *models.User {
+	t.Helper()
+	suffix, err := rand.Bytes(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{Email: fmt.Sprintf("test-%x@example.com", suffix), Role: models.RoleUser}
+	err = db.Get(&user.ID, `INSERT INTO users (email, password_hash) VALUES ($1, '') RETURNING id`, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := db.Exec(`DELETE FROM users WHERE id = $1`, user.ID)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	return &user
+}
+
+// fixedClock returns a clock that always reads the time in *now, so tests can
+// move it forward.
+func fixedClock(now *time.Time) func() time.Time {
+	return func() time.Time { return *now }
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+type changeEmailData struct {
+	Email    string
+	NewEmail string
+	// Pending is the address a confirmation link was sent to.
+	Pending string
+}
+
+type emailChangedData struct {
+	// Undone is set once the old address is back, Email being that address.
+	Undone bool
+	Email  string
+}
+
+func (u Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	data := changeEmailData{Email: user.Email}
+	change, err := u.EmailChangeService.Pending(user.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if change != nil {
+		data.Pending = change.NewEmail
+	}
+	u.Templates.ChangeEmail.Execute(w, r, data)
+}
+
+// ProcessChangeEmail sends a confirmation link to the new address. The email
+// address only changes once the link is followed.
+func (u Users) ProcessChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	data := changeEmailData{
+		Email:    user.Email,
+		NewEmail: r.FormValue("email"),
+	}
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			err = apperrors.Public(err, "The password you entered is incorrect.")
+			u.Templates.ChangeEmail.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	change, err := u.EmailChangeService.Create(user.ID, data.NewEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrEmailTaken):
+			err = apperrors.Public(err, "That email address is already in use.")
+		case errors.Is(err, models.ErrInvalidEmail):
+			err = apperrors.Public(err, "That email address is not valid.")
+		case errors.Is(err, models.ErrSameEmail):
+			err = apperrors.Public(err, "That is already your email address.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.Templates.ChangeEmail.Execute(w, r, data, err)
+		return
+	}
+	vals := url.Values{
+		"token": {change.Token},
+	}
+	// TODO: Make the url here configurable
+	err = u.EmailService.ConfirmEmailChange(change.NewEmail, "https://www.lenslocked.com/confirm-email?"+vals.Encode())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Pending = change.NewEmail
+	data.NewEmail = ""
+	u.Templates.ChangeEmail.Execute(w, r, data)
+}
+
+type confirmEmailChangeData struct {
+	Token string
+	// Undo is set for the link sent to the old address.
+	Undo bool
+}
+
+// ConfirmEmailChange only asks the user to confirm the change, like
+// ConfirmMagicLink does, so email scanners that open every link can't change
+// the address.
+func (u Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	u.Templates.ConfirmEmailChange.Execute(w, r, confirmEmailChangeData{
+		Token: r.FormValue("token"),
+	})
+}
+
+// ProcessConfirmEmailChange switches the user to the new address, signs them
+// out on every other device and tells the old address how to undo the change.
+func (u Users) ProcessConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	change, err := u.EmailChangeService.Confirm(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidToken):
+			err = apperrors.Public(err, "That link is invalid or has expired.")
+		case errors.Is(err, models.ErrEmailTaken):
+			err = apperrors.Public(err, "That email address is already in use.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.Templates.EmailChanged.Execute(w, r, emailChangedData{}, err)
+		return
+	}
+	// The session used to follow the link, if it is the user's, is the only
+	// one that stays signed in.
+	var token string
+	current := appctx.User(r.Context())
+	if current != nil && current.ID == change.UserID {
+		token, _ = readCookie(r, CookieSession)
+	}
+	if token != "" {
+		err = u.SessionService.DeleteOthers(change.UserID, token)
+	} else {
+		err = u.SessionService.DeleteAll(change.UserID)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	vals := url.Values{
+		"token": {change.UndoToken},
+	}
+	// TODO: Make the url here configurable
+	err = u.EmailService.EmailChanged(change.OldEmail, change.NewEmail, "https://www.lenslocked.com/undo-email-change?"+vals.Encode())
+	if err != nil {
+		fmt.Println(err)
+	}
+	if token != "" {
+		http.Redirect(w, r, "/users/me?email_changed=1", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/signin?"+url.Values{"email": {change.NewEmail}}.Encode(), http.StatusFound)
+}
+
+// UndoEmailChange asks the user to confirm they want their old address back.
+func (u Users) UndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	u.Templates.ConfirmEmailChange.Execute(w, r, confirmEmailChangeData{
+		Token: r.FormValue("token"),
+		Undo:  true,
+	})
+}
+
+// ProcessUndoEmailChange puts the old address back. As the change may have
+// been made by someone else, the user is signed out everywhere.
+func (u Users) ProcessUndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	change, err := u.EmailChangeService.Undo(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidToken):
+			err = apperrors.Public(err, "That link is invalid or has expired.")
+		case errors.Is(err, models.ErrEmailTaken):
+			err = apperrors.Public(err, "Your old email address is in use by another account. Please contact support.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.Templates.EmailChanged.Execute(w, r, emailChangedData{}, err)
+		return
+	}
+	err = u.SessionService.DeleteAll(change.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if current := appctx.User(r.Context()); current != nil && current.ID == change.UserID {
+		deleteCookie(w, CookieSession)
+		r = r.WithContext(appctx.WithUser(r.Context(), nil))
+	}
+	u.Templates.EmailChanged.Execute(w, r, emailChangedData{
+		Undone: true,
+		Email:  change.OldEmail,
+	})
+}
@@ -3,27 +3,50 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
 	"lenslocked/models"
 )
 
 type Galleries struct {
 	Templates struct {
-		Show  Template
-		New   Template
-		Edit  Template
-		Index Template
-	}
-	GalleryService *models.GalleryService
+		Show       Template
+		New        Template
+		Edit       Template
+		Index      Template
+		Public     Template
+		Password   Template
+		Invitation Template
+	}
+	GalleryService       *models.GalleryService
+	ShareLinkService     *models.ShareLinkService
+	GalleryMemberService *models.GalleryMemberService
+	EmailService         *models.EmailService
+	// AccessKey signs the cookies that grant access to password protected
+	// galleries.
+	AccessKey []byte
+	// PasswordAttempts limits wrong guesses of gallery passwords.
+	PasswordAttempts *AttemptLimiter
 }
 
+// galleryAccessDuration is how long a visitor can see a password protected
+// gallery after entering the password.
+const galleryAccessDuration = time.Hour
+
+// shareGrantDuration is how long the images of a gallery can be loaded after
+// it was viewed through a share link, even if that view used up the link.
+const shareGrantDuration = 10 * time.Minute
+
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Title string
@@ -51,22 +74,57 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionEditImages))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery, "")
+}
+
+// renderEdit renders the edit page of the gallery. newShareURL is only set
+// right after a share link is created, as it is the only time its token is
+// available. Editors only get to manage the images.
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, newShareURL string, errs ...error) {
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Src             string
+		Srcset          string
+	}
+	type ShareLink struct {
+		ID            int
+		Label         string
+		AllowDownload bool
+		Views         int
+		MaxViews      int
+		ExpiresAt     *time.Time
+		Expired       bool
+	}
+	role, err := g.galleryRole(w, r, gallery)
+	if err != nil {
+		return
 	}
 	data := struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Visibility  models.Visibility
+		SharePath   string
+		HasPassword bool
+		NewShareURL string
+		ShareLinks  []ShareLink
+		Images      []Image
+		CanManage   bool
+		Members     []models.GalleryMember
+		Invitations []models.GalleryInvitation
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Visibility:  gallery.Visibility,
+		SharePath:   slugPath(gallery),
+		HasPassword: gallery.HasPassword(),
+		NewShareURL: newShareURL,
+		CanManage:   models.CanInGallery(appctx.User(r.Context()), gallery, role, models.GalleryPermissionManage),
 	}
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
@@ -74,23 +132,79 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	basePath := fmt.Sprintf("/galleries/%d", gallery.ID)
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Src:             imageURL(basePath, image, nil, models.RenditionThumbnail.Name),
+			Srcset:          srcset(basePath, image, nil),
 		})
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	if !data.CanManage {
+		g.Templates.Edit.Execute(w, r, data, errs...)
+		return
+	}
+	links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	for _, link := range links {
+		shareLink := ShareLink{
+			ID:            link.ID,
+			Label:         link.Label,
+			AllowDownload: link.AllowDownload,
+			Views:         link.Views,
+			MaxViews:      int(link.MaxViews.Int32),
+		}
+		if link.ExpiresAt.Valid {
+			expiresAt := link.ExpiresAt.Time
+			shareLink.ExpiresAt = &expiresAt
+			shareLink.Expired = now.After(expiresAt)
+		}
+		if link.MaxViews.Valid && link.Views >= int(link.MaxViews.Int32) {
+			shareLink.Expired = true
+		}
+		data.ShareLinks = append(data.ShareLinks, shareLink)
+	}
+	data.Members, err = g.GalleryMemberService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Invitations, err = g.GalleryMemberService.Invitations(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
 	if err != nil {
 		return
 	}
 	title := r.FormValue("title")
 	gallery.Title = title
+	if visibility := r.FormValue("visibility"); visibility != "" {
+		gallery.Visibility = models.Visibility(visibility)
+	}
+	if !gallery.Visibility.Valid() {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	if gallery.Visibility == models.VisibilityPublic && !appctx.User(r.Context()).Verified() {
+		// Only users with a verified email address can publish galleries.
+		http.Redirect(w, r, "/users/me/verify-email", http.StatusFound)
+		return
+	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -102,11 +216,21 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
+		ID         int
+		Title      string
+		Visibility models.Visibility
+		TakenDown  bool
+	}
+	type SharedGallery struct {
 		ID    int
 		Title string
+		Role  models.GalleryRole
 	}
 	var data struct {
 		Galleries []Gallery
+		// SharedGalleries are the galleries of others the user is a
+		// member of.
+		SharedGalleries []SharedGallery
 	}
 	// TODO: Lookup the galleries we are going to render
 	user := appctx.User(r.Context())
@@ -117,24 +241,109 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+			TakenDown:  gallery.TakenDown(),
+		})
+	}
+	shared, err := g.GalleryMemberService.Galleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range shared {
+		data.SharedGalleries = append(data.SharedGalleries, SharedGallery{
 			ID:    gallery.ID,
 			Title: gallery.Title,
+			Role:  gallery.Role,
 		})
 	}
 	g.Templates.Index.Execute(w, r, data)
 }
 
+// Public lists every public gallery.
+func (g Galleries) Public(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID    int
+		Title string
+	}
+	var data struct {
+		Galleries []Gallery
+	}
+	galleries, err := g.GalleryService.Public()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:    gallery.ID,
+			Title: gallery.Title,
+		})
+	}
+	g.Templates.Public.Execute(w, r, data)
+}
+
+// Show renders the gallery to its owner, to anyone if it is public, or to
+// visitors with a valid share link.
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
+	if !g.unlocked(r, gallery) {
+		// Views are only counted once the password was entered.
+		_, err = g.authorizeView(w, r, gallery, false)
+		if err != nil {
+			return
+		}
+		g.renderPassword(w, r, fmt.Sprintf("/galleries/%d", gallery.ID))
+		return
+	}
+	link, err := g.authorizeView(w, r, gallery, true)
+	if err != nil {
+		return
+	}
+	var query url.Values
+	allowDownload := true
+	if link != nil {
+		query = url.Values{
+			"share": {r.FormValue("share")},
+			"grant": {g.shareGrant(gallery, link, r.FormValue("share"))},
+		}
+		allowDownload = link.AllowDownload
+	}
+	g.show(w, r, gallery, fmt.Sprintf("/galleries/%d", gallery.ID), query, allowDownload)
+}
+
+// ShowBySlug renders galleries reached through their unguessable slug, which
+// is how unlisted galleries are shared.
+func (g Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	if !g.unlocked(r, gallery) {
+		g.renderPassword(w, r, slugPath(gallery))
+		return
+	}
+	g.show(w, r, gallery, slugPath(gallery), nil, true)
+}
 
-	// TODO: render the gallery
+// show renders the gallery. basePath and query are what the gallery was
+// reached with, image URLs are built from them so they go through the same
+// access checks.
+func (g Galleries) show(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, basePath string, query url.Values, allowDownload bool) {
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		URL             string
+		Src             string
+		Srcset          string
 	}
 	var data struct {
 		ID     int
@@ -150,22 +359,32 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	for _, image := range images {
+		// Visitors that can't download the originals get the largest
+		// rendition instead.
+		size := ""
+		if !allowDownload {
+			size = models.RenditionLarge.Name
+		}
 		data.Images = append(data.Images, Image{
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			URL:             imageURL(basePath, image, query, size),
+			Src:             imageURL(basePath, image, query, models.RenditionMedium.Name),
+			Srcset:          srcset(basePath, image, query),
 		})
 	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
 	if err != nil {
 		return
 	}
-	g.GalleryService.Delete(gallery.ID)
+	err = g.GalleryService.Delete(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -198,23 +417,180 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, nil
 }
 
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	user := appctx.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
-		return fmt.Errorf("user does not have access to this gallery")
+func (g Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	gallery, err := g.GalleryService.BySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	role, err := g.galleryRole(w, r, gallery)
+	if err != nil {
+		return nil, err
+	}
+	if !models.CanViewGalleryBySlug(appctx.User(r.Context()), gallery, role) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, fmt.Errorf("user does not have access to this gallery")
+	}
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gallery, nil
+}
+
+// authorizeView checks that the current user can see the gallery, either
+// because of its visibility or because the request has a valid share token.
+// The share link is returned when it was used to grant access. countView
+// should only be set when rendering the gallery, not for each of its images,
+// which are allowed by the grant the view handed out instead.
+//
+// Visitors without access get a 404 rather than a 403 so that private
+// galleries can't be told apart from galleries that don't exist.
+func (g Galleries) authorizeView(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, countView bool) (*models.ShareLink, error) {
+	role, err := g.galleryRole(w, r, gallery)
+	if err != nil {
+		return nil, err
+	}
+	if models.CanViewGallery(appctx.User(r.Context()), gallery, role) {
+		return nil, nil
+	}
+	if token := r.FormValue("share"); token != "" && models.CanShareGallery(gallery) {
+		if !countView {
+			if link, ok := g.checkShareGrant(r, gallery, token); ok {
+				return link, nil
+			}
+		}
+		var link *models.ShareLink
+		var err error
+		if countView {
+			link, err = g.ShareLinkService.View(gallery.ID, token)
+		} else {
+			link, err = g.ShareLinkService.Check(gallery.ID, token)
+		}
+		if err == nil {
+			return link, nil
+		}
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return nil, err
+		}
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return nil, fmt.Errorf("user does not have access to this gallery")
+}
+
+// shareGrant lets the images of a gallery viewed through a share link load
+// for a little while without checking the link again. Otherwise the view that
+// reaches the limit of a link would be shown without its images. Grants of a
+// revoked link keep working until they expire.
+func (g Galleries) shareGrant(gallery *models.Gallery, link *models.ShareLink, token string) string {
+	expiresAt := time.Now().Add(shareGrantDuration)
+	value := fmt.Sprintf("%d|%d|%t", link.ID, expiresAt.Unix(), link.AllowDownload)
+	return signCookieValue(g.AccessKey, value, shareGrantPayload(gallery, token))
+}
+
+// checkShareGrant returns the share link the grant in the request was handed
+// out for, if the grant is valid and hasn't expired yet.
+func (g Galleries) checkShareGrant(r *http.Request, gallery *models.Gallery, token string) (*models.ShareLink, bool) {
+	signed := r.FormValue("grant")
+	if signed == "" {
+		return nil, false
+	}
+	value, ok := verifyCookieValue(g.AccessKey, signed, shareGrantPayload(gallery, token))
+	if !ok {
+		return nil, false
+	}
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !time.Now().Before(time.Unix(expiresAt, 0)) {
+		return nil, false
+	}
+	allowDownload, err := strconv.ParseBool(parts[2])
+	if err != nil {
+		return nil, false
+	}
+	return &models.ShareLink{ID: id, GalleryID: gallery.ID, AllowDownload: allowDownload}, true
+}
+
+// shareGrantPayload ties grants to the gallery and the share token they were
+// handed out with.
+func shareGrantPayload(gallery *models.Gallery, token string) string {
+	return fmt.Sprintf("share|%d|%s", gallery.ID, token)
+}
+
+// userMust makes sure the current user has the permission in the gallery.
+func (g Galleries) userMust(p models.GalleryPermission) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		role, err := g.galleryRole(w, r, gallery)
+		if err != nil {
+			return err
+		}
+		if !models.CanInGallery(appctx.User(r.Context()), gallery, role, p) {
+			http.Error(w, "You are not authorized to edit this gallery", http.StatusForbidden)
+			return fmt.Errorf("user does not have access to this gallery")
+		}
+		return nil
 	}
-	return nil
+}
+
+// galleryRole returns the role of the current user in the gallery.
+func (g Galleries) galleryRole(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (models.GalleryRole, error) {
+	role, err := g.GalleryMemberService.Role(appctx.User(r.Context()), gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return "", err
+	}
+	return role, nil
 }
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+	link, err := g.authorizeView(w, r, gallery, false)
+	if err != nil {
+		return
+	}
+	if !g.unlocked(r, gallery) {
+		http.Error(w, "This gallery is password protected", http.StatusForbidden)
+		return
+	}
+	g.serveImage(w, r, gallery, link == nil || link.AllowDownload)
+}
+
+func (g Galleries) ImageBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	if !g.unlocked(r, gallery) {
+		http.Error(w, "This gallery is password protected", http.StatusForbidden)
+		return
+	}
+	g.serveImage(w, r, gallery, true)
+}
+
+// serveImage writes the requested image of the gallery. When allowDownload is
+// false only renditions are served, never the original upload.
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, allowDownload bool) {
+	filename := g.filename(r)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Image not found", http.StatusNotFound)
@@ -222,13 +598,52 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var contents io.ReadCloser
+	var info *models.ObjectInfo
+	rendition, ok := models.RenditionByName(r.FormValue("size"))
+	if !ok && !allowDownload {
+		rendition, ok = models.RenditionLarge, true
+	}
+	if ok {
+		contents, info, err = g.GalleryService.OpenRendition(image, rendition)
+	} else {
+		contents, info, err = g.GalleryService.OpenImage(image)
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+	streamImage(w, r, image, contents, info)
+}
+
+// streamImage writes the contents of an image, or of one of its renditions, to
+// the response.
+func streamImage(w http.ResponseWriter, r *http.Request, image models.Image, contents io.Reader, info *models.ObjectInfo) {
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	// Files on disk can be seeked, which lets ServeContent handle range and
+	// conditional requests. Other storages are streamed as they are.
+	if rs, ok := contents.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, image.Filename, info.ModTime, rs)
+		return
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	_, err := io.Copy(w, contents)
+	if err != nil {
+		fmt.Println(err)
 	}
-	http.ServeFile(w, r, image.Path)
 }
 
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(r)
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionEditImages))
 	if err != nil {
 		return
 	}
@@ -241,6 +656,39 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// slugPath is the path unlisted galleries are shared with.
+func slugPath(gallery *models.Gallery) string {
+	return "/g/" + url.PathEscape(gallery.Slug)
+}
+
+// imageURL builds the URL of an image, or of one of its renditions when size
+// is set. query holds the parameters that granted access to the gallery.
+func imageURL(basePath string, image models.Image, query url.Values, size string) string {
+	vals := url.Values{}
+	for k, v := range query {
+		vals[k] = v
+	}
+	if size != "" {
+		vals.Set("size", size)
+	}
+	u := basePath + "/images/" + url.PathEscape(image.Filename)
+	if len(vals) > 0 {
+		u += "?" + vals.Encode()
+	}
+	return u
+}
+
+// srcset lists every rendition of the image with its width, so browsers can
+// pick the smallest one that fits.
+func srcset(basePath string, image models.Image, query url.Values) string {
+	var candidates []string
+	for _, rendition := range models.Renditions {
+		width, _ := rendition.Dimensions(image.Width, image.Height)
+		candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL(basePath, image, query, rendition.Name), width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
 func (g Galleries) filename(r *http.Request) string {
 	filename := chi.URLParam(r, "filename")
 	filename = filepath.Base(filename)
@@ -248,7 +696,7 @@ func (g Galleries) filename(r *http.Request) string {
 }
 
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionEditImages))
 	if err != nil {
 		return
 	}
@@ -267,12 +715,11 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		_, err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
 		if err != nil {
 			var fileErr models.FileError
 			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type of extension. Only png, gif, and jpg files can be uploaded", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
+				http.Error(w, fileErrorMessage(fileHeader.Filename, fileErr), http.StatusBadRequest)
 				return
 			}
 			fmt.Println(err)
@@ -283,3 +730,196 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
+
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	opts := models.ShareLinkOptions{
+		Label:         r.FormValue("label"),
+		AllowDownload: r.FormValue("allow_download") == "on",
+	}
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+		opts.Duration = time.Duration(n) * 24 * time.Hour
+	}
+	if views := r.FormValue("max_views"); views != "" {
+		n, err := strconv.Atoi(views)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid view limit", http.StatusBadRequest)
+			return
+		}
+		opts.MaxViews = n
+	}
+	link, err := g.ShareLinkService.Create(gallery.ID, opts)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	sharePath := fmt.Sprintf("/galleries/%d?%s", gallery.ID, url.Values{"share": {link.Token}}.Encode())
+	g.renderEdit(w, r, gallery, absoluteURL(r, sharePath))
+}
+
+func (g Galleries) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.ShareLinkService.Delete(gallery.ID, linkID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Protect sets the password visitors need to enter to see the gallery.
+func (g Galleries) Protect(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		http.Error(w, "The password can't be empty", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.SetPassword(gallery, password)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) Unprotect(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.SetPassword(gallery, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Unlock checks the password of a protected gallery and, if it is correct,
+// sets a cookie that grants access to the gallery for a while.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	_, err = g.authorizeView(w, r, gallery, false)
+	if err != nil {
+		return
+	}
+	g.unlock(w, r, gallery, fmt.Sprintf("/galleries/%d", gallery.ID))
+}
+
+func (g Galleries) UnlockBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.unlock(w, r, gallery, slugPath(gallery))
+}
+
+func (g Galleries) unlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, basePath string) {
+	redirectPath := basePath
+	if share := r.FormValue("share"); share != "" {
+		redirectPath += "?" + url.Values{"share": {share}}.Encode()
+	}
+	attemptKey := fmt.Sprintf("gallery-%d:%s", gallery.ID, clientIP(r))
+	if !g.PasswordAttempts.Allow(r.Context(), attemptKey) {
+		err := apperrors.Public(fmt.Errorf("too many password attempts"), "Too many password attempts. Please try again later.")
+		w.WriteHeader(http.StatusTooManyRequests)
+		g.renderPassword(w, r, basePath, err)
+		return
+	}
+	if !g.GalleryService.CheckPassword(gallery, r.FormValue("password")) {
+		err := apperrors.Public(fmt.Errorf("wrong gallery password"), "That password is incorrect.")
+		g.renderPassword(w, r, basePath, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(galleryAccessDuration)
+	cookie := newCookie(galleryAccessCookie(gallery), signCookieValue(g.AccessKey, strconv.FormatInt(expiresAt.Unix(), 10), galleryAccessPayload(gallery)))
+	cookie.Expires = expiresAt
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, redirectPath, http.StatusFound)
+}
+
+func (g Galleries) renderPassword(w http.ResponseWriter, r *http.Request, basePath string, errs ...error) {
+	var data struct {
+		Action string
+		Share  string
+	}
+	data.Action = basePath + "/unlock"
+	data.Share = r.FormValue("share")
+	g.Templates.Password.Execute(w, r, data, errs...)
+}
+
+// unlocked reports whether the current visitor can see a gallery that might
+// be password protected. Members and moderators never need the password.
+func (g Galleries) unlocked(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.HasPassword() {
+		return true
+	}
+	user := appctx.User(r.Context())
+	role, err := g.GalleryMemberService.Role(user, gallery)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if models.CanSkipGalleryPassword(user, gallery, role) {
+		return true
+	}
+	signed, err := readCookie(r, galleryAccessCookie(gallery))
+	if err != nil {
+		return false
+	}
+	value, ok := verifyCookieValue(g.AccessKey, signed, galleryAccessPayload(gallery))
+	if !ok {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(time.Unix(expiresAt, 0))
+}
+
+func galleryAccessCookie(gallery *models.Gallery) string {
+	return fmt.Sprintf("gallery_%d", gallery.ID)
+}
+
+// galleryAccessPayload ties access cookies to the current password of the
+// gallery, so that changing the password locks everyone out again.
+func galleryAccessPayload(gallery *models.Gallery) string {
+	return fmt.Sprintf("%d|%s", gallery.ID, gallery.PasswordHash.String)
+}
+
+// fileErrorMessage explains to the user why an uploaded file was refused.
+func fileErrorMessage(filename string, fileErr models.FileError) string {
+	return fmt.Sprintf("%v can't be uploaded: %v. Only png, gif, and jpg images of up to %d megapixels can be uploaded.",
+		filename, fileErr.Issue, models.MaxImagePixels/1_000_000)
+}
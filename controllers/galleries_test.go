@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"lenslocked/models"
+)
+
+func TestShareGrant(t *testing.T) {
+	g := Galleries{AccessKey: []byte("secret")}
+	gallery := &models.Gallery{ID: 1}
+	link := &models.ShareLink{ID: 7, GalleryID: 1, AllowDownload: true}
+	grant := g.shareGrant(gallery, link, "token")
+
+	request := func(grant string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/galleries/1/images/cat.png?"+url.Values{"share": {"token"}, "grant": {grant}}.Encode(), nil)
+	}
+
+	got, ok := g.checkShareGrant(request(grant), gallery, "token")
+	if !ok {
+		t.Fatal("checkShareGrant of a fresh grant = false, want true")
+	}
+	if got.ID != link.ID || !got.AllowDownload {
+		t.Errorf("checkShareGrant = %+v, want link %d allowing downloads", got, link.ID)
+	}
+
+	if _, ok := g.checkShareGrant(request(grant), gallery, "other"); ok {
+		t.Error("checkShareGrant with another share token = true, want false")
+	}
+	if _, ok := g.checkShareGrant(request(grant), &models.Gallery{ID: 2}, "token"); ok {
+		t.Error("checkShareGrant for another gallery = true, want false")
+	}
+	if _, ok := g.checkShareGrant(request(grant+"x"), gallery, "token"); ok {
+		t.Error("checkShareGrant of a tampered grant = true, want false")
+	}
+	expired := signCookieValue(g.AccessKey, "7|1|true", shareGrantPayload(gallery, "token"))
+	if _, ok := g.checkShareGrant(request(expired), gallery, "token"); ok {
+		t.Error("checkShareGrant of an expired grant = true, want false")
+	}
+}
+
+func TestFileErrorMessage(t *testing.T) {
+	msg := fileErrorMessage("bomb.png", models.FileError{Issue: "image is too large: 10000x10000 pixels"})
+	if !strings.Contains(msg, "bomb.png") || !strings.Contains(msg, "too large") {
+		t.Errorf("fileErrorMessage() = %q, want the file name and the issue", msg)
+	}
+	if strings.Contains(msg, "content type") {
+		t.Errorf("fileErrorMessage() = %q, want no mention of the content type", msg)
+	}
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// InviteMember emails an invitation to join the gallery as an editor or
+// viewer.
+func (g Galleries) InviteMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	email := r.FormValue("email")
+	invitation, err := g.GalleryMemberService.Invite(gallery.ID, email, models.GalleryRole(r.FormValue("role")))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidEmail):
+			err = apperrors.Public(err, "That email address is not valid.")
+		case errors.Is(err, models.ErrInvalidGalleryRole):
+			err = apperrors.Public(err, "Members can only be editors or viewers.")
+		case errors.Is(err, models.ErrGalleryOwner):
+			err = apperrors.Public(err, "You already own this gallery.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		g.renderEdit(w, r, gallery, "", err)
+		return
+	}
+	vals := url.Values{
+		"token": {invitation.Token},
+	}
+	inviter := appctx.User(r.Context()).Email
+	err = g.EmailService.GalleryInvitation(invitation.Email, inviter, gallery.Title, "https://www.lenslocked.com/invitations?"+vals.Encode())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	memberID, err := strconv.Atoi(chi.URLParam(r, "memberID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryMemberService.Remove(gallery.ID, memberID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) CancelInvitation(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMust(models.GalleryPermissionManage))
+	if err != nil {
+		return
+	}
+	invitationID, err := strconv.Atoi(chi.URLParam(r, "invitationID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryMemberService.Cancel(gallery.ID, invitationID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+type invitationData struct {
+	Token        string
+	GalleryTitle string
+	Role         models.GalleryRole
+	Email        string
+	// WrongEmail is set when the invitation is for another email address
+	// than the one of the current user.
+	WrongEmail bool
+}
+
+// Invitation asks the user to confirm they want to join the gallery. Like
+// magic links, invitations are only used up by the form, so email scanners
+// that open every link can't accept them.
+func (g Galleries) Invitation(w http.ResponseWriter, r *http.Request) {
+	data := invitationData{Token: r.FormValue("token")}
+	invitation, err := g.GalleryMemberService.Invitation(data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			err = apperrors.Public(err, "That invitation is invalid, expired or was accepted already.")
+			g.Templates.Invitation.Execute(w, r, invitationData{}, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	gallery, err := g.GalleryService.ByID(invitation.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.GalleryTitle = gallery.Title
+	data.Role = invitation.Role
+	data.Email = invitation.Email
+	data.WrongEmail = invitation.Email != appctx.User(r.Context()).Email
+	g.Templates.Invitation.Execute(w, r, data)
+}
+
+func (g Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	invitation, err := g.GalleryMemberService.Accept(r.FormValue("token"), appctx.User(r.Context()))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidToken):
+			err = apperrors.Public(err, "That invitation is invalid, expired or was accepted already.")
+		case errors.Is(err, models.ErrInvitationEmail):
+			err = apperrors.Public(err, "That invitation was sent to another email address. Please sign in with that address to accept it.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		g.Templates.Invitation.Execute(w, r, invitationData{}, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d", invitation.GalleryID), http.StatusFound)
+}
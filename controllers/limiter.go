@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"lenslocked/models"
+)
+
+// AttemptLimiter limits how often something can be tried per key, such as
+// gallery passwords from an IP address. Attempts are counted in the same
+// store as the RateLimit middleware, so every server shares them and idle
+// keys expire there.
+type AttemptLimiter struct {
+	// Name keeps the keys of different limiters apart.
+	Name  string
+	Store models.RateLimitStore
+	Limit models.RateLimit
+}
+
+// Allow counts an attempt for key and reports whether it may be made. Every
+// attempt counts, not just failed ones, as the store can only take tokens.
+// A nil AttemptLimiter allows everything.
+func (l *AttemptLimiter) Allow(ctx context.Context, key string) bool {
+	if l == nil {
+		return true
+	}
+	res, err := l.Store.Take(ctx, "attempts:"+l.Name+":"+key, l.Limit)
+	if err != nil {
+		// Like RateLimit, a broken store should not lock everyone out.
+		fmt.Println(err)
+		return true
+	}
+	return res.Allowed
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"lenslocked/models"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := &models.MemoryRateLimitStore{Now: func() time.Time { return now }}
+	limiter := &AttemptLimiter{
+		Name:  "test",
+		Store: store,
+		Limit: models.RateLimit{Requests: 3, Period: 3 * time.Minute},
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(ctx, "gallery-1:192.0.2.1") {
+			t.Fatalf("attempt %d was refused", i+1)
+		}
+	}
+	if limiter.Allow(ctx, "gallery-1:192.0.2.1") {
+		t.Errorf("attempt 4 was allowed, want it refused")
+	}
+	if !limiter.Allow(ctx, "gallery-2:192.0.2.1") {
+		t.Errorf("attempt for another key was refused")
+	}
+	now = now.Add(time.Minute)
+	if !limiter.Allow(ctx, "gallery-1:192.0.2.1") {
+		t.Errorf("attempt after a minute was refused, want one attempt to be back")
+	}
+
+	var nilLimiter *AttemptLimiter
+	if !nilLimiter.Allow(ctx, "gallery-1:192.0.2.1") {
+		t.Errorf("nil AttemptLimiter refused an attempt")
+	}
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"lenslocked/models"
+)
+
+const loginLockedMessage = "Too many failed sign in attempts. Try again later, or reset your password to unlock your account."
+
+// recordFailedLogin counts a wrong password and emails the owner of the
+// account if it just got locked.
+func recordFailedLogin(throttle *models.LoginThrottleService, emailService *models.EmailService, r *http.Request, email string) {
+	user, err := throttle.Fail(email, clientIP(r))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if user == nil {
+		return
+	}
+	vals := url.Values{
+		"email": {user.Email},
+	}
+	// TODO: Make the url here configurable
+	err = emailService.AccountLocked(user.Email, "https://www.lenslocked.com/forgot-pw?"+vals.Encode())
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// recordFailedTwoFactor counts a wrong two-factor code against the account
+// the challenge was for, the same way as a wrong password.
+func recordFailedTwoFactor(throttle *models.LoginThrottleService, emailService *models.EmailService, users *models.UserService, r *http.Request, userID int) {
+	user, err := users.ByID(userID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	recordFailedLogin(throttle, emailService, r, user.Email)
+}
+
+// unlockLogin forgets the failed sign ins of a user that completed the
+// two-factor step. It returns ErrLoginLocked if wrong codes locked the account
+// after the challenge was created, so that several challenges started at once
+// can't be used to keep guessing codes.
+func unlockLogin(throttle *models.LoginThrottleService, users *models.UserService, r *http.Request, userID int) error {
+	user, err := users.ByID(userID)
+	if err != nil {
+		return fmt.Errorf("unlock login: %w", err)
+	}
+	err = throttle.Check(user.Email, clientIP(r))
+	if err != nil {
+		return fmt.Errorf("unlock login: %w", err)
+	}
+	err = throttle.Unlock(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return nil
+}
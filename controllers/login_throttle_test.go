@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked/models"
+)
+
+// nopTemplate renders nothing. The tests only look at status codes, cookies
+// and redirects.
+type nopTemplate struct{}
+
+func (nopTemplate) Execute(w http.ResponseWriter, r *http.Request, data any, err ...error) {}
+
+// testTOTPCode computes the code an authenticator app would show for the
+// secret at time t.
+func testTOTPCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Now()
+	clock := fixedClock(&now)
+
+	throttle := &models.LoginThrottleService{DB: db, MaxAccountFailures: 3, Now: clock}
+	twoFactor := &models.TwoFactorService{DB: db, Issuer: "Lenslocked", Now: clock}
+	magicLinks := &models.MagicLinkService{DB: db, Now: clock}
+	u := Users{
+		UserService:          &models.UserService{DB: db},
+		SessionService:       &models.SessionService{DB: db},
+		TwoFactorService:     twoFactor,
+		LoginThrottleService: throttle,
+		MagicLinkService:     magicLinks,
+		// Nothing listens there, the lockout email just fails to send.
+		EmailService:           models.NewEmailService(models.SMTPConfig{Host: "localhost", Port: 1}),
+		AccountDeletionService: &models.AccountDeletionService{DB: db, Now: clock},
+	}
+	u.Templates.SignIn = nopTemplate{}
+	u.Templates.SignInTwoFactor = nopTemplate{}
+	u.Templates.MagicLink = nopTemplate{}
+
+	enrollment, err := twoFactor.Setup(user.ID, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = twoFactor.Confirm(user.ID, testTOTPCode(t, enrollment.Secret, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// post sends a form and returns the response.
+	post := func(handler http.HandlerFunc, path string, form url.Values, cookies ...*http.Cookie) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Result()
+	}
+	// signInWithLink uses a new magic link and returns the two-factor cookie
+	// it leads to.
+	signInWithLink := func() *http.Cookie {
+		t.Helper()
+		link, err := magicLinks.Create(user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := post(u.ProcessConfirmMagicLink, "/signin/link", url.Values{"token": {link.Token}})
+		if loc := res.Header.Get("Location"); res.StatusCode != http.StatusFound || loc != "/signin/2fa" {
+			t.Fatalf("ProcessConfirmMagicLink = %d to %q, want %d to /signin/2fa", res.StatusCode, loc, http.StatusFound)
+		}
+		for _, c := range res.Cookies() {
+			if c.Name == CookieTwoFactor {
+				return c
+			}
+		}
+		t.Fatal("ProcessConfirmMagicLink set no two-factor cookie")
+		return nil
+	}
+	ip := clientIP(httptest.NewRequest(http.MethodGet, "/", nil))
+
+	challenge := signInWithLink()
+	for i := 0; i < throttle.MaxAccountFailures; i++ {
+		post(u.ProcessSignInTwoFactor, "/signin/2fa", url.Values{"code": {"wrong code"}}, challenge)
+	}
+	err = throttle.Check(user.Email, ip)
+	if !errors.Is(err, models.ErrLoginLocked) {
+		t.Fatalf("Check() after wrong codes err = %v, want %v", err, models.ErrLoginLocked)
+	}
+
+	// The magic link is only the first factor, it must not unlock the
+	// account, and the lock holds for the right code as well.
+	now = now.Add(time.Minute)
+	challenge = signInWithLink()
+	err = throttle.Check(user.Email, ip)
+	if !errors.Is(err, models.ErrLoginLocked) {
+		t.Fatalf("Check() after magic link err = %v, want %v", err, models.ErrLoginLocked)
+	}
+	res := post(u.ProcessSignInTwoFactor, "/signin/2fa", url.Values{"code": {testTOTPCode(t, enrollment.Secret, now)}}, challenge)
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("ProcessSignInTwoFactor while locked = %d, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+
+	// Once the lock expired both factors sign the user in and the failures
+	// are forgotten.
+	now = now.Add(models.DefaultLockoutDuration)
+	challenge = signInWithLink()
+	res = post(u.ProcessSignInTwoFactor, "/signin/2fa", url.Values{"code": {testTOTPCode(t, enrollment.Secret, now)}}, challenge)
+	if loc := res.Header.Get("Location"); res.StatusCode != http.StatusFound || loc != "/galleries" {
+		t.Fatalf("ProcessSignInTwoFactor = %d to %q, want %d to /galleries", res.StatusCode, loc, http.StatusFound)
+	}
+	post(u.ProcessSignInTwoFactor, "/signin/2fa", url.Values{"code": {"wrong code"}}, signInWithLink())
+	err = throttle.Check(user.Email, ip)
+	if err != nil {
+		t.Errorf("Check() after signing in and one wrong code err = %v, want nil", err)
+	}
+}
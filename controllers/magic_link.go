@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+type magicLinkData struct {
+	Email string
+	Sent  bool
+}
+
+// MagicLink asks for the email address to send a sign in link to.
+func (u Users) MagicLink(w http.ResponseWriter, r *http.Request) {
+	u.Templates.MagicLink.Execute(w, r, magicLinkData{Email: r.FormValue("email")})
+}
+
+func (u Users) ProcessMagicLink(w http.ResponseWriter, r *http.Request) {
+	data := magicLinkData{Email: r.FormValue("email")}
+	link, err := u.MagicLinkService.Create(data.Email)
+	if err != nil {
+		// Unknown addresses get the same answer, so the form can't be used to
+		// find out who has an account.
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		vals := url.Values{
+			"token": {link.Token},
+		}
+		// TODO: Make the url here configurable
+		err = u.EmailService.MagicLink(data.Email, "https://www.lenslocked.com/signin/link/confirm?"+vals.Encode())
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+	}
+	data.Sent = true
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+// ConfirmMagicLink only asks the user to confirm they want to sign in. Email
+// scanners that open every link would otherwise use the link up, or sign in
+// themselves.
+func (u Users) ConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.ConfirmMagicLink.Execute(w, r, data)
+}
+
+func (u Users) ProcessConfirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	user, err := u.MagicLinkService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			err = apperrors.Public(err, "That sign in link is invalid, expired or was used already. Please ask for a new one.")
+			u.Templates.MagicLink.Execute(w, r, magicLinkData{}, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// The link is only one factor. Failed sign ins are forgotten once the
+	// session is created, after the two-factor step if there is one.
+	u.signIn(w, r, user)
+}
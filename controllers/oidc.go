@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// CookieOIDCState ties the callback of an identity provider to the browser
+// that started the sign in.
+const CookieOIDCState = "oidc_state"
+
+// OIDCLogin sends the user to the identity provider to sign in.
+func (u Users) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	login, err := u.OIDCService.Begin(chi.URLParam(r, "provider"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieOIDCState, login.State)
+	http.Redirect(w, r, login.URL, http.StatusFound)
+}
+
+// OIDCCallback finishes signing in once the identity provider sends the user
+// back. Users with two-factor authentication still have to enter a code.
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := u.OIDCService.Provider(chi.URLParam(r, "provider"))
+	if err != nil {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	data := u.newSignInData("")
+	state, _ := readCookie(r, CookieOIDCState)
+	deleteCookie(w, CookieOIDCState)
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		err = fmt.Errorf("oidc callback: %s: %s", providerErr, r.FormValue("error_description"))
+		err = apperrors.Public(err, fmt.Sprintf("Signing in with %s was cancelled or failed.", provider.DisplayName))
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		err = apperrors.Public(models.ErrChallengeExpired, "That sign in has expired. Please try again.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	user, err := u.OIDCService.Finish(provider.Name, state, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrChallengeExpired):
+			err = apperrors.Public(err, "That sign in has expired. Please try again.")
+		case errors.Is(err, models.ErrInvalidIDToken):
+			fmt.Println(err)
+			err = apperrors.Public(err, fmt.Sprintf("Your sign in with %s could not be verified.", provider.DisplayName))
+		case errors.Is(err, models.ErrOIDCEmailUnverified):
+			err = apperrors.Public(err, fmt.Sprintf("%s did not confirm your email address.", provider.DisplayName))
+		case errors.Is(err, models.ErrOIDCNoAccount):
+			err = apperrors.Public(err, "There is no account with your email address. Please sign up first.")
+		case errors.Is(err, models.ErrOIDCAccountUnverified):
+			err = apperrors.Public(err, "Please sign in with your password and verify your email address first.")
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	// The provider only vouches for one factor. Failed sign ins are forgotten
+	// once the session is created, after the two-factor step if there is one.
+	u.signIn(w, r, user)
+}
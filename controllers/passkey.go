@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// CookiePasskey identifies the passkey registration or sign in that is under
+// way in the browser.
+const CookiePasskey = "passkey"
+
+// passkeyResult tells the browser where to go once a passkey ceremony is
+// finished.
+type passkeyResult struct {
+	Redirect string `json:"redirect"`
+}
+
+// passkeyError makes the errors of finishing a passkey ceremony public, and
+// returns the status to respond with.
+func passkeyError(err error) (int, error) {
+	switch {
+	case errors.Is(err, models.ErrChallengeExpired):
+		return http.StatusBadRequest, apperrors.Public(err, "That took too long. Please try again.")
+	case errors.Is(err, models.ErrInvalidPasskey):
+		return http.StatusBadRequest, apperrors.Public(err, "Your passkey could not be verified.")
+	case errors.Is(err, models.ErrPasskeyRegistered):
+		return http.StatusConflict, apperrors.Public(err, "That passkey is already registered.")
+	default:
+		return http.StatusInternalServerError, err
+	}
+}
+
+// Passkeys lists the passkeys of the user and lets them add new ones.
+func (u Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	passkeys, err := u.PasskeyService.ByUser(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Passkeys []models.Passkey
+	}
+	data.Passkeys = passkeys
+	u.Templates.Passkeys.Execute(w, r, data)
+}
+
+// BeginPasskeyRegistration responds with the options for
+// navigator.credentials.create.
+func (u Users) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	registration, err := u.PasskeyService.BeginRegistration(user)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setCookie(w, CookiePasskey, registration.Token)
+	writeJSON(w, http.StatusOK, registration.Options)
+}
+
+// FinishPasskeyRegistration stores the credential the authenticator created.
+func (u Users) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	var body struct {
+		Name       string                    `json:"name"`
+		Credential models.PasskeyAttestation `json:"credential"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	token, _ := readCookie(r, CookiePasskey)
+	deleteCookie(w, CookiePasskey)
+	_, err := u.PasskeyService.FinishRegistration(user.ID, token, body.Name, body.Credential)
+	if err != nil {
+		status, err := passkeyError(err)
+		if status == http.StatusBadRequest {
+			fmt.Println(err)
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, passkeyResult{Redirect: "/users/me/passkeys"})
+}
+
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.PasskeyService.Delete(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+// BeginPasskeySignIn responds with the options for navigator.credentials.get.
+func (u Users) BeginPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	signIn, err := u.PasskeyService.BeginSignIn()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setCookie(w, CookiePasskey, signIn.Token)
+	writeJSON(w, http.StatusOK, signIn.Options)
+}
+
+// FinishPasskeySignIn signs in the user the passkey belongs to. Passkeys are
+// verified with a PIN or biometrics, so no two-factor code is asked for.
+func (u Users) FinishPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	var assertion models.PasskeyAssertion
+	if !readJSON(w, r, &assertion) {
+		return
+	}
+	token, _ := readCookie(r, CookiePasskey)
+	deleteCookie(w, CookiePasskey)
+	user, err := u.PasskeyService.FinishSignIn(token, assertion)
+	if err != nil {
+		status, err := passkeyError(err)
+		if status == http.StatusBadRequest {
+			fmt.Println(err)
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	if user.Suspended() {
+		err = apperrors.Public(models.ErrAccountSuspended, accountSuspendedMessage)
+		writeAPIError(w, http.StatusForbidden, err)
+		return
+	}
+	// Like a magic link, the passkey proves the user owns the account.
+	err = u.LoginThrottleService.Unlock(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	redirect, err := u.createSession(w, r, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrAccountSuspended) {
+			writeAPIError(w, http.StatusForbidden, apperrors.Public(err, accountSuspendedMessage))
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, passkeyResult{Redirect: redirect})
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// passwordError explains to the user why a new password was not accepted.
+func passwordError(err error) error {
+	var pwErr models.PasswordError
+	if !errors.As(err, &pwErr) {
+		return err
+	}
+	switch {
+	case errors.Is(pwErr.Err, models.ErrPasswordTooShort):
+		return apperrors.Public(err, fmt.Sprintf("Your password must be at least %d characters long.", pwErr.Limit))
+	case errors.Is(pwErr.Err, models.ErrPasswordTooLong):
+		return apperrors.Public(err, fmt.Sprintf("Your password can be at most %d bytes long. Letters with accents and emoji take up more than one byte.", pwErr.Limit))
+	case errors.Is(pwErr.Err, models.ErrPasswordIsEmail):
+		return apperrors.Public(err, "Your password can't be your email address.")
+	case errors.Is(pwErr.Err, models.ErrPasswordBreached):
+		return apperrors.Public(err, "That password has appeared in a data breach, so attackers are likely to try it. Please choose a different one.")
+	}
+	return err
+}
+
+func (u Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u.Templates.ChangePassword.Execute(w, r, nil)
+}
+
+// ProcessChangePassword sets a new password once the current one is
+// confirmed, and signs the user out on every other device.
+func (u Users) ProcessChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("current_password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			err = apperrors.Public(err, "The current password you entered is incorrect.")
+			u.Templates.ChangePassword.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.UpdatePassword(user.ID, r.FormValue("password"))
+	if err != nil {
+		var pwErr models.PasswordError
+		if errors.As(err, &pwErr) {
+			u.Templates.ChangePassword.Execute(w, r, nil, passwordError(err))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me?password_changed=1", http.StatusFound)
+}
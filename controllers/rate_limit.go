@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+// RateLimitKey picks the bucket a request is counted against.
+type RateLimitKey func(r *http.Request) string
+
+// KeyByIP counts requests per client IP address.
+func KeyByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// KeyByUser counts requests per signed in user, and per IP address for
+// everyone else. It must be used after a middleware that sets the user.
+func KeyByUser(r *http.Request) string {
+	if user := appctx.User(r.Context()); user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return KeyByIP(r)
+}
+
+// KeyByToken counts requests per session or personal API token, and per IP
+// address for requests without a valid one. It must be used after
+// API.SetUser, so that only tokens it looked up get their own bucket and
+// made up tokens can't be used to get around the limit.
+func KeyByToken(r *http.Request) string {
+	if id, ok := r.Context().Value(tokenIDKey).(string); ok {
+		return "token:" + id
+	}
+	return KeyByIP(r)
+}
+
+// RateLimit is a middleware that rejects requests over Limit with a 429. Name
+// keeps the buckets of different route groups apart.
+type RateLimit struct {
+	Name  string
+	Store models.RateLimitStore
+	Limit models.RateLimit
+	// Key defaults to KeyByIP.
+	Key RateLimitKey
+	// Template renders the error page. Without one the error is written as
+	// JSON, like the API does.
+	Template Template
+}
+
+func (rl RateLimit) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := rl.Key
+		if key == nil {
+			key = KeyByIP
+		}
+		res, err := rl.Store.Take(r.Context(), rl.Name+":"+key(r), rl.Limit)
+		if err != nil {
+			// A broken store should not take the site down with it.
+			fmt.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.Limit.Requests))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		if res.Allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		retryAfter := int(math.Ceil(res.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		err = apperrors.Public(fmt.Errorf("rate limit %s exceeded", rl.Name), "You are doing that too often. Please wait a moment and try again.")
+		if rl.Template == nil {
+			writeAPIError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		rl.Template.Execute(w, r, nil, err)
+	})
+}
@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyByToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/galleries", nil)
+	r.Header.Set("Authorization", "Bearer made-up")
+	if got, want := KeyByToken(r), KeyByIP(r); got != want {
+		t.Errorf("KeyByToken() of a token SetUser didn't resolve = %q, want %q", got, want)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), tokenIDKey, "session:7"))
+	if got, want := KeyByToken(r), "token:session:7"; got != want {
+		t.Errorf("KeyByToken() = %q, want %q", got, want)
+	}
+}
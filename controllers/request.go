@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+)
+
+// clientIP returns the IP address of the client that sent the request,
+// without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// absoluteURL turns a path on this server into a full URL, using the host the
+// request was sent to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/skip2/go-qrcode"
+
+	"lenslocked/appctx"
+	apperrors "lenslocked/errors"
+	"lenslocked/models"
+)
+
+const CookieTwoFactor = "two_factor"
+
+// TwoFactor shows whether two-factor authentication is enabled for the current
+// user, and lets them enable or disable it.
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	var data struct {
+		Enabled bool
+	}
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Enabled = enabled
+	u.Templates.TwoFactor.Execute(w, r, data)
+}
+
+// SetupTwoFactor generates a new secret and shows it to the user, both as a QR
+// code and as text, so they can add it to their authenticator app.
+func (u Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	enrollment, err := u.TwoFactorService.Setup(user.ID, user.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, 256)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Secret string
+		URI    template.URL
+		QRCode template.URL
+	}
+	data.Secret = enrollment.Secret
+	data.URI = template.URL(enrollment.URI)
+	data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	u.Templates.TwoFactorSetup.Execute(w, r, data)
+}
+
+func (u Users) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	codes, err := u.TwoFactorService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			err = apperrors.Public(err, "That code is not valid. Please scan the new QR code and try again.")
+			var data struct {
+				Enabled bool
+			}
+			u.Templates.TwoFactor.Execute(w, r, data, err)
+			return
+		}
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		RecoveryCodes []string
+	}
+	data.RecoveryCodes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+// DisableTwoFactor requires the user to enter their password again before
+// two-factor authentication is turned off.
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("password"))
+	if err != nil {
+		err = apperrors.Public(err, "The password you entered is incorrect.")
+		var data struct {
+			Enabled bool
+		}
+		data.Enabled = true
+		u.Templates.TwoFactor.Execute(w, r, data, err)
+		return
+	}
+	err = u.TwoFactorService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+}
+
+// SignInTwoFactor renders the second sign in step. It expects the challenge
+// cookie set by ProcessSignIn.
+func (u Users) SignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.SignInTwoFactor.Execute(w, r, nil)
+}
+
+func (u Users) ProcessSignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	userID, err := u.TwoFactorService.CompleteChallenge(token, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCode):
+			recordFailedTwoFactor(u.LoginThrottleService, u.EmailService, u.UserService, r, userID)
+			err = apperrors.Public(err, "That code is not valid.")
+			u.Templates.SignInTwoFactor.Execute(w, r, nil, err)
+		case errors.Is(err, models.ErrChallengeExpired):
+			deleteCookie(w, CookieTwoFactor)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	deleteCookie(w, CookieTwoFactor)
+	err = unlockLogin(u.LoginThrottleService, u.UserService, r, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrLoginLocked) {
+			err = apperrors.Public(err, loginLockedMessage)
+			w.WriteHeader(http.StatusTooManyRequests)
+			u.Templates.SignIn.Execute(w, r, u.newSignInData(""), err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	redirect, err := u.createSession(w, r, userID)
+	if err != nil {
+		u.sessionError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
@@ -1,11 +1,14 @@
 package controllers
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 
 	"lenslocked/appctx"
 	apperrors "lenslocked/errors"
@@ -14,17 +17,58 @@ import (
 
 type Users struct {
 	Templates struct {
-		New            Template
-		SignIn         Template
-		CurrentUser    Template
-		ForgotPassword Template
-		CheckYourEmail Template
-		ResetPassword  Template
+		New                Template
+		SignIn             Template
+		CurrentUser        Template
+		ForgotPassword     Template
+		CheckYourEmail     Template
+		ResetPassword      Template
+		Sessions           Template
+		TwoFactor          Template
+		TwoFactorSetup     Template
+		RecoveryCodes      Template
+		SignInTwoFactor    Template
+		VerifyEmail        Template
+		APITokens          Template
+		DeleteAccount      Template
+		AccountDeleted     Template
+		AccountExport      Template
+		ChangeEmail        Template
+		ConfirmEmailChange Template
+		EmailChanged       Template
+		ChangePassword     Template
+		MagicLink          Template
+		ConfirmMagicLink   Template
+		Passkeys           Template
+	}
+	UserService              *models.UserService
+	SessionService           *models.SessionService
+	PasswordResetService     *models.PasswordResetService
+	EmailService             *models.EmailService
+	TwoFactorService         *models.TwoFactorService
+	EmailVerificationService *models.EmailVerificationService
+	APITokenService          *models.APITokenService
+	LoginThrottleService     *models.LoginThrottleService
+	AccountDeletionService   *models.AccountDeletionService
+	AccountExportService     *models.AccountExportService
+	EmailChangeService       *models.EmailChangeService
+	MagicLinkService         *models.MagicLinkService
+	PasskeyService           *models.PasskeyService
+	OIDCService              *models.OIDCService
+}
+
+type signInData struct {
+	Email    string
+	Password string
+	// Providers are the identity providers users can sign in with instead.
+	Providers []*models.OIDCProvider
+}
+
+func (u Users) newSignInData(email string) signInData {
+	return signInData{
+		Email:     email,
+		Providers: u.OIDCService.ProviderList(),
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -36,10 +80,7 @@ func (u Users) New(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
-	}
-	data.Email = r.FormValue("email")
+	data := u.newSignInData(r.FormValue("email"))
 	u.Templates.SignIn.Execute(w, r, data)
 }
 
@@ -55,10 +96,20 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		if errors.Is(err, models.ErrEmailTaken) {
 			err = apperrors.Public(err, "That email address is already in use.")
 		}
+		if errors.Is(err, models.ErrInvalidEmail) {
+			err = apperrors.Public(err, "That email address is not valid.")
+		}
+		err = passwordError(err)
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	// The account can be used right away, failing to send the verification
+	// email only means the user will have to ask for a new one.
+	err = u.sendVerification(user)
+	if err != nil {
+		fmt.Println(err)
+	}
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
 		fmt.Println(err)
 		// TODO: should use warning of not being able to log in
@@ -70,31 +121,110 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email    string
-		Password string
-	}
-	data.Email = r.FormValue("email")
+	data := u.newSignInData(r.FormValue("email"))
 	data.Password = r.FormValue("password")
+	err := u.LoginThrottleService.Check(data.Email, clientIP(r))
+	if err != nil {
+		if errors.Is(err, models.ErrLoginLocked) {
+			err = apperrors.Public(err, loginLockedMessage)
+			w.WriteHeader(http.StatusTooManyRequests)
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
 	user, err := u.UserService.Authenticate(data.Email, data.Password)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			recordFailedLogin(u.LoginThrottleService, u.EmailService, r, data.Email)
 			// TODO: this should show a modal saying you couldn't log in
 			http.Redirect(w, r, "/signin", http.StatusFound)
 			return
 		}
+		if errors.Is(err, models.ErrAccountSuspended) {
+			err = apperrors.Public(err, accountSuspendedMessage)
+			w.WriteHeader(http.StatusForbidden)
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	// Failed attempts are only forgotten once the user got through every
+	// step, see signIn and ProcessSignInTwoFactor.
+	u.signIn(w, r, user)
+}
+
+// accountSuspendedMessage is shown to suspended users that try to sign in.
+const accountSuspendedMessage = "Your account has been suspended. Please contact us if you think this is a mistake."
+
+// signIn finishes signing in a user that proved who they are. Users with
+// two-factor authentication still have to enter a code first.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.Suspended() {
+		err := apperrors.Public(models.ErrAccountSuspended, accountSuspendedMessage)
+		w.WriteHeader(http.StatusForbidden)
+		u.Templates.SignIn.Execute(w, r, u.newSignInData(user.Email), err)
+		return
+	}
+	twoFactor, err := u.TwoFactorService.Enabled(user.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	if twoFactor {
+		// The session is only created once the second factor is verified.
+		challenge, err := u.TwoFactorService.CreateChallenge(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, CookieTwoFactor, challenge.Token)
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+	redirect, err := u.createSession(w, r, user.ID)
+	if err != nil {
+		u.sessionError(w, r, err)
+		return
+	}
+	err = u.LoginThrottleService.Unlock(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// createSession signs the user in on this device and returns where to send
+// them next.
+func (u Users) createSession(w http.ResponseWriter, r *http.Request, userID int) (string, error) {
+	session, err := u.SessionService.Create(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return "", err
+	}
 	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	if cancelAccountDeletion(u.AccountDeletionService, userID) {
+		return "/users/me?deletion_cancelled=1", nil
+	}
+	return "/galleries", nil
+}
+
+// sessionError responds to a failure to create a session. The account can be
+// suspended after the user started signing in.
+func (u Users) sessionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, models.ErrAccountSuspended) {
+		err = apperrors.Public(err, accountSuspendedMessage)
+		w.WriteHeader(http.StatusForbidden)
+		u.Templates.SignIn.Execute(w, r, u.newSignInData(""), err)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 }
 
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -117,12 +247,95 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	user := appctx.User(r.Context())
 	var data struct {
-		UserName string
+		UserName          string
+		Verified          bool
+		DeletionCancelled bool
+		EmailChanged      bool
+		PasswordChanged   bool
+		CanModerate       bool
+		CanManageUsers    bool
 	}
 	data.UserName = user.Email
+	data.Verified = user.Verified()
+	data.DeletionCancelled = r.FormValue("deletion_cancelled") != ""
+	data.EmailChanged = r.FormValue("email_changed") != ""
+	data.PasswordChanged = r.FormValue("password_changed") != ""
+	data.CanModerate = models.Can(user, models.PermissionModerateGalleries)
+	data.CanManageUsers = models.Can(user, models.PermissionManageUsers)
 	u.Templates.CurrentUser.Execute(w, r, data)
 }
 
+// Sessions lists every active session of the current user so they can revoke
+// the ones they don't recognize.
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	type Session struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+	var data struct {
+		Sessions []Session
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    u.SessionService.IsToken(session, token),
+		})
+	}
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+func (u Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.SessionService.DeleteByID(user.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+func (u Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
 func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
@@ -172,7 +385,28 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
 
-	user, err := u.PasswordResetService.Consume(data.Token)
+	// The password is checked before the token is used up, so the user can
+	// try again with a better one.
+	user, err := u.PasswordResetService.User(data.Token)
+	if err != nil {
+		fmt.Println(err)
+		// TODO: Distinguish between server error and invalid token errors
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.ValidatePassword(user.Email, data.Password)
+	if err != nil {
+		var pwErr models.PasswordError
+		if errors.As(err, &pwErr) {
+			u.Templates.ResetPassword.Execute(w, r, data, passwordError(err))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	user, err = u.PasswordResetService.Consume(data.Token)
 	if err != nil {
 		fmt.Println(err)
 		// TODO: Distinguish between server error and invalid token errors
@@ -186,17 +420,94 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	// Whoever might have known the old password is signed out.
+	err = u.SessionService.DeleteAll(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
 
-	// Sign the user in now that they have reset their password.
-	// Any errors from this point onware should redirect to the sign in page.
-	session, err := u.SessionService.Create(user.ID)
+	// Sign the user in now that they have reset their password. The reset
+	// email is only one factor, users with two-factor authentication still
+	// have to enter a code before the account is unlocked.
+	u.signIn(w, r, user)
+}
+
+// VerifyEmail explains why an unverified user was sent here and lets them ask
+// for a new verification email.
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	var data struct {
+		Email    string
+		Verified bool
+		Sent     bool
+	}
+	data.Email = user.Email
+	data.Verified = user.Verified()
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	if user.Verified() {
+		http.Redirect(w, r, "/users/me", http.StatusFound)
+		return
+	}
+	err := u.sendVerification(user)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	var data struct {
+		Email    string
+		Verified bool
+		Sent     bool
+	}
+	data.Email = user.Email
+	data.Sent = true
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := u.EmailVerificationService.Consume(r.FormValue("token"))
+	if err != nil {
+		fmt.Println(err)
+		err = apperrors.Public(err, "That verification link is invalid or has expired.")
+		var data struct {
+			Email    string
+			Verified bool
+			Sent     bool
+		}
+		if current := appctx.User(r.Context()); current != nil {
+			data.Email = current.Email
+			data.Verified = current.Verified()
+		}
+		u.Templates.VerifyEmail.Execute(w, r, data, err)
+		return
+	}
+	if current := appctx.User(r.Context()); current != nil && current.ID == user.ID {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/signin?"+url.Values{"email": {user.Email}}.Encode(), http.StatusFound)
+}
+
+func (u Users) sendVerification(user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	// TODO: Make the url here configurable
+	err = u.EmailService.VerifyEmail(user.Email, "https://www.lenslocked.com/verify-email?"+vals.Encode())
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+	return nil
 }
 
 type UserMiddleware struct {
@@ -233,3 +544,35 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireVerifiedUser must be used after RequireUser. Users that have not
+// verified their email address yet are sent to the verification page.
+func (umw UserMiddleware) RequireVerifiedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := appctx.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.Verified() {
+			http.Redirect(w, r, "/users/me/verify-email", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission must be used after RequireUser. Users without the
+// permission get a 404, so the pages they can't use don't give away that
+// they exist.
+func (umw UserMiddleware) RequirePermission(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !models.Can(appctx.User(r.Context()), p) {
+				http.Error(w, "Page not found", http.StatusNotFound)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
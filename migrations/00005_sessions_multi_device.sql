@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+    DROP CONSTRAINT IF EXISTS sessions_user_id_key;
+ALTER TABLE sessions
+    ADD COLUMN created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN expires_at   TIMESTAMPTZ NOT NULL DEFAULT now() + INTERVAL '30 days',
+    ADD COLUMN user_agent   TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN ip_address   TEXT        NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS sessions_user_id_idx;
+ALTER TABLE sessions
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS last_seen_at,
+    DROP COLUMN IF EXISTS expires_at,
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS ip_address;
+-- +goose StatementEnd
@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS totp_credentials
+(
+    id             SERIAL PRIMARY KEY,
+    user_id        INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    secret         TEXT   NOT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at   TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    id        SERIAL PRIMARY KEY,
+    user_id   INT REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT UNIQUE NOT NULL,
+    used_at   TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_challenges
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    attempts   INT         NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS two_factor_challenges;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS totp_credentials;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN verified_at TIMESTAMPTZ;
+-- Accounts created before verification existed are trusted as they are.
+UPDATE users
+SET verified_at = now();
+
+CREATE TABLE IF NOT EXISTS email_verifications
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_verifications;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS verified_at;
+-- +goose StatementEnd
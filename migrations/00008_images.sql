@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS images
+(
+    id           SERIAL PRIMARY KEY,
+    gallery_id   INT REFERENCES galleries (id) ON DELETE CASCADE,
+    filename     TEXT        NOT NULL,
+    storage_key  TEXT        NOT NULL,
+    caption      TEXT        NOT NULL DEFAULT '',
+    position     INT         NOT NULL DEFAULT 0,
+    content_type TEXT        NOT NULL DEFAULT '',
+    size         BIGINT      NOT NULL DEFAULT 0,
+    width        INT         NOT NULL DEFAULT 0,
+    height       INT         NOT NULL DEFAULT 0,
+    content_hash TEXT        NOT NULL DEFAULT '',
+    uploaded_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS images;
+-- +goose StatementEnd
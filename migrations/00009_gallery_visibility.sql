@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries used to be readable by anyone, existing ones start out private so
+-- their owners can decide who gets to see them.
+ALTER TABLE galleries
+    ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private',
+    ADD COLUMN slug       TEXT UNIQUE;
+UPDATE galleries
+SET slug = replace(gen_random_uuid()::text, '-', '')
+WHERE slug IS NULL;
+ALTER TABLE galleries
+    ALTER COLUMN slug SET NOT NULL,
+    ADD CONSTRAINT galleries_visibility_check CHECK (visibility IN ('private', 'unlisted', 'public'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN IF EXISTS visibility,
+    DROP COLUMN IF EXISTS slug;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS share_links
+(
+    id             SERIAL PRIMARY KEY,
+    gallery_id     INT REFERENCES galleries (id) ON DELETE CASCADE,
+    token_hash     TEXT UNIQUE NOT NULL,
+    label          TEXT        NOT NULL DEFAULT '',
+    allow_download BOOLEAN     NOT NULL DEFAULT FALSE,
+    max_views      INT,
+    views          INT         NOT NULL DEFAULT 0,
+    expires_at     TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS share_links;
+-- +goose StatementEnd
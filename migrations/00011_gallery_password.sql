@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+    ADD COLUMN password_hash TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN IF EXISTS password_hash;
+-- +goose StatementEnd
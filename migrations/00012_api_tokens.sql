@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS api_tokens
+(
+    id           SERIAL PRIMARY KEY,
+    user_id      INT REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT        NOT NULL,
+    token_hash   TEXT UNIQUE NOT NULL,
+    scopes       TEXT        NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS api_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS account_exports
+(
+    id           SERIAL PRIMARY KEY,
+    user_id      INT REFERENCES users (id) ON DELETE CASCADE,
+    status       TEXT        NOT NULL DEFAULT 'pending',
+    storage_key  TEXT,
+    size         BIGINT,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at   TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    expires_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS account_exports_user_id_idx ON account_exports (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS account_exports;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS email_changes
+(
+    id              SERIAL PRIMARY KEY,
+    user_id         INT REFERENCES users (id) ON DELETE CASCADE,
+    old_email       TEXT        NOT NULL,
+    new_email       TEXT        NOT NULL,
+    token_hash      TEXT UNIQUE NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    confirmed_at    TIMESTAMPTZ,
+    undo_token_hash TEXT UNIQUE,
+    undo_expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS email_changes_user_id_idx ON email_changes (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_changes;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS passkeys
+(
+    id            SERIAL PRIMARY KEY,
+    user_id       INT REFERENCES users (id) ON DELETE CASCADE,
+    name          TEXT        NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    public_key    BYTEA       NOT NULL,
+    algorithm     INT         NOT NULL,
+    sign_count    BIGINT      NOT NULL DEFAULT 0,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
+
+CREATE TABLE IF NOT EXISTS passkey_challenges
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    challenge  BYTEA       NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS passkey_challenges;
+DROP TABLE IF EXISTS passkeys;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS oidc_logins
+(
+    id            SERIAL PRIMARY KEY,
+    provider      TEXT        NOT NULL,
+    state_hash    TEXT UNIQUE NOT NULL,
+    nonce         TEXT        NOT NULL,
+    code_verifier TEXT        NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT REFERENCES users (id) ON DELETE CASCADE,
+    provider   TEXT        NOT NULL,
+    subject    TEXT        NOT NULL,
+    email      TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS oidc_logins;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role         TEXT NOT NULL DEFAULT 'user',
+    ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;
+
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS taken_down_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN IF EXISTS taken_down_at;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS suspended_at,
+    DROP COLUMN IF EXISTS role;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS gallery_members
+(
+    id         SERIAL PRIMARY KEY,
+    gallery_id INT         NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id    INT         NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role       TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS gallery_members_user_id_idx ON gallery_members (user_id);
+
+CREATE TABLE IF NOT EXISTS gallery_invitations
+(
+    id         SERIAL PRIMARY KEY,
+    gallery_id INT         NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    email      TEXT        NOT NULL,
+    role       TEXT        NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (gallery_id, email)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS gallery_invitations;
+DROP TABLE IF EXISTS gallery_members;
+-- +goose StatementEnd
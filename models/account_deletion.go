@@ -0,0 +1,181 @@
+package models
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultDeletionGracePeriod is how long an account waits before it is
+// deleted, during which signing in cancels the deletion.
+const DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+
+//go:embed account_deletion.sql
+var accountDeletionQueriesFile string
+
+var accountDeletionQueries map[string]string
+
+func init() {
+	accountDeletionQueries = sqlf.Load(accountDeletionQueriesFile)
+}
+
+// AccountDeletionService lets users delete their account. Accounts are only
+// marked for deletion at first, and purged once the grace period is over.
+type AccountDeletionService struct {
+	DB *sqlx.DB
+	// GalleryService deletes the galleries of purged accounts, along with
+	// their images.
+	GalleryService *GalleryService
+	// GracePeriod defaults to DefaultDeletionGracePeriod.
+	GracePeriod time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Request marks the account for deletion and signs it out everywhere. It
+// returns when the account will be deleted.
+func (ad *AccountDeletionService) Request(userID int) (time.Time, error) {
+	now := ad.now()
+	tx, err := ad.DB.Beginx()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("request account deletion: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(accountDeletionQueries["request"], userID, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("request account deletion: %w", err)
+	}
+	_, err = tx.Exec(accountDeletionQueries["delete_sessions"], userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("request account deletion: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("request account deletion: %w", err)
+	}
+	return now.Add(ad.gracePeriod()), nil
+}
+
+// Cancel stops a pending deletion. It reports whether there was one.
+func (ad *AccountDeletionService) Cancel(userID int) (bool, error) {
+	res, err := ad.DB.Exec(accountDeletionQueries["cancel"], userID)
+	if err != nil {
+		return false, fmt.Errorf("cancel account deletion: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("cancel account deletion: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Purge deletes every account whose grace period is over and returns how many
+// were deleted. The images of their galleries are removed from the storage of
+// the GalleryService, as are the archives of the user's data exports.
+// Sessions, password resets and everything else the user owns go with the
+// user row.
+func (ad *AccountDeletionService) Purge() (int, error) {
+	cutoff := ad.now().Add(-ad.gracePeriod())
+	var userIDs []int
+	err := ad.DB.Select(&userIDs, accountDeletionQueries["due"], cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("purge accounts: %w", err)
+	}
+	var purged int
+	var errs []error
+	for _, userID := range userIDs {
+		deleted, err := ad.purge(userID, cutoff)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if deleted {
+			purged++
+		}
+	}
+	if len(errs) > 0 {
+		return purged, fmt.Errorf("purge accounts: %w", errors.Join(errs...))
+	}
+	return purged, nil
+}
+
+// purge deletes the user if their deletion is still due. It reports whether
+// the user was deleted.
+//
+// The images and exports are removed from the storage before the user row, so
+// that a failure leaves the user in place to be purged again later instead of
+// orphaning their files. The user row stays locked meanwhile, which makes a
+// concurrent Cancel wait for the purge.
+func (ad *AccountDeletionService) purge(userID int, cutoff time.Time) (bool, error) {
+	tx, err := ad.DB.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	defer tx.Rollback()
+	var id int
+	err = tx.Get(&id, accountDeletionQueries["lock_user"], userID, cutoff)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// The deletion was cancelled in the meantime.
+			return false, nil
+		}
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	var galleryIDs []int
+	err = tx.Select(&galleryIDs, accountDeletionQueries["gallery_ids"], userID)
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	var exportKeys []string
+	err = tx.Select(&exportKeys, accountDeletionQueries["export_keys"], userID)
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+
+	for _, galleryID := range galleryIDs {
+		err = ad.GalleryService.deleteImages(galleryID)
+		if err != nil {
+			return false, fmt.Errorf("purge user %d: %w", userID, err)
+		}
+	}
+	// Their exports are personal data as well.
+	for _, key := range exportKeys {
+		err = ad.GalleryService.storage().Delete(key)
+		if err != nil {
+			return false, fmt.Errorf("purge user %d: %w", userID, err)
+		}
+	}
+
+	// Their galleries go with the user row.
+	_, err = tx.Exec(accountDeletionQueries["delete_user"], userID)
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	_, err = tx.Exec(accountDeletionQueries["delete_login_throttle"], userID)
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("purge user %d: %w", userID, err)
+	}
+	return true, nil
+}
+
+func (ad *AccountDeletionService) gracePeriod() time.Duration {
+	if ad.GracePeriod <= 0 {
+		return DefaultDeletionGracePeriod
+	}
+	return ad.GracePeriod
+}
+
+func (ad *AccountDeletionService) now() time.Time {
+	if ad.Now == nil {
+		return time.Now()
+	}
+	return ad.Now()
+}
@@ -0,0 +1,48 @@
+-- name: request
+UPDATE users
+SET deletion_requested_at = $2
+WHERE id = $1;
+
+-- name: cancel
+UPDATE users
+SET deletion_requested_at = NULL
+WHERE id = $1
+  AND deletion_requested_at IS NOT NULL;
+
+-- name: due
+SELECT id
+FROM users
+WHERE deletion_requested_at <= $1;
+
+-- name: lock_user
+SELECT id
+FROM users
+WHERE id = $1
+  AND deletion_requested_at <= $2
+FOR UPDATE;
+
+-- name: gallery_ids
+SELECT id
+FROM galleries
+WHERE user_id = $1;
+
+-- name: export_keys
+SELECT storage_key
+FROM account_exports
+WHERE user_id = $1
+  AND storage_key IS NOT NULL;
+
+-- name: delete_sessions
+DELETE
+FROM sessions
+WHERE user_id = $1;
+
+-- name: delete_user
+DELETE
+FROM users
+WHERE id = $1;
+
+-- name: delete_login_throttle
+DELETE
+FROM login_throttles
+WHERE key = 'user:' || $1::INT;
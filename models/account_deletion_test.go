@@ -0,0 +1,68 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingDeleteStorage is a MemoryStorage that can't delete anything.
+type failingDeleteStorage struct {
+	*MemoryStorage
+}
+
+func (failingDeleteStorage) Delete(key string) error {
+	return errors.New("storage unavailable")
+}
+
+func TestPurgeDeletesStorageBeforeUser(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Now()
+	storage := &MemoryStorage{}
+	galleries := &GalleryService{DB: db, Storage: storage}
+	gallery, err := galleries.Create("Holidays", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := galleries.galleryPrefix(gallery.ID) + "beach.png"
+	err = storage.Put(key, strings.NewReader("png"), 3, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := &AccountDeletionService{DB: db, GalleryService: galleries, Now: fixedClock(&now)}
+	_, err = ad.Request(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(DefaultDeletionGracePeriod + time.Minute)
+
+	// While the storage fails the user is kept, so the purge can be retried.
+	galleries.Storage = failingDeleteStorage{storage}
+	_, err = ad.purge(user.ID, now.Add(-DefaultDeletionGracePeriod))
+	if err == nil {
+		t.Fatal("purge with a failing storage = nil, want an error")
+	}
+	var count int
+	err = db.Get(&count, `SELECT count(*) FROM users WHERE id = $1`, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("purge deleted the user although their images are still stored")
+	}
+
+	galleries.Storage = storage
+	deleted, err := ad.purge(user.ID, now.Add(-DefaultDeletionGracePeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Fatal("purge = false, want the user deleted")
+	}
+	_, err = storage.Stat(key)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat of a purged image = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,380 @@
+package models
+
+import (
+	"archive/zip"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// DefaultExportDuration is how long a finished export can be downloaded.
+	DefaultExportDuration = 7 * 24 * time.Hour
+	// DefaultExportTimeout is how long an export may take to build before it
+	// is assumed the server building it went away, and it is built again.
+	DefaultExportTimeout = time.Hour
+)
+
+// ExportStatus is where an AccountExport is in its life.
+type ExportStatus string
+
+const (
+	ExportPending  ExportStatus = "pending"
+	ExportBuilding ExportStatus = "building"
+	ExportReady    ExportStatus = "ready"
+	ExportFailed   ExportStatus = "failed"
+)
+
+// AccountExport is a ZIP archive of everything we hold about a user, built in
+// the background after they asked for it.
+type AccountExport struct {
+	ID          int            `db:"id"`
+	UserID      int            `db:"user_id"`
+	Status      ExportStatus   `db:"status"`
+	StorageKey  sql.NullString `db:"storage_key"`
+	Size        sql.NullInt64  `db:"size"`
+	RequestedAt time.Time      `db:"requested_at"`
+	StartedAt   sql.NullTime   `db:"started_at"`
+	CompletedAt sql.NullTime   `db:"completed_at"`
+	ExpiresAt   sql.NullTime   `db:"expires_at"`
+}
+
+// InProgress reports whether the export has not been built yet.
+func (e AccountExport) InProgress() bool {
+	return e.Status == ExportPending || e.Status == ExportBuilding
+}
+
+// Expired reports whether the export can no longer be downloaded.
+func (e AccountExport) Expired(now time.Time) bool {
+	return e.ExpiresAt.Valid && !now.Before(e.ExpiresAt.Time)
+}
+
+//go:embed account_export.sql
+var accountExportQueriesFile string
+
+var accountExportQueries map[string]string
+
+func init() {
+	accountExportQueries = sqlf.Load(accountExportQueriesFile)
+}
+
+// AccountExportService builds the data exports users ask for. The archives
+// are kept in the gallery Storage until they expire.
+type AccountExportService struct {
+	DB *sqlx.DB
+	// GalleryService provides the galleries and the image files.
+	GalleryService *GalleryService
+	// Duration defaults to DefaultExportDuration.
+	Duration time.Duration
+	// Timeout defaults to DefaultExportTimeout.
+	Timeout time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Request queues a new export for the user. If an export is already queued
+// or being built, that one is returned instead.
+func (ae *AccountExportService) Request(userID int) (*AccountExport, error) {
+	latest, err := ae.Latest(userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("request export: %w", err)
+	}
+	if latest != nil && latest.InProgress() {
+		return latest, nil
+	}
+	export := AccountExport{
+		UserID:      userID,
+		Status:      ExportPending,
+		RequestedAt: ae.now(),
+	}
+	err = sqlf.NamedDB{DB: ae.DB}.NamedGet(&export.ID, accountExportQueries["create"], export)
+	if err != nil {
+		return nil, fmt.Errorf("request export: %w", err)
+	}
+	return &export, nil
+}
+
+// Latest returns the most recently requested export of the user.
+func (ae *AccountExportService) Latest(userID int) (*AccountExport, error) {
+	var export AccountExport
+	err := ae.DB.Get(&export, accountExportQueries["latest"], userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("latest export: %w", err)
+	}
+	return &export, nil
+}
+
+// Next claims the oldest export that still has to be built, so that no other
+// server builds it too. It returns ErrNotFound when there is nothing to do.
+func (ae *AccountExportService) Next() (*AccountExport, error) {
+	now := ae.now()
+	var export AccountExport
+	err := ae.DB.Get(&export, accountExportQueries["claim"], now, now.Add(-ae.timeout()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("next export: %w", err)
+	}
+	return &export, nil
+}
+
+// Build writes the archive of the export and stores it. Exports that could
+// not be built are marked as failed, so the user can ask for a new one.
+func (ae *AccountExportService) Build(export *AccountExport) error {
+	err := ae.build(export)
+	if err != nil {
+		now := ae.now()
+		_, failErr := ae.DB.Exec(accountExportQueries["fail"], export.ID, now, now.Add(ae.duration()))
+		if failErr != nil {
+			return fmt.Errorf("build export: %w", errors.Join(err, failErr))
+		}
+		export.Status = ExportFailed
+		return fmt.Errorf("build export: %w", err)
+	}
+	return nil
+}
+
+func (ae *AccountExportService) build(export *AccountExport) error {
+	// The archive is written to a temporary file first, so neither the images
+	// nor the archive ever have to fit in memory.
+	file, err := os.CreateTemp("", "lenslocked-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = ae.writeArchive(file, export.UserID)
+	if err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("exports/export-%d.zip", export.ID)
+	err = ae.GalleryService.storage().Put(key, file, size, "application/zip")
+	if err != nil {
+		return err
+	}
+
+	now := ae.now()
+	expiresAt := now.Add(ae.duration())
+	_, err = ae.DB.Exec(accountExportQueries["complete"], export.ID, key, size, now, expiresAt)
+	if err != nil {
+		return err
+	}
+	export.Status = ExportReady
+	export.StorageKey = sql.NullString{String: key, Valid: true}
+	export.Size = sql.NullInt64{Int64: size, Valid: true}
+	export.CompletedAt = sql.NullTime{Time: now, Valid: true}
+	export.ExpiresAt = sql.NullTime{Time: expiresAt, Valid: true}
+	return nil
+}
+
+// exportManifest is the manifest.json at the root of the archive.
+type exportManifest struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	User       exportUser      `json:"user"`
+	Galleries  []exportGallery `json:"galleries"`
+}
+
+type exportUser struct {
+	ID         int        `json:"id"`
+	Email      string     `json:"email"`
+	VerifiedAt *time.Time `json:"verified_at"`
+}
+
+type exportGallery struct {
+	ID                int           `json:"id"`
+	Title             string        `json:"title"`
+	Visibility        Visibility    `json:"visibility"`
+	Slug              string        `json:"slug"`
+	PasswordProtected bool          `json:"password_protected"`
+	Images            []exportImage `json:"images"`
+}
+
+type exportImage struct {
+	// File is the path of the image inside the archive. It is empty when the
+	// file was missing from the storage.
+	File        string    `json:"file"`
+	Filename    string    `json:"filename"`
+	Caption     string    `json:"caption"`
+	Position    int       `json:"position"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	ContentHash string    `json:"content_hash"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// writeArchive writes the original image files of every gallery of the user
+// to w, followed by the manifest describing them.
+func (ae *AccountExportService) writeArchive(w io.Writer, userID int) error {
+	var user User
+	err := ae.DB.Get(&user, accountExportQueries["user"], userID)
+	if err != nil {
+		return fmt.Errorf("export user %d: %w", userID, err)
+	}
+	manifest := exportManifest{
+		ExportedAt: ae.now(),
+		User: exportUser{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+		Galleries: []exportGallery{},
+	}
+	if user.VerifiedAt.Valid {
+		manifest.User.VerifiedAt = &user.VerifiedAt.Time
+	}
+
+	zw := zip.NewWriter(w)
+	galleries, err := ae.GalleryService.ByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("export user %d: %w", userID, err)
+	}
+	for _, gallery := range galleries {
+		images, err := ae.GalleryService.Images(gallery.ID)
+		if err != nil {
+			return fmt.Errorf("export user %d: %w", userID, err)
+		}
+		exported := exportGallery{
+			ID:                gallery.ID,
+			Title:             gallery.Title,
+			Visibility:        gallery.Visibility,
+			Slug:              gallery.Slug,
+			PasswordProtected: gallery.HasPassword(),
+			Images:            []exportImage{},
+		}
+		for _, image := range images {
+			file := fmt.Sprintf("galleries/%d/%s", gallery.ID, path.Base(image.Filename))
+			err = ae.writeImage(zw, file, image)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					return fmt.Errorf("export user %d: %w", userID, err)
+				}
+				file = ""
+			}
+			exported.Images = append(exported.Images, exportImage{
+				File:        file,
+				Filename:    image.Filename,
+				Caption:     image.Caption,
+				Position:    image.Position,
+				ContentType: image.ContentType,
+				Size:        image.Size,
+				Width:       image.Width,
+				Height:      image.Height,
+				ContentHash: image.ContentHash,
+				UploadedAt:  image.UploadedAt,
+			})
+		}
+		manifest.Galleries = append(manifest.Galleries, exported)
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("export user %d: %w", userID, err)
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return fmt.Errorf("export user %d: %w", userID, err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("export user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (ae *AccountExportService) writeImage(zw *zip.Writer, name string, image Image) error {
+	contents, _, err := ae.GalleryService.OpenImage(image)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	// Images are compressed already, so they are stored as they are.
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: image.UploadedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, contents)
+	return err
+}
+
+// Open returns the archive of a ready export. Callers must close the returned
+// reader.
+func (ae *AccountExportService) Open(export *AccountExport) (io.ReadCloser, *ObjectInfo, error) {
+	if export.Status != ExportReady || export.Expired(ae.now()) {
+		return nil, nil, fmt.Errorf("open export: %w", ErrNotFound)
+	}
+	contents, info, err := ae.GalleryService.storage().Get(export.StorageKey.String)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open export: %w", err)
+	}
+	return contents, info, nil
+}
+
+// Purge deletes the exports that expired, along with their archives, and
+// returns how many were deleted.
+func (ae *AccountExportService) Purge() (int, error) {
+	var keys []sql.NullString
+	err := ae.DB.Select(&keys, accountExportQueries["delete_expired"], ae.now())
+	if err != nil {
+		return 0, fmt.Errorf("purge exports: %w", err)
+	}
+	for _, key := range keys {
+		if !key.Valid {
+			continue
+		}
+		err = ae.GalleryService.storage().Delete(key.String)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, fmt.Errorf("purge exports: %w", err)
+		}
+	}
+	return len(keys), nil
+}
+
+func (ae *AccountExportService) duration() time.Duration {
+	if ae.Duration <= 0 {
+		return DefaultExportDuration
+	}
+	return ae.Duration
+}
+
+func (ae *AccountExportService) timeout() time.Duration {
+	if ae.Timeout <= 0 {
+		return DefaultExportTimeout
+	}
+	return ae.Timeout
+}
+
+func (ae *AccountExportService) now() time.Time {
+	if ae.Now == nil {
+		return time.Now()
+	}
+	return ae.Now()
+}
@@ -0,0 +1,50 @@
+-- name: create
+INSERT INTO account_exports (user_id, requested_at)
+VALUES (:user_id, :requested_at)
+RETURNING id;
+
+-- name: latest
+SELECT id, user_id, status, storage_key, size, requested_at, started_at, completed_at, expires_at
+FROM account_exports
+WHERE user_id = $1
+ORDER BY requested_at DESC
+LIMIT 1;
+
+-- name: claim
+UPDATE account_exports
+SET status     = 'building',
+    started_at = $1
+WHERE id = (SELECT id
+            FROM account_exports
+            WHERE status = 'pending'
+               OR (status = 'building' AND started_at <= $2)
+            ORDER BY requested_at
+            LIMIT 1 FOR UPDATE SKIP LOCKED)
+RETURNING id, user_id, status, storage_key, size, requested_at, started_at, completed_at, expires_at;
+
+-- name: complete
+UPDATE account_exports
+SET status       = 'ready',
+    storage_key  = $2,
+    size         = $3,
+    completed_at = $4,
+    expires_at   = $5
+WHERE id = $1;
+
+-- name: fail
+UPDATE account_exports
+SET status       = 'failed',
+    completed_at = $2,
+    expires_at   = $3
+WHERE id = $1;
+
+-- name: user
+SELECT id, email, verified_at
+FROM users
+WHERE id = $1;
+
+-- name: delete_expired
+DELETE
+FROM account_exports
+WHERE expires_at <= $1
+RETURNING storage_key;
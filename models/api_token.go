@@ -0,0 +1,212 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+// APITokenPrefix starts every personal API token, which tells them apart from
+// session tokens when they are sent as a bearer token.
+const APITokenPrefix = "lla_"
+
+// Scope is something a personal API token is allowed to do.
+type Scope string
+
+const (
+	ScopeReadGalleries  Scope = "galleries:read"
+	ScopeWriteGalleries Scope = "galleries:write"
+	ScopeUploadImages   Scope = "images:upload"
+	// ScopeAdmin grants every other scope.
+	ScopeAdmin Scope = "admin"
+)
+
+// AllScopes lists every scope, in the order they are shown to users.
+var AllScopes = []Scope{ScopeReadGalleries, ScopeWriteGalleries, ScopeUploadImages, ScopeAdmin}
+
+func (s Scope) Valid() bool {
+	for _, scope := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Scopes is stored as a space separated list.
+type Scopes []Scope
+
+func (s Scopes) Has(scope Scope) bool {
+	for _, have := range s {
+		if have == scope || have == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scopes) String() string {
+	strs := make([]string, len(s))
+	for i, scope := range s {
+		strs[i] = string(scope)
+	}
+	return strings.Join(strs, " ")
+}
+
+func (s Scopes) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+func (s *Scopes) Scan(src any) error {
+	var str string
+	switch v := src.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("scan scopes: unsupported type %T", src)
+	}
+	*s = nil
+	for _, field := range strings.Fields(str) {
+		*s = append(*s, Scope(field))
+	}
+	return nil
+}
+
+// APIToken is a long-lived token users create to script against the API. It
+// can only do what its scopes allow.
+type APIToken struct {
+	ID     int    `db:"id"`
+	UserID int    `db:"user_id"`
+	Name   string `db:"name"`
+	// Token is only set when the APIToken is being created.
+	Token      string       `db:"token"`
+	TokenHash  string       `db:"token_hash"`
+	Scopes     Scopes       `db:"scopes"`
+	CreatedAt  time.Time    `db:"created_at"`
+	ExpiresAt  sql.NullTime `db:"expires_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+}
+
+//go:embed api_token.sql
+var apiTokenQueriesFile string
+
+var apiTokenQueries map[string]string
+
+func init() {
+	apiTokenQueries = sqlf.Load(apiTokenQueriesFile)
+}
+
+type APITokenService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// IsAPIToken reports whether token looks like a personal API token rather
+// than a session token.
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// Create makes a new token for the user. A zero duration means the token
+// never expires.
+func (at *APITokenService) Create(userID int, name string, scopes Scopes, duration time.Duration) (*APIToken, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("create api token: %w", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		if !scope.Valid() {
+			return nil, fmt.Errorf("create api token: %w", ErrInvalidScope)
+		}
+	}
+	bytesPerToken := at.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	token = APITokenPrefix + token
+	now := at.now()
+	apiToken := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     token,
+		TokenHash: at.hash(token),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if duration > 0 {
+		apiToken.ExpiresAt = sql.NullTime{Time: now.Add(duration), Valid: true}
+	}
+	err = sqlf.NamedDB{DB: at.DB}.NamedGet(&apiToken.ID, apiTokenQueries["create"], apiToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	return &apiToken, nil
+}
+
+func (at *APITokenService) ByUserID(userID int) ([]APIToken, error) {
+	var tokens []APIToken
+	err := at.DB.Select(&tokens, apiTokenQueries["by_user_id"], userID)
+	if err != nil {
+		return nil, fmt.Errorf("api tokens by user: %w", err)
+	}
+	return tokens, nil
+}
+
+// User looks up the user a token belongs to and records that the token was
+// used. Expired tokens, and tokens of accounts that are about to be deleted,
+// are reported as ErrNotFound.
+func (at *APITokenService) User(token string) (*User, *APIToken, error) {
+	var dao struct {
+		User     User     `db:"user"`
+		APIToken APIToken `db:"token"`
+	}
+	err := at.DB.Get(&dao, apiTokenQueries["user"], at.hash(token), at.now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("api token user: %w", err)
+	}
+	return &dao.User, &dao.APIToken, nil
+}
+
+// Delete revokes the token. The user ID is required so users can only revoke
+// their own tokens.
+func (at *APITokenService) Delete(userID, id int) error {
+	_, err := at.DB.Exec(apiTokenQueries["delete"], id, userID)
+	if err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
+
+func (at *APITokenService) now() time.Time {
+	if at.Now == nil {
+		return time.Now()
+	}
+	return at.Now()
+}
+
+func (at *APITokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
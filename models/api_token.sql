@@ -0,0 +1,41 @@
+-- name: create
+INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+VALUES (:user_id, :name, :token_hash, :scopes, :created_at, :expires_at)
+RETURNING id;
+
+-- name: by_user_id
+SELECT id, user_id, name, token_hash, scopes, created_at, expires_at, last_used_at
+FROM api_tokens
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: user
+UPDATE api_tokens t
+SET last_used_at = $2
+FROM users u
+WHERE t.token_hash = $1
+  AND (t.expires_at IS NULL OR t.expires_at > $2)
+  AND u.id = t.user_id
+  AND u.deletion_requested_at IS NULL
+  AND u.suspended_at IS NULL
+RETURNING t.id            "token.id",
+          t.user_id       "token.user_id",
+          t.name          "token.name",
+          t.token_hash    "token.token_hash",
+          t.scopes        "token.scopes",
+          t.created_at    "token.created_at",
+          t.expires_at    "token.expires_at",
+          t.last_used_at  "token.last_used_at",
+          u.id            "user.id",
+          u.email         "user.email",
+          u.password_hash "user.password_hash",
+          u.verified_at   "user.verified_at",
+          u.role          "user.role",
+          u.suspended_at  "user.suspended_at";
+
+-- name: delete
+DELETE
+FROM api_tokens
+WHERE id = $1
+  AND user_id = $2;
+
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// errInvalidCBOR is returned for data that is not CBOR, or uses parts of it
+// authenticators never do.
+var errInvalidCBOR = errors.New("invalid cbor")
+
+// maxCBORDepth bounds how deeply arrays and maps may be nested. WebAuthn data
+// never goes past a few levels.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR data item in data and returns it with the
+// bytes that follow it. Only the subset of CBOR authenticators use is
+// supported, that is definite lengths without floats. Integers are decoded
+// as int64, byte strings as []byte, text strings as string, arrays as []any
+// and maps as map[any]any. Tags are dropped, keeping the value they wrap.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errInvalidCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", errInvalidCBOR)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errInvalidCBOR, info)
+		}
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", errInvalidCBOR)
+		}
+		switch size {
+		case 1:
+			arg = uint64(data[0])
+		case 2:
+			arg = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			arg = uint64(binary.BigEndian.Uint32(data))
+		case 8:
+			arg = binary.BigEndian.Uint64(data)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("%w: indefinite lengths are not supported", errInvalidCBOR)
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errInvalidCBOR)
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errInvalidCBOR)
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", errInvalidCBOR)
+		}
+		value := data[:arg]
+		if major == 3 {
+			return string(value), data[arg:], nil
+		}
+		return append([]byte(nil), value...), data[arg:], nil
+	case 4:
+		// Every item takes at least one byte, which keeps a bogus length from
+		// allocating more than the data could hold.
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", errInvalidCBOR)
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			var err error
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end of data", errInvalidCBOR)
+		}
+		items := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			var err error
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errInvalidCBOR, key)
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, fmt.Errorf("%w: duplicate map key %v", errInvalidCBOR, key)
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	default: // 6, a tag
+		return decodeCBORItem(data, depth+1)
+	}
+}
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// cborPair is an entry of a cborMap.
+type cborPair struct {
+	Key   any
+	Value any
+}
+
+// cborMap is a CBOR map that keeps the order of its entries, so encoded test
+// data is the same on every run.
+type cborMap []cborPair
+
+// encodeCBOR encodes int, int64, []byte, string, bool, []any and cborMap
+// values. It is only the little of CBOR the tests need to build
+// authenticator data.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		return encodeCBOR(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case []any:
+		data := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			data = append(data, encodeCBOR(item)...)
+		}
+		return data
+	case cborMap:
+		data := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			data = append(data, encodeCBOR(pair.Key)...)
+			data = append(data, encodeCBOR(pair.Value)...)
+		}
+		return data
+	default:
+		panic(fmt.Sprintf("encodeCBOR: unsupported type %T", v))
+	}
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// Most of the examples are from appendix A of RFC 8949.
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"1b7fffffffffffffff", int64(9223372036854775807)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3b7fffffffffffffff", int64(-9223372036854775808)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+		// Tags are dropped.
+		{"c11a514b67b0", int64(1363896240)},
+		{"d74401020304", []byte{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hex, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, rest, err := decodeCBOR(append(data, 0xff))
+			if err != nil {
+				t.Fatalf("decodeCBOR() err = %v", err)
+			}
+			if want, ok := tt.want.([]byte); ok {
+				if b, ok := got.([]byte); !ok || !bytes.Equal(b, want) {
+					t.Errorf("decodeCBOR() = %#v, want %#v", got, want)
+				}
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCBOR() = %#v, want %#v", got, tt.want)
+			}
+			if !bytes.Equal(rest, []byte{0xff}) {
+				t.Errorf("decodeCBOR() rest = %x, want ff", rest)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x81}, maxCBORDepth+1)
+	nested = append(nested, 0x00)
+	tests := map[string]string{
+		"empty":                       "",
+		"truncated argument":          "19e8",
+		"truncated byte string":       "440102",
+		"truncated text string":       "6449",
+		"truncated array":             "830102",
+		"truncated map":               "a20102",
+		"reserved additional info":    "1c",
+		"indefinite byte string":      "5f42010243030405ff",
+		"indefinite text string":      "7f657374726561646d696e67ff",
+		"indefinite array":            "9f0102ff",
+		"indefinite map":              "bf6346756ef563416d7421ff",
+		"float":                       "f93c00",
+		"double":                      "fb3ff199999999999a",
+		"unassigned simple value":     "f0",
+		"one byte simple value":       "f820",
+		"integer overflow":            "1b8000000000000000",
+		"negative integer overflow":   "3b8000000000000000",
+		"byte string length overflow": "5bffffffffffffffff",
+		"duplicate map key":           "a201020103",
+		"array map key":               "a1800102",
+		"bytes map key":               "a1400102",
+		"nested too deeply":           hex.EncodeToString(nested),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := hex.DecodeString(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = decodeCBOR(b)
+			if !errors.Is(err, errInvalidCBOR) {
+				t.Errorf("decodeCBOR() err = %v, want %v", err, errInvalidCBOR)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORMaxDepth(t *testing.T) {
+	data := bytes.Repeat([]byte{0x81}, maxCBORDepth)
+	data = append(data, 0x00)
+	_, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatalf("decodeCBOR() err = %v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("decodeCBOR() rest = %x, want nothing", rest)
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	for _, algorithm := range []int{COSEAlgorithmES256, COSEAlgorithmRS256} {
+		t.Run(fmt.Sprint(algorithm), func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, algorithm, "www.lenslocked.com")
+			publicKey, got, err := parseCOSEKey(authenticator.coseKey())
+			if err != nil {
+				t.Fatalf("parseCOSEKey() err = %v", err)
+			}
+			if got != algorithm {
+				t.Errorf("parseCOSEKey() algorithm = %d, want %d", got, algorithm)
+			}
+			if !reflect.DeepEqual(publicKey, authenticator.key.Public()) {
+				t.Errorf("parseCOSEKey() = %v, want %v", publicKey, authenticator.key.Public())
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyInvalid(t *testing.T) {
+	es256 := newSoftAuthenticator(t, COSEAlgorithmES256, "www.lenslocked.com")
+	ecKey := es256.coseKeyMap()
+	rs256 := newSoftAuthenticator(t, COSEAlgorithmRS256, "www.lenslocked.com")
+	rsaKey := rs256.coseKeyMap()
+
+	// with returns the key with the value of label replaced.
+	with := func(key cborMap, label int, value any) []byte {
+		changed := cborMap{}
+		for _, pair := range key {
+			if pair.Key == label {
+				pair.Value = value
+			}
+			changed = append(changed, pair)
+		}
+		return encodeCBOR(changed)
+	}
+	offCurve := make([]byte, 32)
+	offCurve[31] = 1
+	smallN := make([]byte, 128)
+	smallN[0] = 0x80
+	smallN[127] = 1
+
+	tests := map[string][]byte{
+		"not cbor":             {0xff},
+		"not a map":            encodeCBOR([]any{int64(2)}),
+		"trailing bytes":       append(encodeCBOR(ecKey), 0x00),
+		"unknown key type":     with(ecKey, 1, 1),
+		"unknown algorithm":    with(ecKey, 3, -8),
+		"algorithm of rsa":     with(ecKey, 3, COSEAlgorithmRS256),
+		"other curve":          with(ecKey, -1, 2),
+		"short x":              with(ecKey, -2, make([]byte, 31)),
+		"y not a byte string":  with(ecKey, -3, "y"),
+		"point not on curve":   with(ecKey, -3, offCurve),
+		"rsa key of 1024 bits": with(rsaKey, -1, smallN),
+		"even exponent":        with(rsaKey, -2, []byte{1, 0, 0}),
+		"exponent of 1":        with(rsaKey, -2, []byte{1}),
+		"long exponent":        with(rsaKey, -2, []byte{1, 0, 0, 0, 1}),
+		"exponent not bytes":   with(rsaKey, -2, 65537),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseCOSEKey(data)
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("parseCOSEKey() err = %v, want %v", err, ErrInvalidPasskey)
+			}
+		})
+	}
+}
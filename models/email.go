@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"html"
+	"time"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -89,3 +91,102 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	}
 	return nil
 }
+
+func (es *EmailService) MagicLink(to, signInURL string) error {
+	email := Email{
+		Subject:   "Your sign in link",
+		To:        to,
+		Plaintext: "To sign in to your account, please visit the following link: " + signInURL + " The link can only be used once and expires shortly. If you didn't ask for it, you can ignore this email.",
+		HTML:      `<p>To sign in to your account, please visit the following link: <a href="` + signInURL + `">` + signInURL + `</a></p><p>The link can only be used once and expires shortly. If you didn't ask for it, you can ignore this email.</p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("magic link email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject:   "Verify your email address",
+		To:        to,
+		Plaintext: "Please confirm this is your email address by visiting the following link: " + verifyURL,
+		HTML:      `<p>Please confirm this is your email address by visiting the following link: <a href="` + verifyURL + `">` + verifyURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		Subject:   "Confirm your new email address",
+		To:        to,
+		Plaintext: "Please confirm you want to use this email address for your account by visiting the following link: " + confirmURL,
+		HTML:      `<p>Please confirm you want to use this email address for your account by visiting the following link: <a href="` + confirmURL + `">` + confirmURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) EmailChanged(to, newEmail, undoURL string) error {
+	email := Email{
+		Subject:   "Your email address has been changed",
+		To:        to,
+		Plaintext: "The email address of your account has been changed to " + newEmail + ". If this wasn't you, change it back by visiting the following link: " + undoURL,
+		HTML:      `<p>The email address of your account has been changed to ` + html.EscapeString(newEmail) + `.</p><p>If this wasn't you, change it back by visiting the following link: <a href="` + undoURL + `">` + undoURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email changed email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) GalleryInvitation(to, inviter, galleryTitle, acceptURL string) error {
+	email := Email{
+		Subject:   inviter + " invited you to a gallery",
+		To:        to,
+		Plaintext: inviter + " invited you to join their gallery \"" + galleryTitle + "\". Sign in or sign up with this email address, then visit the following link to accept: " + acceptURL,
+		HTML:      `<p>` + html.EscapeString(inviter) + ` invited you to join their gallery "` + html.EscapeString(galleryTitle) + `".</p><p>Sign in or sign up with this email address, then visit the following link to accept: <a href="` + acceptURL + `">` + acceptURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("gallery invitation email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) AccountLocked(to, resetURL string) error {
+	email := Email{
+		Subject:   "Your account has been locked",
+		To:        to,
+		Plaintext: "We locked your account for a while after too many failed sign in attempts. If this wasn't you, someone may be trying to guess your password. You can unlock your account right away by resetting your password: " + resetURL,
+		HTML:      `<p>We locked your account for a while after too many failed sign in attempts. If this wasn't you, someone may be trying to guess your password.</p><p>You can unlock your account right away by resetting your password: <a href="` + resetURL + `">` + resetURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account locked email: %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) AccountExportReady(to, downloadURL string, expiresAt time.Time) error {
+	expires := expiresAt.Format("January 2, 2006")
+	email := Email{
+		Subject:   "Your data export is ready",
+		To:        to,
+		Plaintext: "The export of your account data you asked for is ready. You can download it until " + expires + " after signing in: " + downloadURL,
+		HTML:      `<p>The export of your account data you asked for is ready.</p><p>You can download it until ` + expires + ` after signing in: <a href="` + downloadURL + `">` + downloadURL + `</a></p>`,
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account export ready email: %w", err)
+	}
+	return nil
+}
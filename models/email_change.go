@@ -0,0 +1,253 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+const (
+	// DefaultEmailChangeDuration is how long the link sent to the new email
+	// address can be used to confirm the change.
+	DefaultEmailChangeDuration = 24 * time.Hour
+	// DefaultEmailChangeUndoDuration is how long the link sent to the old
+	// email address can be used to undo the change.
+	DefaultEmailChangeUndoDuration = 7 * 24 * time.Hour
+)
+
+// EmailChange is a request to change the email address of a user. It only
+// takes effect once the new address is confirmed, and can be undone from the
+// old address for a while after that.
+type EmailChange struct {
+	ID       int    `db:"id"`
+	UserID   int    `db:"user_id"`
+	OldEmail string `db:"old_email"`
+	NewEmail string `db:"new_email"`
+	// Token is only set when the EmailChange is created, and UndoToken when it
+	// is confirmed.
+	Token         string         `db:"token"`
+	TokenHash     string         `db:"token_hash"`
+	ExpiresAt     time.Time      `db:"expires_at"`
+	ConfirmedAt   sql.NullTime   `db:"confirmed_at"`
+	UndoToken     string         `db:"undo_token"`
+	UndoTokenHash sql.NullString `db:"undo_token_hash"`
+	UndoExpiresAt sql.NullTime   `db:"undo_expires_at"`
+}
+
+//go:embed email_change.sql
+var emailChangeQueriesFile string
+
+var emailChangeQueries map[string]string
+
+func init() {
+	emailChangeQueries = sqlf.Load(emailChangeQueriesFile)
+}
+
+type EmailChangeService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	// Duration defaults to DefaultEmailChangeDuration.
+	Duration time.Duration
+	// UndoDuration defaults to DefaultEmailChangeUndoDuration.
+	UndoDuration time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Create starts changing the email address of the user to newEmail,
+// replacing any change that was not confirmed yet.
+func (ec *EmailChangeService) Create(userID int, newEmail string) (*EmailChange, error) {
+	newEmail = strings.ToLower(newEmail)
+	err := validateEmail(newEmail)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	var ownerID int
+	err = ec.DB.Get(&ownerID, emailChangeQueries["user_id_by_email"], newEmail)
+	switch {
+	case err == nil && ownerID == userID:
+		return nil, fmt.Errorf("create email change: %w", ErrSameEmail)
+	case err == nil:
+		return nil, fmt.Errorf("create email change: %w", ErrEmailTaken)
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	token, err := rand.String(ec.bytesPerToken())
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: ec.hash(token),
+		ExpiresAt: ec.now().Add(ec.duration()),
+	}
+
+	tx, err := ec.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(emailChangeQueries["delete_pending"], userID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	err = tx.Get(&change, emailChangeQueries["create"], userID, change.NewEmail, change.TokenHash, change.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Pending returns the change of the user that is waiting to be confirmed.
+func (ec *EmailChangeService) Pending(userID int) (*EmailChange, error) {
+	var change EmailChange
+	err := ec.DB.Get(&change, emailChangeQueries["pending"], userID, ec.now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("pending email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Confirm changes the email address of the user to the new one, which is
+// verified by following the link. The returned EmailChange has the UndoToken
+// set, to be sent to the old address.
+func (ec *EmailChangeService) Confirm(token string) (*EmailChange, error) {
+	tx, err := ec.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("confirm email change: %w", err)
+	}
+	defer tx.Rollback()
+	var change EmailChange
+	err = tx.Get(&change, emailChangeQueries["by_token_hash"], ec.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("confirm email change: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("confirm email change: %w", err)
+	}
+	now := ec.now()
+	if !now.Before(change.ExpiresAt) {
+		return nil, fmt.Errorf("confirm email change: %w", ErrInvalidToken)
+	}
+	_, err = tx.Exec(emailChangeQueries["update_email"], change.UserID, change.NewEmail, now)
+	if err != nil {
+		return nil, fmt.Errorf("confirm email change: %w", emailTakenError(err))
+	}
+	undoToken, err := rand.String(ec.bytesPerToken())
+	if err != nil {
+		return nil, fmt.Errorf("confirm email change: %w", err)
+	}
+	change.ConfirmedAt = sql.NullTime{Time: now, Valid: true}
+	change.UndoToken = undoToken
+	change.UndoTokenHash = sql.NullString{String: ec.hash(undoToken), Valid: true}
+	change.UndoExpiresAt = sql.NullTime{Time: now.Add(ec.undoDuration()), Valid: true}
+	_, err = tx.Exec(emailChangeQueries["confirm"], change.ID, change.ConfirmedAt, change.UndoTokenHash, change.UndoExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("confirm email change: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("confirm email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Undo changes the email address of the user back to the old one. Every other
+// change of the user is dropped, including any still waiting to be confirmed.
+func (ec *EmailChangeService) Undo(token string) (*EmailChange, error) {
+	tx, err := ec.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("undo email change: %w", err)
+	}
+	defer tx.Rollback()
+	var change EmailChange
+	err = tx.Get(&change, emailChangeQueries["by_undo_token_hash"], ec.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("undo email change: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("undo email change: %w", err)
+	}
+	now := ec.now()
+	if !change.UndoExpiresAt.Valid || !now.Before(change.UndoExpiresAt.Time) {
+		return nil, fmt.Errorf("undo email change: %w", ErrInvalidToken)
+	}
+	_, err = tx.Exec(emailChangeQueries["update_email"], change.UserID, change.OldEmail, now)
+	if err != nil {
+		return nil, fmt.Errorf("undo email change: %w", emailTakenError(err))
+	}
+	_, err = tx.Exec(emailChangeQueries["delete_for_user"], change.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("undo email change: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("undo email change: %w", err)
+	}
+	return &change, nil
+}
+
+// emailTakenError turns unique violations of the users email into
+// ErrEmailTaken, as someone else may have signed up with the address in the
+// meantime.
+func emailTakenError(err error) error {
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (ec *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (ec *EmailChangeService) bytesPerToken() int {
+	if ec.BytesPerToken < MinBytesPerToken {
+		return MinBytesPerToken
+	}
+	return ec.BytesPerToken
+}
+
+func (ec *EmailChangeService) duration() time.Duration {
+	if ec.Duration <= 0 {
+		return DefaultEmailChangeDuration
+	}
+	return ec.Duration
+}
+
+func (ec *EmailChangeService) undoDuration() time.Duration {
+	if ec.UndoDuration <= 0 {
+		return DefaultEmailChangeUndoDuration
+	}
+	return ec.UndoDuration
+}
+
+func (ec *EmailChangeService) now() time.Time {
+	if ec.Now == nil {
+		return time.Now()
+	}
+	return ec.Now()
+}
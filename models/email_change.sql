@@ -0,0 +1,57 @@
+-- name: user_id_by_email
+SELECT id
+FROM users
+WHERE email = $1;
+
+-- name: delete_pending
+DELETE
+FROM email_changes
+WHERE user_id = $1
+  AND confirmed_at IS NULL;
+
+-- name: create
+INSERT INTO email_changes (user_id, old_email, new_email, token_hash, expires_at)
+SELECT id, email, $2, $3, $4
+FROM users
+WHERE id = $1
+RETURNING id, old_email;
+
+-- name: pending
+SELECT id, user_id, old_email, new_email, token_hash, expires_at, confirmed_at, undo_token_hash, undo_expires_at
+FROM email_changes
+WHERE user_id = $1
+  AND confirmed_at IS NULL
+  AND expires_at > $2
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: by_token_hash
+SELECT id, user_id, old_email, new_email, token_hash, expires_at, confirmed_at, undo_token_hash, undo_expires_at
+FROM email_changes
+WHERE token_hash = $1
+  AND confirmed_at IS NULL
+    FOR UPDATE;
+
+-- name: by_undo_token_hash
+SELECT id, user_id, old_email, new_email, token_hash, expires_at, confirmed_at, undo_token_hash, undo_expires_at
+FROM email_changes
+WHERE undo_token_hash = $1
+    FOR UPDATE;
+
+-- name: update_email
+UPDATE users
+SET email       = $2,
+    verified_at = $3
+WHERE id = $1;
+
+-- name: confirm
+UPDATE email_changes
+SET confirmed_at    = $2,
+    undo_token_hash = $3,
+    undo_expires_at = $4
+WHERE id = $1;
+
+-- name: delete_for_user
+DELETE
+FROM email_changes
+WHERE user_id = $1;
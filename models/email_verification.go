@@ -0,0 +1,109 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+type EmailVerification struct {
+	ID     int `db:"id"`
+	UserID int `db:"user_id"`
+	// The Token is only set when an EmailVerification is being created.
+	Token     string    `db:"token"`
+	TokenHash string    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+//go:embed email_verification.sql
+var emailVerificationQueriesFile string
+
+var emailVerificationQueries map[string]string
+
+func init() {
+	emailVerificationQueries = sqlf.Load(emailVerificationQueriesFile)
+}
+
+const DefaultVerificationDuration = 24 * time.Hour
+
+type EmailVerificationService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+// Create issues a new verification token for the user, replacing any token
+// that was sent before.
+func (ev *EmailVerificationService) Create(userID int) (*EmailVerification, error) {
+	bytesPerToken := ev.BytesPerToken
+	if bytesPerToken == 0 {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := ev.Duration
+	if duration == 0 {
+		duration = DefaultVerificationDuration
+	}
+
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: ev.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	err = sqlf.NamedDB{DB: ev.DB}.NamedGet(&verification.ID, emailVerificationQueries["create"], verification)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	return &verification, nil
+}
+
+// Consume marks the email address of the user the token was issued to as
+// verified.
+func (ev *EmailVerificationService) Consume(token string) (*User, error) {
+	tokenHash := ev.hash(token)
+	var dao struct {
+		User         User              `db:"user"`
+		Verification EmailVerification `db:"verification"`
+	}
+	err := ev.DB.Get(&dao, emailVerificationQueries["consume"], tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	if time.Now().After(dao.Verification.ExpiresAt) {
+		return nil, fmt.Errorf("consume: %w: expired", ErrInvalidToken)
+	}
+	err = ev.DB.Get(&dao.User.VerifiedAt, emailVerificationQueries["verify"], dao.User.ID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	_, err = ev.DB.Exec(emailVerificationQueries["delete"], dao.Verification.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+
+	out := dao.User
+	return &out, nil
+}
+
+func (ev *EmailVerificationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,27 @@
+-- name: create
+INSERT INTO email_verifications (user_id, token_hash, expires_at)
+VALUES (:user_id, :token_hash, :expires_at)
+ON CONFLICT (user_id) DO UPDATE SET token_hash = :token_hash,
+                                    expires_at = :expires_at
+RETURNING id;
+
+-- name: consume
+SELECT email_verifications.id         "verification.id",
+       email_verifications.expires_at "verification.expires_at",
+       users.id                       "user.id",
+       users.email                    "user.email",
+       users.password_hash            "user.password_hash"
+FROM email_verifications
+         JOIN users ON users.id = email_verifications.user_id
+WHERE email_verifications.token_hash = $1;
+
+-- name: verify
+UPDATE users
+SET verified_at = $2
+WHERE id = $1
+RETURNING verified_at;
+
+-- name: delete
+DELETE
+FROM email_verifications
+WHERE id = $1;
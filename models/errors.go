@@ -9,10 +9,60 @@ import (
 )
 
 var (
-	ErrNotFound   = errors.New("models: resource could not be found")
-	ErrEmailTaken = errors.New("models: email address is already in use")
+	ErrNotFound     = errors.New("models: resource could not be found")
+	ErrEmailTaken   = errors.New("models: email address is already in use")
+	ErrInvalidEmail = errors.New("models: email address is not valid")
+	ErrSameEmail    = errors.New("models: email address is the current one")
+	ErrInvalidToken = errors.New("models: token is invalid or expired")
+
+	ErrInvalidCredentials = errors.New("models: invalid email or password")
+	ErrLoginLocked        = errors.New("models: too many failed sign in attempts")
+	ErrAccountSuspended   = errors.New("models: account is suspended")
+
+	ErrPasswordTooShort = errors.New("models: password is too short")
+	ErrPasswordTooLong  = errors.New("models: password is too long")
+	ErrPasswordIsEmail  = errors.New("models: password is the email address")
+	ErrPasswordBreached = errors.New("models: password is known to have leaked")
+
+	ErrInvalidVisibility = errors.New("models: invalid gallery visibility")
+
+	ErrInvalidCode      = errors.New("models: invalid two-factor code")
+	ErrTwoFactorEnabled = errors.New("models: two-factor authentication is already enabled")
+	ErrChallengeExpired = errors.New("models: sign in challenge expired")
+
+	ErrInvalidPasskey    = errors.New("models: passkey could not be verified")
+	ErrPasskeyRegistered = errors.New("models: passkey is already registered")
+
+	ErrInvalidIDToken        = errors.New("models: id token could not be verified")
+	ErrOIDCEmailUnverified   = errors.New("models: identity provider did not verify the email address")
+	ErrOIDCNoAccount         = errors.New("models: no account has the email address of the identity")
+	ErrOIDCAccountUnverified = errors.New("models: account email address is not verified")
+
+	ErrInvalidScope = errors.New("models: invalid api token scope")
+
+	ErrInvalidRole = errors.New("models: invalid role")
+
+	ErrInvalidGalleryRole = errors.New("models: invalid gallery member role")
+	ErrGalleryOwner       = errors.New("models: user owns the gallery")
+	ErrInvitationEmail    = errors.New("models: invitation is for another email address")
 )
 
+// PasswordError is returned for passwords that break the PasswordPolicy. Err
+// is one of the ErrPassword errors, and Limit the length that was broken, if
+// any.
+type PasswordError struct {
+	Err   error
+	Limit int
+}
+
+func (pe PasswordError) Error() string {
+	return fmt.Sprintf("invalid password: %v", pe.Err)
+}
+
+func (pe PasswordError) Unwrap() error {
+	return pe.Err
+}
+
 type FileError struct {
 	Issue string
 }
@@ -21,24 +71,26 @@ func (f FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", f.Issue)
 }
 
-func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
-	testBytes := make([]byte, 511)
-	_, err := r.Read(testBytes)
-	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
+// checkContentType sniffs the content type of r and returns it if it is one of
+// the allowed types. r is rewound to the start afterwards.
+func checkContentType(r io.ReadSeeker, allowedTypes []string) (string, error) {
+	testBytes := make([]byte, 512)
+	n, err := io.ReadFull(r, testBytes)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
-	_, err = r.Seek(-1, 0)
+	_, err = r.Seek(0, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
 
-	contentType := http.DetectContentType(testBytes)
+	contentType := http.DetectContentType(testBytes[:n])
 	for _, t := range allowedTypes {
 		if contentType == t {
-			return nil
+			return contentType, nil
 		}
 	}
-	return FileError{
+	return "", FileError{
 		Issue: fmt.Sprintf("invalid content type: %v", contentType),
 	}
 }
@@ -51,3 +103,12 @@ func checkExtension(filename string, allowedExtensions []string) error {
 	}
 	return nil
 }
+
+func checkDimensions(width, height int) error {
+	if int64(width)*int64(height) > MaxImagePixels {
+		return FileError{
+			Issue: fmt.Sprintf("image is too large: %dx%d pixels", width, height),
+		}
+	}
+	return nil
+}
@@ -1,24 +1,76 @@
 package models
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	_ "embed"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"io/fs"
-	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Zelinzky/go-sqlf"
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+
+	"lenslocked/rand"
 )
 
+// gallerySlugBytes is the amount of random bytes in a gallery slug. It only
+// needs to be unguessable, not as strong as a session token.
+const gallerySlugBytes = 16
+
 type Gallery struct {
-	ID     int    `db:"id"`
-	UserID int    `db:"user_id"`
-	Title  string `db:"title"`
+	ID         int        `db:"id"`
+	UserID     int        `db:"user_id"`
+	Title      string     `db:"title"`
+	Visibility Visibility `db:"visibility"`
+	// Slug is an unguessable identifier used to share unlisted galleries.
+	Slug string `db:"slug"`
+	// PasswordHash is set for galleries that visitors can only see after
+	// entering a password.
+	PasswordHash sql.NullString `db:"password_hash"`
+	// TakenDownAt is set when a moderator has hidden the gallery from
+	// everyone but its owner.
+	TakenDownAt sql.NullTime `db:"taken_down_at"`
+}
+
+// TakenDown reports whether a moderator has hidden the gallery.
+func (gallery Gallery) TakenDown() bool {
+	return gallery.TakenDownAt.Valid
+}
+
+// HasPassword reports whether visitors need a password to see the gallery.
+func (gallery Gallery) HasPassword() bool {
+	return gallery.PasswordHash.Valid
+}
+
+// Visibility controls who can see a gallery and its images.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be seen by anyone that has the link
+	// containing their slug.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone and are listed.
+	VisibilityPublic Visibility = "public"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
 }
 
 //go:embed gallery.sql
@@ -32,16 +84,26 @@ func init() {
 
 type GalleryService struct {
 	DB *sqlx.DB
+	// Storage is where the images are stored. When it is nil images are
+	// stored on the local disk inside ImagesDir.
+	Storage Storage
 	// ImagesDir holds the directory where the images are going to be stored
 	ImagesDir string
 }
 
+// Create starts a new private gallery for the user.
 func (g *GalleryService) Create(title string, userID int) (*Gallery, error) {
+	slug, err := rand.String(gallerySlugBytes)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:      title,
+		UserID:     userID,
+		Visibility: VisibilityPrivate,
+		Slug:       slug,
 	}
-	err := sqlf.NamedDB{DB: g.DB}.NamedGet(&gallery.ID, galleryQueries["create"], gallery)
+	err = sqlf.NamedDB{DB: g.DB}.NamedGet(&gallery.ID, galleryQueries["create"], gallery)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -62,6 +124,28 @@ func (g *GalleryService) ByID(id int) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (g *GalleryService) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	err := g.DB.Get(&gallery, galleryQueries["by_slug"], slug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get gallery by slug: %w", err)
+	}
+	return &gallery, nil
+}
+
+// Public returns every public gallery, newest first.
+func (g *GalleryService) Public() ([]Gallery, error) {
+	var galleries []Gallery
+	err := g.DB.Select(&galleries, galleryQueries["by_visibility"], VisibilityPublic)
+	if err != nil {
+		return nil, fmt.Errorf("query public galleries: %w", err)
+	}
+	return galleries, nil
+}
+
 func (g *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	var galleries []Gallery
 	err := g.DB.Select(&galleries, galleryQueries["by_user_id"], userID)
@@ -71,7 +155,67 @@ func (g *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
+// ByUserIDPage returns one page of the galleries of the user, together with the
+// total amount of galleries the user has.
+func (g *GalleryService) ByUserIDPage(userID int, page Page) ([]Gallery, int, error) {
+	var total int
+	err := g.DB.Get(&total, galleryQueries["count_by_user_id"], userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("count galleries by user: %w", err)
+	}
+	galleries := []Gallery{}
+	err = g.DB.Select(&galleries, galleryQueries["by_user_id_page"], userID, page.Limit(), page.Offset())
+	if err != nil {
+		return nil, 0, fmt.Errorf("query galleries by user: %w", err)
+	}
+	return galleries, total, nil
+}
+
+// OwnedGallery is a gallery together with the email address of its owner.
+type OwnedGallery struct {
+	Gallery
+	OwnerEmail string `db:"owner_email"`
+}
+
+// Page returns one page of every gallery, newest first, together with the
+// total amount of galleries.
+func (g *GalleryService) Page(page Page) ([]OwnedGallery, int, error) {
+	var total int
+	err := g.DB.Get(&total, galleryQueries["count"])
+	if err != nil {
+		return nil, 0, fmt.Errorf("count galleries: %w", err)
+	}
+	galleries := []OwnedGallery{}
+	err = g.DB.Select(&galleries, galleryQueries["page"], page.Limit(), page.Offset())
+	if err != nil {
+		return nil, 0, fmt.Errorf("query galleries: %w", err)
+	}
+	return galleries, total, nil
+}
+
+// TakeDown hides the gallery from everyone but its owner and moderators, no
+// matter its visibility or share links.
+func (g *GalleryService) TakeDown(id int) error {
+	_, err := g.DB.Exec(galleryQueries["take_down"], id, time.Now())
+	if err != nil {
+		return fmt.Errorf("take down gallery: %w", err)
+	}
+	return nil
+}
+
+// Restore undoes TakeDown.
+func (g *GalleryService) Restore(id int) error {
+	_, err := g.DB.Exec(galleryQueries["restore"], id)
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	return nil
+}
+
 func (g *GalleryService) Update(gallery *Gallery) error {
+	if !gallery.Visibility.Valid() {
+		return fmt.Errorf("update gallery: %w", ErrInvalidVisibility)
+	}
 	_, err := g.DB.NamedExec(galleryQueries["update"], *gallery)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
@@ -79,65 +223,135 @@ func (g *GalleryService) Update(gallery *Gallery) error {
 	return nil
 }
 
+// SetPassword protects the gallery with a password. An empty password removes
+// the protection.
+func (g *GalleryService) SetPassword(gallery *Gallery, password string) error {
+	var passwordHash sql.NullString
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("set gallery password: %w", err)
+		}
+		passwordHash = sql.NullString{String: string(hashedBytes), Valid: true}
+	}
+	_, err := g.DB.Exec(galleryQueries["update_password"], gallery.ID, passwordHash)
+	if err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+	gallery.PasswordHash = passwordHash
+	return nil
+}
+
+// CheckPassword reports whether password is the one protecting the gallery.
+func (g *GalleryService) CheckPassword(gallery *Gallery, password string) bool {
+	if !gallery.HasPassword() {
+		return true
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash.String), []byte(password))
+	return err == nil
+}
+
 func (g *GalleryService) Delete(id int) error {
 	_, err := g.DB.Exec(galleryQueries["delete"], id)
 	if err != nil {
 		return fmt.Errorf("delete gallery by id: %w", err)
 	}
-	err = os.RemoveAll(g.galleryDir(id))
+	return g.deleteImages(id)
+}
+
+// deleteImages removes every object of the gallery from the storage, images
+// and their renditions alike.
+func (g *GalleryService) deleteImages(id int) error {
+	objects, err := g.storage().List(g.galleryPrefix(id))
 	if err != nil {
 		return fmt.Errorf("delete gallery images: %w", err)
 	}
+	for _, object := range objects {
+		err = g.storage().Delete(object.Key)
+		if err != nil {
+			return fmt.Errorf("delete gallery images: %w", err)
+		}
+	}
 	return nil
 }
 
-func (g *GalleryService) galleryDir(id int) string {
-	imagesDir := g.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// storage returns the configured Storage, falling back to images on the local
+// disk inside ImagesDir.
+func (g *GalleryService) storage() Storage {
+	if g.Storage != nil {
+		return g.Storage
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+	return &DiskStorage{Dir: g.ImagesDir}
+}
+
+func (g *GalleryService) galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d/", id)
 }
 
 type Image struct {
-	GalleryID int
-	Path      string
-	Filename  string
+	ID        int    `db:"id"`
+	GalleryID int    `db:"gallery_id"`
+	Filename  string `db:"filename"`
+	// Path is the key of the image in the gallery Storage.
+	Path        string    `db:"storage_key"`
+	Caption     string    `db:"caption"`
+	Position    int       `db:"position"`
+	ContentType string    `db:"content_type"`
+	Size        int64     `db:"size"`
+	Width       int       `db:"width"`
+	Height      int       `db:"height"`
+	ContentHash string    `db:"content_hash"`
+	UploadedAt  time.Time `db:"uploaded_at"`
 }
 
 func (g *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(g.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+	var images []Image
+	err := g.DB.Select(&images, galleryQueries["images"], galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
-	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, g.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
-		}
-	}
 	return images, nil
 }
 
+// ImagesPage returns one page of the images of the gallery, together with the
+// total amount of images in it.
+func (g *GalleryService) ImagesPage(galleryID int, page Page) ([]Image, int, error) {
+	var total int
+	err := g.DB.Get(&total, galleryQueries["count_images"], galleryID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("counting gallery images: %w", err)
+	}
+	images := []Image{}
+	err = g.DB.Select(&images, galleryQueries["images_page"], galleryID, page.Limit(), page.Offset())
+	if err != nil {
+		return nil, 0, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	return images, total, nil
+}
+
 func (g *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(g.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+	var image Image
+	err := g.DB.Get(&image, galleryQueries["image"], galleryID, filename)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
 		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
-	return Image{
-		GalleryID: galleryID,
-		Path:      imagePath,
-		Filename:  filename,
-	}, nil
+	return image, nil
+}
+
+// OpenImage returns the contents of the image. Callers must close the
+// returned reader.
+func (g *GalleryService) OpenImage(image Image) (io.ReadCloser, *ObjectInfo, error) {
+	contents, info, err := g.storage().Get(image.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening image: %w", err)
+	}
+	if info.ContentType == "" {
+		info.ContentType = image.ContentType
+	}
+	return contents, info, nil
 }
 
 func (g *GalleryService) DeleteImage(galleryID int, filename string) error {
@@ -145,41 +359,129 @@ func (g *GalleryService) DeleteImage(galleryID int, filename string) error {
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
-	err = os.Remove(image.Path)
+	_, err = g.DB.Exec(galleryQueries["delete_image"], image.ID)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = g.storage().Delete(image.Path)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = g.deleteRenditions(image)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 	return nil
 }
 
-func (g *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
-	err := checkContentType(contents, g.imageContentTypes())
+// AllImages returns the images of every gallery.
+func (g *GalleryService) AllImages() ([]Image, error) {
+	var images []Image
+	err := g.DB.Select(&images, galleryQueries["all_images"])
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("retrieving all images: %w", err)
 	}
-	if !hasExtension(filename, g.extensions()) {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+	return images, nil
+}
+
+// CreateImage stores the contents of the image and records its metadata.
+// Uploading a file with the same name as an existing image replaces it.
+// Images are decoded before anything is stored, and what was stored is
+// deleted again if the image can't be recorded.
+func (g *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) (*Image, error) {
+	contentType, err := checkContentType(contents, g.imageContentTypes())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = checkExtension(filename, g.extensions())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	image, err := readImageMetadata(contents)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
+	image.GalleryID = galleryID
+	image.Filename = filename
+	image.Path = g.galleryPrefix(galleryID) + filename
+	image.ContentType = contentType
+	image.UploadedAt = time.Now()
 
-	galleryDir := g.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	src, _, err := decodeImage(contents)
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	_, err = contents.Seek(0, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	defer dst.Close()
+	err = g.storage().Put(image.Path, contents, image.Size, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("storing image %v: %w", filename, err)
+	}
+	err = g.storeRenditions(*image, src)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, errors.Join(err, g.discardImage(*image)))
+	}
+	err = sqlf.NamedDB{DB: g.DB}.NamedGet(&image.ID, galleryQueries["create_image"], image)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, errors.Join(err, g.discardImage(*image)))
+	}
+	return image, nil
+}
 
-	_, err = io.Copy(dst, contents)
+// discardImage deletes the original and renditions of an image that could
+// not be created.
+func (g *GalleryService) discardImage(image Image) error {
+	err := g.storage().Delete(image.Path)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return fmt.Errorf("discard image: %w", err)
+	}
+	err = g.deleteRenditions(image)
+	if err != nil {
+		return fmt.Errorf("discard image: %w", err)
 	}
 	return nil
 }
 
+// MaxImagePixels is the largest width times height an image can have. Decoding
+// takes several bytes of memory per pixel, so small files that claim huge
+// dimensions are refused before they are decoded.
+const MaxImagePixels = 50_000_000
+
+// readImageMetadata computes the size, dimensions and content hash of an
+// image. r is rewound to the start afterwards.
+func readImageMetadata(r io.ReadSeeker) (*Image, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return nil, fmt.Errorf("reading image metadata: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("reading image metadata: %w", err)
+	}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, FileError{Issue: fmt.Sprintf("image could not be decoded: %v", err)}
+	}
+	err = checkDimensions(config.Width, config.Height)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("reading image metadata: %w", err)
+	}
+	return &Image{
+		Size:        size,
+		Width:       config.Width,
+		Height:      config.Height,
+		ContentHash: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
 func hasExtension(file string, extensions []string) bool {
 	for _, ext := range extensions {
 		file = strings.ToLower(file)
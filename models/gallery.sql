@@ -1,24 +1,132 @@
 -- name: create
-INSERT INTO galleries (title, user_id)
-VALUES (:title, :user_id)
+INSERT INTO galleries (title, user_id, visibility, slug)
+VALUES (:title, :user_id, :visibility, :slug)
 RETURNING id;
 
 -- name: by_id
-SELECT title, user_id
+SELECT title, user_id, visibility, slug, password_hash, taken_down_at
 FROM galleries
 WHERE id = :id;
 
+-- name: by_slug
+SELECT id, title, user_id, visibility, slug, password_hash, taken_down_at
+FROM galleries
+WHERE slug = $1;
+
 -- name: by_user_id
-SELECT id, title
+SELECT id, user_id, title, visibility, slug, password_hash, taken_down_at
 FROM galleries
 WHERE user_id = $1;
 
+-- name: by_visibility
+SELECT id, user_id, title, visibility, slug, password_hash, taken_down_at
+FROM galleries
+WHERE visibility = $1
+  AND taken_down_at IS NULL
+ORDER BY id DESC;
+
 -- name: update
 UPDATE galleries
-SET title = :title
+SET title      = :title,
+    visibility = :visibility
 WHERE id = :id;
 
+-- name: update_password
+UPDATE galleries
+SET password_hash = $2
+WHERE id = $1;
+
 -- name: delete
 DELETE
 FROM galleries
-WHERE id = $1;
\ No newline at end of file
+WHERE id = $1;
+
+-- name: create_image
+INSERT INTO images (gallery_id, filename, storage_key, position, content_type, size, width, height, content_hash,
+                    uploaded_at)
+VALUES (:gallery_id, :filename, :storage_key,
+        (SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE gallery_id = :gallery_id),
+        :content_type, :size, :width, :height, :content_hash, :uploaded_at)
+ON CONFLICT (gallery_id, filename) DO UPDATE SET storage_key  = :storage_key,
+                                                 content_type = :content_type,
+                                                 size         = :size,
+                                                 width        = :width,
+                                                 height       = :height,
+                                                 content_hash = :content_hash,
+                                                 uploaded_at  = :uploaded_at
+RETURNING id;
+
+-- name: images
+SELECT id, gallery_id, filename, storage_key, caption, position, content_type, size, width, height, content_hash,
+       uploaded_at
+FROM images
+WHERE gallery_id = $1
+ORDER BY position, id;
+
+-- name: image
+SELECT id, gallery_id, filename, storage_key, caption, position, content_type, size, width, height, content_hash,
+       uploaded_at
+FROM images
+WHERE gallery_id = $1
+  AND filename = $2;
+
+-- name: all_images
+SELECT id, gallery_id, filename, storage_key, caption, position, content_type, size, width, height, content_hash,
+       uploaded_at
+FROM images
+ORDER BY gallery_id, position, id;
+
+-- name: delete_image
+DELETE
+FROM images
+WHERE id = $1;
+
+-- name: exists
+SELECT EXISTS(SELECT 1 FROM galleries WHERE id = $1);
+
+-- name: by_user_id_page
+SELECT id, user_id, title, visibility, slug, password_hash, taken_down_at
+FROM galleries
+WHERE user_id = $1
+ORDER BY id
+LIMIT $2 OFFSET $3;
+
+-- name: count_by_user_id
+SELECT COUNT(*)
+FROM galleries
+WHERE user_id = $1;
+
+-- name: images_page
+SELECT id, gallery_id, filename, storage_key, caption, position, content_type, size, width, height, content_hash,
+       uploaded_at
+FROM images
+WHERE gallery_id = $1
+ORDER BY position, id
+LIMIT $2 OFFSET $3;
+
+-- name: count_images
+SELECT COUNT(*)
+FROM images
+WHERE gallery_id = $1;
+
+-- name: page
+SELECT g.id, g.user_id, g.title, g.visibility, g.slug, g.password_hash, g.taken_down_at, u.email owner_email
+FROM galleries g
+         JOIN users u ON u.id = g.user_id
+ORDER BY g.id DESC
+LIMIT $1 OFFSET $2;
+
+-- name: count
+SELECT COUNT(*)
+FROM galleries;
+
+-- name: take_down
+UPDATE galleries
+SET taken_down_at = $2
+WHERE id = $1
+  AND taken_down_at IS NULL;
+
+-- name: restore
+UPDATE galleries
+SET taken_down_at = NULL
+WHERE id = $1;
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+// GalleryRole is the part a user plays in a gallery. The owner is the user
+// that created it, editors and viewers are members the owner invited.
+type GalleryRole string
+
+const (
+	GalleryRoleOwner GalleryRole = "owner"
+	// GalleryRoleEditor members can upload and delete images.
+	GalleryRoleEditor GalleryRole = "editor"
+	// GalleryRoleViewer members can see the gallery whatever its
+	// visibility.
+	GalleryRoleViewer GalleryRole = "viewer"
+)
+
+// ValidMember reports whether users can be invited to a gallery with the
+// role. There is only ever one owner.
+func (r GalleryRole) ValidMember() bool {
+	return r == GalleryRoleEditor || r == GalleryRoleViewer
+}
+
+// GalleryMember is a user the owner of a gallery invited to it.
+type GalleryMember struct {
+	ID        int         `db:"id"`
+	GalleryID int         `db:"gallery_id"`
+	UserID    int         `db:"user_id"`
+	Email     string      `db:"email"`
+	Role      GalleryRole `db:"role"`
+	CreatedAt time.Time   `db:"created_at"`
+}
+
+// GalleryInvitation asks the user with the email address to become a member
+// of a gallery.
+type GalleryInvitation struct {
+	ID        int         `db:"id"`
+	GalleryID int         `db:"gallery_id"`
+	Email     string      `db:"email"`
+	Role      GalleryRole `db:"role"`
+	// The Token is only set when a GalleryInvitation is being created.
+	Token     string    `db:"token"`
+	TokenHash string    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// MemberGallery is a gallery together with the role the user it was looked up
+// for has in it.
+type MemberGallery struct {
+	Gallery
+	Role GalleryRole `db:"member_role"`
+}
+
+//go:embed gallery_member.sql
+var galleryMemberQueriesFile string
+
+var galleryMemberQueries map[string]string
+
+func init() {
+	galleryMemberQueries = sqlf.Load(galleryMemberQueriesFile)
+}
+
+// DefaultGalleryInvitationDuration leaves invitees a week to accept.
+const DefaultGalleryInvitationDuration = 7 * 24 * time.Hour
+
+type GalleryMemberService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	Duration      time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Role returns the role of the user in the gallery. It is empty for visitors
+// that are not signed in and users that aren't members.
+func (gm *GalleryMemberService) Role(user *User, gallery *Gallery) (GalleryRole, error) {
+	if user == nil {
+		return "", nil
+	}
+	if user.ID == gallery.UserID {
+		return GalleryRoleOwner, nil
+	}
+	var role GalleryRole
+	err := gm.DB.Get(&role, galleryMemberQueries["role"], gallery.ID, user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("gallery role: %w", err)
+	}
+	return role, nil
+}
+
+func (gm *GalleryMemberService) ByGalleryID(galleryID int) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := gm.DB.Select(&members, galleryMemberQueries["by_gallery_id"], galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery members: %w", err)
+	}
+	return members, nil
+}
+
+// Galleries returns the galleries the user is a member of. Galleries that
+// were taken down are left out.
+func (gm *GalleryMemberService) Galleries(userID int) ([]MemberGallery, error) {
+	var galleries []MemberGallery
+	err := gm.DB.Select(&galleries, galleryMemberQueries["galleries"], userID)
+	if err != nil {
+		return nil, fmt.Errorf("query member galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+// Remove takes the membership with the ID away from the gallery.
+func (gm *GalleryMemberService) Remove(galleryID, id int) error {
+	_, err := gm.DB.Exec(galleryMemberQueries["delete"], id, galleryID)
+	if err != nil {
+		return fmt.Errorf("remove gallery member: %w", err)
+	}
+	return nil
+}
+
+// Invite creates an invitation for the email address to join the gallery,
+// replacing any earlier invitation of the address. The owner can't be
+// invited to their own gallery.
+func (gm *GalleryMemberService) Invite(galleryID int, email string, role GalleryRole) (*GalleryInvitation, error) {
+	email = strings.ToLower(email)
+	err := validateEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	if !role.ValidMember() {
+		return nil, fmt.Errorf("invite gallery member: %w", ErrInvalidGalleryRole)
+	}
+	var ownerEmail string
+	err = gm.DB.Get(&ownerEmail, galleryMemberQueries["owner_email"], galleryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invite gallery member: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	if ownerEmail == email {
+		return nil, fmt.Errorf("invite gallery member: %w", ErrGalleryOwner)
+	}
+
+	now := gm.now()
+	_, err = gm.DB.Exec(galleryMemberQueries["delete_expired_invitations"], now)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	bytesPerToken := gm.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	duration := gm.Duration
+	if duration == 0 {
+		duration = DefaultGalleryInvitationDuration
+	}
+	invitation := GalleryInvitation{
+		GalleryID: galleryID,
+		Email:     email,
+		Role:      role,
+		Token:     token,
+		TokenHash: gm.hash(token),
+		ExpiresAt: now.Add(duration),
+	}
+	err = sqlf.NamedDB{DB: gm.DB}.NamedGet(&invitation.ID, galleryMemberQueries["create_invitation"], invitation)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	return &invitation, nil
+}
+
+// Invitations returns the invitations of the gallery that can still be
+// accepted.
+func (gm *GalleryMemberService) Invitations(galleryID int) ([]GalleryInvitation, error) {
+	var invitations []GalleryInvitation
+	err := gm.DB.Select(&invitations, galleryMemberQueries["invitations"], galleryID, gm.now())
+	if err != nil {
+		return nil, fmt.Errorf("query gallery invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Invitation looks up the invitation with the token, so the invitee can be
+// asked to confirm. It returns ErrInvalidToken for unknown or expired tokens.
+func (gm *GalleryMemberService) Invitation(token string) (*GalleryInvitation, error) {
+	var invitation GalleryInvitation
+	err := gm.DB.Get(&invitation, galleryMemberQueries["invitation"], gm.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("gallery invitation: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("gallery invitation: %w", err)
+	}
+	if !gm.now().Before(invitation.ExpiresAt) {
+		return nil, fmt.Errorf("gallery invitation: %w", ErrInvalidToken)
+	}
+	return &invitation, nil
+}
+
+func (gm *GalleryMemberService) Cancel(galleryID, invitationID int) error {
+	_, err := gm.DB.Exec(galleryMemberQueries["delete_invitation"], invitationID, galleryID)
+	if err != nil {
+		return fmt.Errorf("cancel gallery invitation: %w", err)
+	}
+	return nil
+}
+
+// Accept makes the user a member of the gallery the invitation with the token
+// is for. Invitations can only be accepted by the user with the email
+// address they were sent to, so forwarding one doesn't let anyone else in.
+func (gm *GalleryMemberService) Accept(token string, user *User) (*GalleryInvitation, error) {
+	tx, err := gm.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	defer tx.Rollback()
+	var invitation GalleryInvitation
+	err = tx.Get(&invitation, galleryMemberQueries["invitation"], gm.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("accept gallery invitation: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	if !gm.now().Before(invitation.ExpiresAt) {
+		return nil, fmt.Errorf("accept gallery invitation: %w", ErrInvalidToken)
+	}
+	if invitation.Email != strings.ToLower(user.Email) {
+		return nil, fmt.Errorf("accept gallery invitation: %w", ErrInvitationEmail)
+	}
+	_, err = tx.Exec(galleryMemberQueries["delete_invitation"], invitation.ID, invitation.GalleryID)
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	_, err = tx.Exec(galleryMemberQueries["add_member"], invitation.GalleryID, user.ID, invitation.Role)
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	return &invitation, nil
+}
+
+func (gm *GalleryMemberService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (gm *GalleryMemberService) now() time.Time {
+	if gm.Now == nil {
+		return time.Now()
+	}
+	return gm.Now()
+}
@@ -0,0 +1,68 @@
+-- name: role
+SELECT role
+FROM gallery_members
+WHERE gallery_id = $1
+  AND user_id = $2;
+
+-- name: by_gallery_id
+SELECT m.id, m.gallery_id, m.user_id, m.role, m.created_at, u.email
+FROM gallery_members m
+         JOIN users u ON u.id = m.user_id
+WHERE m.gallery_id = $1
+ORDER BY m.id;
+
+-- name: delete
+DELETE
+FROM gallery_members
+WHERE id = $1
+  AND gallery_id = $2;
+
+-- name: galleries
+SELECT g.id, g.user_id, g.title, g.visibility, g.slug, g.password_hash, g.taken_down_at, m.role member_role
+FROM galleries g
+         JOIN gallery_members m ON m.gallery_id = g.id
+WHERE m.user_id = $1
+  AND g.taken_down_at IS NULL
+ORDER BY g.id;
+
+-- name: owner_email
+SELECT u.email
+FROM galleries g
+         JOIN users u ON u.id = g.user_id
+WHERE g.id = $1;
+
+-- name: create_invitation
+INSERT INTO gallery_invitations (gallery_id, email, role, token_hash, expires_at)
+VALUES (:gallery_id, :email, :role, :token_hash, :expires_at)
+ON CONFLICT (gallery_id, email) DO UPDATE SET role       = :role,
+                                              token_hash = :token_hash,
+                                              expires_at = :expires_at
+RETURNING id;
+
+-- name: invitations
+SELECT id, gallery_id, email, role, token_hash, expires_at
+FROM gallery_invitations
+WHERE gallery_id = $1
+  AND expires_at > $2
+ORDER BY id;
+
+-- name: invitation
+SELECT id, gallery_id, email, role, token_hash, expires_at
+FROM gallery_invitations
+WHERE token_hash = $1;
+
+-- name: delete_invitation
+DELETE
+FROM gallery_invitations
+WHERE id = $1
+  AND gallery_id = $2;
+
+-- name: delete_expired_invitations
+DELETE
+FROM gallery_invitations
+WHERE expires_at <= $1;
+
+-- name: add_member
+INSERT INTO gallery_members (gallery_id, user_id, role)
+VALUES ($1, $2, $3)
+ON CONFLICT (gallery_id, user_id) DO UPDATE SET role = $3;
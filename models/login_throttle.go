@@ -0,0 +1,199 @@
+package models
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// DefaultMaxAccountFailures is how many wrong passwords an account gets
+	// before it is locked.
+	DefaultMaxAccountFailures = 5
+	// DefaultMaxIPFailures is how many failed sign ins an IP address gets,
+	// across every account, before it is blocked.
+	DefaultMaxIPFailures = 20
+	// DefaultLockoutDuration is how long the first lockout lasts. Every
+	// further failure doubles it, up to DefaultMaxLockoutDuration.
+	DefaultLockoutDuration    = 5 * time.Minute
+	DefaultMaxLockoutDuration = 24 * time.Hour
+	// DefaultFailureWindow is how long failures are remembered after the
+	// last one.
+	DefaultFailureWindow = 24 * time.Hour
+)
+
+//go:embed login_throttle.sql
+var loginThrottleQueriesFile string
+
+var loginThrottleQueries map[string]string
+
+func init() {
+	loginThrottleQueries = sqlf.Load(loginThrottleQueriesFile)
+}
+
+// LoginThrottleService tracks failed sign ins per account and per IP address
+// and locks them out for a while once they have too many. Checking is cheap,
+// so locked out attempts never get to the password hash.
+type LoginThrottleService struct {
+	DB *sqlx.DB
+	// The zero values of the limits below use the package defaults.
+	MaxAccountFailures int
+	MaxIPFailures      int
+	LockoutDuration    time.Duration
+	MaxLockoutDuration time.Duration
+	FailureWindow      time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Check returns ErrLoginLocked if the account with the email address or the
+// IP address is currently locked out.
+func (lt *LoginThrottleService) Check(email, ipAddress string) error {
+	var accountKey string
+	user, err := lt.userByEmail(email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("check login: %w", err)
+	}
+	if user != nil {
+		accountKey = lt.accountKey(user.ID)
+	}
+	var lockedUntil sql.NullTime
+	err = lt.DB.Get(&lockedUntil, loginThrottleQueries["locked_until"], accountKey, lt.ipKey(ipAddress), lt.now())
+	if err != nil {
+		return fmt.Errorf("check login: %w", err)
+	}
+	if lockedUntil.Valid {
+		return fmt.Errorf("check login: %w", ErrLoginLocked)
+	}
+	return nil
+}
+
+// Fail records a failed sign in. If it caused the account to be locked, the
+// account's user is returned so they can be told about it.
+func (lt *LoginThrottleService) Fail(email, ipAddress string) (*User, error) {
+	_, err := lt.fail(lt.ipKey(ipAddress), lt.maxIPFailures())
+	if err != nil {
+		return nil, fmt.Errorf("record failed login: %w", err)
+	}
+	user, err := lt.userByEmail(email)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("record failed login: %w", err)
+	}
+	locked, err := lt.fail(lt.accountKey(user.ID), lt.maxAccountFailures())
+	if err != nil {
+		return nil, fmt.Errorf("record failed login: %w", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// Unlock forgets the failed sign ins of the user. It is used once they signed
+// in or proved they own the account by resetting their password.
+func (lt *LoginThrottleService) Unlock(userID int) error {
+	_, err := lt.DB.Exec(loginThrottleQueries["reset"], lt.accountKey(userID))
+	if err != nil {
+		return fmt.Errorf("unlock login: %w", err)
+	}
+	return nil
+}
+
+// fail counts a failure for key and locks it if it has max failures or more.
+// It reports whether the key was not locked before.
+func (lt *LoginThrottleService) fail(key string, max int) (bool, error) {
+	now := lt.now()
+	var row struct {
+		Failures    int          `db:"failures"`
+		LockedUntil sql.NullTime `db:"locked_until"`
+	}
+	err := lt.DB.Get(&row, loginThrottleQueries["fail"], key, now, now.Add(-lt.failureWindow()))
+	if err != nil {
+		return false, err
+	}
+	if row.Failures < max {
+		return false, nil
+	}
+	_, err = lt.DB.Exec(loginThrottleQueries["lock"], key, now.Add(lt.lockoutDuration(row.Failures-max)))
+	if err != nil {
+		return false, err
+	}
+	wasLocked := row.LockedUntil.Valid && row.LockedUntil.Time.After(now)
+	return !wasLocked, nil
+}
+
+// lockoutDuration doubles the lockout for every failure past the limit.
+func (lt *LoginThrottleService) lockoutDuration(extraFailures int) time.Duration {
+	duration := lt.LockoutDuration
+	if duration <= 0 {
+		duration = DefaultLockoutDuration
+	}
+	max := lt.MaxLockoutDuration
+	if max <= 0 {
+		max = DefaultMaxLockoutDuration
+	}
+	for i := 0; i < extraFailures && duration < max; i++ {
+		duration *= 2
+	}
+	if duration > max {
+		duration = max
+	}
+	return duration
+}
+
+func (lt *LoginThrottleService) userByEmail(email string) (*User, error) {
+	var user User
+	err := lt.DB.Get(&user, loginThrottleQueries["user_by_email"], strings.ToLower(email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (lt *LoginThrottleService) accountKey(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+func (lt *LoginThrottleService) ipKey(ipAddress string) string {
+	return "ip:" + ipAddress
+}
+
+func (lt *LoginThrottleService) maxAccountFailures() int {
+	if lt.MaxAccountFailures <= 0 {
+		return DefaultMaxAccountFailures
+	}
+	return lt.MaxAccountFailures
+}
+
+func (lt *LoginThrottleService) maxIPFailures() int {
+	if lt.MaxIPFailures <= 0 {
+		return DefaultMaxIPFailures
+	}
+	return lt.MaxIPFailures
+}
+
+func (lt *LoginThrottleService) failureWindow() time.Duration {
+	if lt.FailureWindow <= 0 {
+		return DefaultFailureWindow
+	}
+	return lt.FailureWindow
+}
+
+func (lt *LoginThrottleService) now() time.Time {
+	if lt.Now == nil {
+		return time.Now()
+	}
+	return lt.Now()
+}
@@ -0,0 +1,31 @@
+-- name: user_by_email
+SELECT id, email, password_hash, verified_at
+FROM users
+WHERE email = $1;
+
+-- name: locked_until
+SELECT MAX(locked_until)
+FROM login_throttles
+WHERE key IN ($1, $2)
+  AND locked_until > $3;
+
+-- name: fail
+INSERT INTO login_throttles (key, failures, last_failure_at)
+VALUES ($1, 1, $2)
+ON CONFLICT (key) DO UPDATE
+    SET failures        = CASE
+                              WHEN login_throttles.last_failure_at < $3 THEN 1
+                              ELSE login_throttles.failures + 1
+        END,
+        last_failure_at = $2
+RETURNING failures, locked_until;
+
+-- name: lock
+UPDATE login_throttles
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: reset
+DELETE
+FROM login_throttles
+WHERE key = $1;
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+// MagicLink lets a user sign in by following a link sent to their email
+// address, instead of entering their password.
+type MagicLink struct {
+	ID     int `db:"id"`
+	UserID int `db:"user_id"`
+	// The Token is only set when a MagicLink is being created.
+	Token     string    `db:"token"`
+	TokenHash string    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+//go:embed magic_link.sql
+var magicLinkQueriesFile string
+
+var magicLinkQueries map[string]string
+
+func init() {
+	magicLinkQueries = sqlf.Load(magicLinkQueriesFile)
+}
+
+// DefaultMagicLinkDuration is kept short, as anyone with the link can sign
+// in with it.
+const DefaultMagicLinkDuration = 15 * time.Minute
+
+type MagicLinkService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	Duration      time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Create issues a sign in link for the user with the email address, replacing
+// any link that was sent before. It returns ErrNotFound if there is no such
+// user.
+func (ml *MagicLinkService) Create(email string) (*MagicLink, error) {
+	email = strings.ToLower(email)
+	var userID int
+	err := ml.DB.Get(&userID, magicLinkQueries["user_id"], email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create magic link: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+
+	bytesPerToken := ml.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	duration := ml.Duration
+	if duration == 0 {
+		duration = DefaultMagicLinkDuration
+	}
+	link := MagicLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: ml.hash(token),
+		ExpiresAt: ml.now().Add(duration),
+	}
+	err = sqlf.NamedDB{DB: ml.DB}.NamedGet(&link.ID, magicLinkQueries["create"], link)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	return &link, nil
+}
+
+// Consume uses the link up and returns the user it was issued to. Links that
+// don't exist, were used already or expired are reported as ErrInvalidToken.
+func (ml *MagicLinkService) Consume(token string) (*User, error) {
+	var link MagicLink
+	err := ml.DB.Get(&link, magicLinkQueries["consume"], ml.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume magic link: %w", ErrInvalidToken)
+		}
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	if !ml.now().Before(link.ExpiresAt) {
+		return nil, fmt.Errorf("consume magic link: %w", ErrInvalidToken)
+	}
+	var user User
+	err = ml.DB.Get(&user, magicLinkQueries["user"], link.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	return &user, nil
+}
+
+func (ml *MagicLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (ml *MagicLinkService) now() time.Time {
+	if ml.Now == nil {
+		return time.Now()
+	}
+	return ml.Now()
+}
@@ -0,0 +1,22 @@
+-- name: user_id
+SELECT id
+FROM users
+WHERE email = $1;
+
+-- name: create
+INSERT INTO magic_links (user_id, token_hash, expires_at)
+VALUES (:user_id, :token_hash, :expires_at)
+ON CONFLICT (user_id) DO UPDATE SET token_hash = :token_hash,
+                                    expires_at = :expires_at
+RETURNING id;
+
+-- name: consume
+DELETE
+FROM magic_links
+WHERE token_hash = $1
+RETURNING user_id, expires_at;
+
+-- name: user
+SELECT *
+FROM users
+WHERE id = $1;
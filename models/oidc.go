@@ -0,0 +1,455 @@
+package models
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcClockSkew is how far the clocks of the provider and the server may
+	// be apart when checking the times in ID tokens.
+	oidcClockSkew = time.Minute
+	// oidcKeysRefreshInterval keeps ID tokens with unknown key IDs from making
+	// the provider fetch its keys over and over.
+	oidcKeysRefreshInterval = time.Minute
+	maxOIDCResponseBytes    = 1 << 20
+)
+
+// OIDCProvider is an OpenID Connect identity provider users can sign in with,
+// using the authorization code flow with PKCE. Its endpoints and keys are
+// read from its discovery document the first time they are needed.
+type OIDCProvider struct {
+	// Name identifies the provider in URLs, e.g. "acme" for /auth/acme/login.
+	Name string
+	// DisplayName is shown on the sign in page.
+	DisplayName string
+	// Issuer is the URL of the provider. The discovery document is looked up
+	// at Issuer + "/.well-known/openid-configuration".
+	Issuer   string
+	ClientID string
+	// ClientSecret is sent with HTTP basic authentication. Public clients
+	// leave it empty and only rely on PKCE.
+	ClientSecret string
+	// RedirectURL is the callback URL registered with the provider.
+	RedirectURL string
+	// HTTPClient defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          []oidcKey
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// IDToken holds the claims of a verified ID token.
+type IDToken struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        oidcAudience `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	Expiry          int64        `json:"exp"`
+	IssuedAt        int64        `json:"iat"`
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	EmailVerified   oidcBool     `json:"email_verified"`
+}
+
+// oidcAudience is either a single audience or a list of them.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("aud: %w", err)
+	}
+	*a = list
+	return nil
+}
+
+// oidcBool is a boolean claim, which some providers send as a string.
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	switch string(bytes.Trim(data, `"`)) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// AuthCodeURL returns the URL to send the user to, to sign in at the
+// provider. state and nonce come back in the callback and the ID token, and
+// the code verifier has to be given to Exchange.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", fmt.Errorf("auth code url: %w", err)
+	}
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("auth code url: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// Exchange trades the authorization code from the callback for the ID token
+// of the user, which still has to be verified.
+func (p *OIDCProvider) Exchange(code, codeVerifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", fmt.Errorf("exchange code: %w", err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("exchange code: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("exchange code: %w", err)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("exchange code: %s: %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("exchange code: unexpected status %d", status)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("exchange code: no id token in response")
+	}
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken checks the signature of the ID token against the keys of the
+// provider, and that it was issued by the provider for this client and
+// sign in. Tokens that can't be verified are reported as ErrInvalidIDToken.
+func (p *OIDCProvider) VerifyIDToken(rawIDToken, nonce string) (*IDToken, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("verify id token: %w: malformed token", ErrInvalidIDToken)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w: header: %v", ErrInvalidIDToken, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w: header: %v", ErrInvalidIDToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w: signature: %v", ErrInvalidIDToken, err)
+	}
+	keys, err := p.signingKeys(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifyJWS(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("verify id token: %w: bad signature", ErrInvalidIDToken)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w: claims: %v", ErrInvalidIDToken, err)
+	}
+	var token IDToken
+	err = json.Unmarshal(claimsJSON, &token)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w: claims: %v", ErrInvalidIDToken, err)
+	}
+	if token.Issuer != discovery.Issuer {
+		return nil, fmt.Errorf("verify id token: %w: issuer %q", ErrInvalidIDToken, token.Issuer)
+	}
+	audience := false
+	for _, aud := range token.Audience {
+		audience = audience || aud == p.ClientID
+	}
+	if !audience {
+		return nil, fmt.Errorf("verify id token: %w: audience %q", ErrInvalidIDToken, token.Audience)
+	}
+	if len(token.Audience) > 1 && token.AuthorizedParty != p.ClientID {
+		return nil, fmt.Errorf("verify id token: %w: authorized party %q", ErrInvalidIDToken, token.AuthorizedParty)
+	}
+	now := p.now()
+	if !now.Before(time.Unix(token.Expiry, 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("verify id token: %w: expired", ErrInvalidIDToken)
+	}
+	if time.Unix(token.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("verify id token: %w: issued in the future", ErrInvalidIDToken)
+	}
+	if token.Nonce == "" || token.Nonce != nonce {
+		return nil, fmt.Errorf("verify id token: %w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if token.Subject == "" {
+		return nil, fmt.Errorf("verify id token: %w: no subject", ErrInvalidIDToken)
+	}
+	return &token, nil
+}
+
+// discover fetches the discovery document of the provider, once.
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var discovery oidcDiscovery
+	err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discover: issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discover: missing endpoints")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// signingKeys returns the keys of the provider a token signed with the key
+// ID may be signed with. The keys are fetched again if none match, as
+// providers rotate their keys.
+func (p *OIDCProvider) signingKeys(keyID string) ([]crypto.PublicKey, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := p.matchingKeys(keyID)
+	if len(keys) > 0 || p.now().Sub(p.keysFetchedAt) < oidcKeysRefreshInterval {
+		return keys, nil
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err = p.getJSON(discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %w", err)
+	}
+	p.keys = nil
+	for _, raw := range jwks.Keys {
+		key, ok := parseJWK(raw)
+		if ok {
+			p.keys = append(p.keys, key)
+		}
+	}
+	p.keysFetchedAt = p.now()
+	return p.matchingKeys(keyID), nil
+}
+
+func (p *OIDCProvider) matchingKeys(keyID string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, key := range p.keys {
+		if keyID == "" || key.id == keyID {
+			keys = append(keys, key.key)
+		}
+	}
+	return keys
+}
+
+// parseJWK parses an RSA or P-256 signing key of a JWK set. Other keys are
+// skipped.
+func parseJWK(raw json.RawMessage) (oidcKey, bool) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	err := json.Unmarshal(raw, &jwk)
+	if err != nil || (jwk.Use != "" && jwk.Use != "sig") {
+		return oidcKey{}, false
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return oidcKey{}, false
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return oidcKey{}, false
+		}
+		key := rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < minRSAKeyBits || key.E < 3 || key.E%2 == 0 {
+			return oidcKey{}, false
+		}
+		return oidcKey{id: jwk.Kid, key: &key}, true
+	case "EC":
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if jwk.Crv != "P-256" || errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return oidcKey{}, false
+		}
+		_, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return oidcKey{}, false
+		}
+		key := ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return oidcKey{id: jwk.Kid, key: &key}, true
+	default:
+		return oidcKey{}, false
+	}
+}
+
+// verifyJWS reports whether signature is a valid RS256 or ES256 signature of
+// data by key. Any other algorithm, "none" included, is rejected.
+func verifyJWS(alg string, key crypto.PublicKey, data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s side by side rather than ASN.1.
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+func (p *OIDCProvider) getJSON(rawURL string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	status, err := p.do(req, v)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("get %s: unexpected status %d", rawURL, status)
+	}
+	return nil
+}
+
+// do sends req and decodes the JSON response into v, whatever its status.
+func (p *OIDCProvider) do(req *http.Request, v any) (int, error) {
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(v)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("%s %s: %w", req.Method, req.URL, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (p *OIDCProvider) httpClient() *http.Client {
+	if p.HTTPClient == nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return p.HTTPClient
+}
+
+func (p *OIDCProvider) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+	return p.Now()
+}
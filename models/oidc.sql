@@ -0,0 +1,32 @@
+-- name: create_login
+INSERT INTO oidc_logins (provider, state_hash, nonce, code_verifier, expires_at)
+VALUES (:provider, :state_hash, :nonce, :code_verifier, :expires_at)
+RETURNING id;
+
+-- name: consume_login
+DELETE
+FROM oidc_logins
+WHERE state_hash = $1
+RETURNING id, provider, state_hash, nonce, code_verifier, expires_at;
+
+-- name: delete_expired_logins
+DELETE
+FROM oidc_logins
+WHERE expires_at <= $1;
+
+-- name: user_by_identity
+SELECT users.*
+FROM users
+         JOIN user_identities ON user_identities.user_id = users.id
+WHERE user_identities.provider = $1
+  AND user_identities.subject = $2;
+
+-- name: user_by_email
+SELECT *
+FROM users
+WHERE email = $1;
+
+-- name: create_identity
+INSERT INTO user_identities (user_id, provider, subject, email)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (provider, subject) DO NOTHING;
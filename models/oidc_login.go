@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+// DefaultOIDCLoginDuration is how long users have to sign in at the identity
+// provider and come back.
+const DefaultOIDCLoginDuration = 10 * time.Minute
+
+// OIDCLogin is a sign in with an identity provider that was started. It is
+// found again by its state when the provider redirects back.
+type OIDCLogin struct {
+	ID       int    `db:"id"`
+	Provider string `db:"provider"`
+	// State is only set when an OIDCLogin is being created.
+	State        string    `db:"state"`
+	StateHash    string    `db:"state_hash"`
+	Nonce        string    `db:"nonce"`
+	CodeVerifier string    `db:"code_verifier"`
+	ExpiresAt    time.Time `db:"expires_at"`
+	// URL is where to send the user to sign in at the provider.
+	URL string `db:"-"`
+}
+
+//go:embed oidc.sql
+var oidcQueriesFile string
+
+var oidcQueries map[string]string
+
+func init() {
+	oidcQueries = sqlf.Load(oidcQueriesFile)
+}
+
+// OIDCService signs users in with OpenID Connect identity providers. The
+// identity is linked to the account with the same email address the first
+// time, after which the provider keeps signing in to that account.
+type OIDCService struct {
+	DB            *sqlx.DB
+	Providers     map[string]*OIDCProvider
+	BytesPerToken int
+	// Duration defaults to DefaultOIDCLoginDuration.
+	Duration time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Provider returns the provider with the name, or ErrNotFound.
+func (oc *OIDCService) Provider(name string) (*OIDCProvider, error) {
+	provider, ok := oc.Providers[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return provider, nil
+}
+
+// ProviderList returns the providers sorted by name.
+func (oc *OIDCService) ProviderList() []*OIDCProvider {
+	providers := make([]*OIDCProvider, 0, len(oc.Providers))
+	for _, provider := range oc.Providers {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
+
+// Begin starts signing in with the provider. The State of the returned
+// OIDCLogin has to be kept by the browser, so the callback can be checked to
+// come from the same one.
+func (oc *OIDCService) Begin(providerName string) (*OIDCLogin, error) {
+	provider, err := oc.Provider(providerName)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	now := oc.now()
+	_, err = oc.DB.Exec(oidcQueries["delete_expired_logins"], now)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	bytesPerToken := oc.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	state, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	nonce, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	// PKCE code verifiers can't have the padding of rand.String.
+	verifier, err := rand.Bytes(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	duration := oc.Duration
+	if duration <= 0 {
+		duration = DefaultOIDCLoginDuration
+	}
+	login := OIDCLogin{
+		Provider:     provider.Name,
+		State:        state,
+		StateHash:    oc.hash(state),
+		Nonce:        nonce,
+		CodeVerifier: base64.RawURLEncoding.EncodeToString(verifier),
+		ExpiresAt:    now.Add(duration),
+	}
+	login.URL, err = provider.AuthCodeURL(login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	err = sqlf.NamedDB{DB: oc.DB}.NamedGet(&login.ID, oidcQueries["create_login"], login)
+	if err != nil {
+		return nil, fmt.Errorf("begin oidc login: %w", err)
+	}
+	return &login, nil
+}
+
+// Finish completes the sign in identified by state with the authorization
+// code the provider sent back, and returns the user it signs in to.
+//
+// Identities are only linked to accounts whose email address is verified,
+// both by the provider and by us. Otherwise whoever signed up with an
+// address first could take over the account of its owner, or the other way
+// around.
+func (oc *OIDCService) Finish(providerName, state, code string) (*User, error) {
+	provider, err := oc.Provider(providerName)
+	if err != nil {
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	var login OIDCLogin
+	err = oc.DB.Get(&login, oidcQueries["consume_login"], oc.hash(state))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("finish oidc login: %w", ErrChallengeExpired)
+		}
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	if login.Provider != provider.Name || !oc.now().Before(login.ExpiresAt) {
+		return nil, fmt.Errorf("finish oidc login: %w", ErrChallengeExpired)
+	}
+	rawIDToken, err := provider.Exchange(code, login.CodeVerifier)
+	if err != nil {
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	token, err := provider.VerifyIDToken(rawIDToken, login.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+
+	var user User
+	err = oc.DB.Get(&user, oidcQueries["user_by_identity"], provider.Name, token.Subject)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	if token.Email == "" || !token.EmailVerified {
+		return nil, fmt.Errorf("finish oidc login: %w", ErrOIDCEmailUnverified)
+	}
+	email := strings.ToLower(token.Email)
+	err = oc.DB.Get(&user, oidcQueries["user_by_email"], email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("finish oidc login: %w", ErrOIDCNoAccount)
+		}
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	if !user.Verified() {
+		return nil, fmt.Errorf("finish oidc login: %w", ErrOIDCAccountUnverified)
+	}
+	_, err = oc.DB.Exec(oidcQueries["create_identity"], user.ID, provider.Name, token.Subject, email)
+	if err != nil {
+		return nil, fmt.Errorf("finish oidc login: %w", err)
+	}
+	return &user, nil
+}
+
+func (oc *OIDCService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (oc *OIDCService) now() time.Time {
+	if oc.Now == nil {
+		return time.Now()
+	}
+	return oc.Now()
+}
@@ -0,0 +1,509 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOIDC is an identity provider that serves the discovery document, its
+// keys and the token endpoint. Codes are handed out by authorize instead of
+// a sign in page.
+type fakeOIDC struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	rsaKey       *rsa.PrivateKey
+	ecKey        *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeOIDCCode
+}
+
+type fakeOIDCCode struct {
+	challenge   string
+	redirectURI string
+	idToken     string
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeOIDC{
+		ClientID:     "lenslocked",
+		ClientSecret: "client secret",
+		rsaKey:       rsaKey,
+		ecKey:        ecKey,
+		codes:        map[string]fakeOIDCCode{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeFakeOIDCJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeFakeOIDCJSON(w, http.StatusOK, map[string]any{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "rsa",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				{
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+					"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", f.token)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Provider returns a provider for the fake, using clock for the current time.
+func (f *fakeOIDC) Provider(clock func() time.Time) *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "fake",
+		DisplayName:  "Fake",
+		Issuer:       f.URL,
+		ClientID:     f.ClientID,
+		ClientSecret: f.ClientSecret,
+		RedirectURL:  "https://www.lenslocked.com/auth/fake/callback",
+		HTTPClient:   f.Client(),
+		Now:          clock,
+	}
+}
+
+// authorize signs the user with the claims in at the auth code URL, and
+// returns the code the provider would redirect back with. The nonce is
+// taken from the URL unless the claims have one.
+func (f *fakeOIDC) authorize(t *testing.T, authCodeURL string, claims map[string]any) string {
+	t.Helper()
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != f.ClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected auth code url %s", authCodeURL)
+	}
+	if _, ok := claims["nonce"]; !ok {
+		claims["nonce"] = query.Get("nonce")
+	}
+	code := base64.RawURLEncoding.EncodeToString([]byte(query.Get("state")))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.codes[code] = fakeOIDCCode{
+		challenge:   query.Get("code_challenge"),
+		redirectURI: query.Get("redirect_uri"),
+		idToken:     f.sign(t, "RS256", "rsa", claims),
+	}
+	return code
+}
+
+func (f *fakeOIDC) token(w http.ResponseWriter, r *http.Request) {
+	// The client ID and secret are form encoded before being put in the
+	// header, see section 2.3.1 of RFC 6749.
+	clientID, clientSecret, ok := r.BasicAuth()
+	clientID, errID := url.QueryUnescape(clientID)
+	clientSecret, errSecret := url.QueryUnescape(clientSecret)
+	if !ok || errID != nil || errSecret != nil || clientID != f.ClientID || clientSecret != f.ClientSecret {
+		writeFakeOIDCJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		writeFakeOIDCJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	f.mu.Lock()
+	code, ok := f.codes[r.FormValue("code")]
+	delete(f.codes, r.FormValue("code"))
+	f.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || code.redirectURI != r.FormValue("redirect_uri") ||
+		code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		writeFakeOIDCJSON(w, http.StatusBadRequest, map[string]string{
+			"error":             "invalid_grant",
+			"error_description": "code or code verifier is invalid",
+		})
+		return
+	}
+	writeFakeOIDCJSON(w, http.StatusOK, map[string]string{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"id_token":     code.idToken,
+	})
+}
+
+// sign returns an ID token with the claims, signed with the key of the fake
+// for alg. Tokens with the alg "none" are not signed.
+func (f *fakeOIDC) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, f.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, f.ecKey, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "none":
+	default:
+		t.Fatalf("unsupported alg %q", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims returns the claims of a valid ID token issued at now.
+func (f *fakeOIDC) claims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":            f.URL,
+		"sub":            "248289761001",
+		"aud":            f.ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "n-0S6_WzA2Mj",
+		"email":          "Jane.Doe@example.com",
+		"email_verified": true,
+	}
+}
+
+func writeFakeOIDCJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	provider := fake.Provider(fixedClock(&now))
+
+	authCodeURL, err := provider.AuthCodeURL("state", "n-0S6_WzA2Mj", "code verifier of the test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authCodeURL, fake.URL+"/authorize?") {
+		t.Errorf("AuthCodeURL() = %s, want the authorization endpoint", authCodeURL)
+	}
+	code := fake.authorize(t, authCodeURL, fake.claims(now))
+	rawIDToken, err := provider.Exchange(code, "code verifier of the test")
+	if err != nil {
+		t.Fatalf("Exchange() err = %v", err)
+	}
+	token, err := provider.VerifyIDToken(rawIDToken, "n-0S6_WzA2Mj")
+	if err != nil {
+		t.Fatalf("VerifyIDToken() err = %v", err)
+	}
+	if token.Subject != "248289761001" || token.Email != "Jane.Doe@example.com" || !token.EmailVerified {
+		t.Errorf("VerifyIDToken() = %+v", token)
+	}
+
+	_, err = provider.Exchange(code, "code verifier of the test")
+	if err == nil {
+		t.Errorf("Exchange() with a used code err = nil, want an error")
+	}
+}
+
+func TestOIDCProviderExchangeWrongCodeVerifier(t *testing.T) {
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	provider := fake.Provider(fixedClock(&now))
+
+	authCodeURL, err := provider.AuthCodeURL("state", "n-0S6_WzA2Mj", "code verifier of the test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := fake.authorize(t, authCodeURL, fake.claims(now))
+	_, err = provider.Exchange(code, "code verifier of someone else")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange() err = %v, want invalid_grant", err)
+	}
+}
+
+func TestOIDCProviderVerifyIDToken(t *testing.T) {
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	provider := fake.Provider(fixedClock(&now))
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[alg]
+			token, err := provider.VerifyIDToken(fake.sign(t, alg, kid, fake.claims(now)), "n-0S6_WzA2Mj")
+			if err != nil {
+				t.Fatalf("VerifyIDToken() err = %v", err)
+			}
+			if token.Subject != "248289761001" {
+				t.Errorf("Subject = %q, want %q", token.Subject, "248289761001")
+			}
+		})
+	}
+	t.Run("without key id", func(t *testing.T) {
+		_, err := provider.VerifyIDToken(fake.sign(t, "ES256", "", fake.claims(now)), "n-0S6_WzA2Mj")
+		if err != nil {
+			t.Fatalf("VerifyIDToken() err = %v", err)
+		}
+	})
+	t.Run("audience list", func(t *testing.T) {
+		claims := fake.claims(now)
+		claims["aud"] = []string{fake.ClientID, "someone else"}
+		claims["azp"] = fake.ClientID
+		_, err := provider.VerifyIDToken(fake.sign(t, "RS256", "rsa", claims), "n-0S6_WzA2Mj")
+		if err != nil {
+			t.Fatalf("VerifyIDToken() err = %v", err)
+		}
+	})
+	t.Run("email verified as a string", func(t *testing.T) {
+		claims := fake.claims(now)
+		claims["email_verified"] = "true"
+		token, err := provider.VerifyIDToken(fake.sign(t, "RS256", "rsa", claims), "n-0S6_WzA2Mj")
+		if err != nil {
+			t.Fatalf("VerifyIDToken() err = %v", err)
+		}
+		if !token.EmailVerified {
+			t.Errorf("EmailVerified = false, want true")
+		}
+	})
+}
+
+func TestOIDCProviderVerifyIDTokenInvalid(t *testing.T) {
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	provider := fake.Provider(fixedClock(&now))
+
+	// signed returns a token with the claims changed by change.
+	signed := func(change func(claims map[string]any)) string {
+		claims := fake.claims(now)
+		change(claims)
+		return fake.sign(t, "RS256", "rsa", claims)
+	}
+	tests := map[string]string{
+		"malformed": "not a token",
+		"bad signature": func() string {
+			token := fake.sign(t, "RS256", "rsa", fake.claims(now))
+			parts := strings.Split(token, ".")
+			claims := fake.claims(now)
+			claims["sub"] = "someone else"
+			claimsJSON, _ := json.Marshal(claims)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(claimsJSON) + "." + parts[2]
+		}(),
+		"alg none":          fake.sign(t, "none", "", fake.claims(now)),
+		"alg none with kid": fake.sign(t, "none", "rsa", fake.claims(now)),
+		"alg of other key": func() string {
+			token := fake.sign(t, "ES256", "ec", fake.claims(now))
+			parts := strings.Split(token, ".")
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"ec"}`))
+			return header + "." + parts[1] + "." + parts[2]
+		}(),
+		"unknown key id": fake.sign(t, "RS256", "rotated", fake.claims(now)),
+		"wrong issuer": signed(func(claims map[string]any) {
+			claims["iss"] = "https://accounts.example.com"
+		}),
+		"wrong audience": signed(func(claims map[string]any) {
+			claims["aud"] = "someone else"
+		}),
+		"audience list without authorized party": signed(func(claims map[string]any) {
+			claims["aud"] = []string{fake.ClientID, "someone else"}
+		}),
+		"expired": signed(func(claims map[string]any) {
+			claims["exp"] = now.Add(-oidcClockSkew - time.Second).Unix()
+		}),
+		"issued in the future": signed(func(claims map[string]any) {
+			claims["iat"] = now.Add(oidcClockSkew + time.Minute).Unix()
+		}),
+		"nonce mismatch": signed(func(claims map[string]any) {
+			claims["nonce"] = "another nonce"
+		}),
+		"no nonce": signed(func(claims map[string]any) {
+			delete(claims, "nonce")
+		}),
+		"no subject": signed(func(claims map[string]any) {
+			delete(claims, "sub")
+		}),
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(token, "n-0S6_WzA2Mj")
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("VerifyIDToken() err = %v, want %v", err, ErrInvalidIDToken)
+			}
+		})
+	}
+}
+
+// TestOIDCProviderExpiryClockSkew checks tokens are accepted for a little
+// while after they expire, in case the clocks are apart.
+func TestOIDCProviderExpiryClockSkew(t *testing.T) {
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	provider := fake.Provider(fixedClock(&now))
+	claims := fake.claims(now)
+	claims["exp"] = now.Add(-oidcClockSkew + time.Second).Unix()
+	_, err := provider.VerifyIDToken(fake.sign(t, "RS256", "rsa", claims), "n-0S6_WzA2Mj")
+	if err != nil {
+		t.Errorf("VerifyIDToken() err = %v", err)
+	}
+}
+
+func TestOIDCServiceFinish(t *testing.T) {
+	db := testDB(t)
+	fake := newFakeOIDC(t)
+	now := time.Now()
+	oc := &OIDCService{
+		DB:        db,
+		Providers: map[string]*OIDCProvider{"fake": fake.Provider(fixedClock(&now))},
+		Now:       fixedClock(&now),
+	}
+	verified := testUser(t, db)
+	_, err := db.Exec(`UPDATE users SET verified_at = $2 WHERE id = $1`, verified.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified := testUser(t, db)
+
+	// finish signs in at the fake with the claims and comes back.
+	finish := func(claims map[string]any) (*User, error) {
+		t.Helper()
+		login, err := oc.Begin("fake")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := fake.authorize(t, login.URL, claims)
+		return oc.Finish("fake", login.State, code)
+	}
+	claims := func(subject, email string, emailVerified any) map[string]any {
+		claims := fake.claims(now)
+		delete(claims, "nonce")
+		claims["sub"] = subject
+		claims["email"] = strings.ToUpper(email)
+		claims["email_verified"] = emailVerified
+		return claims
+	}
+
+	t.Run("email not verified by the provider", func(t *testing.T) {
+		for _, emailVerified := range []any{false, "false", nil} {
+			_, err := finish(claims("unverified-"+verified.Email, verified.Email, emailVerified))
+			if !errors.Is(err, ErrOIDCEmailUnverified) {
+				t.Errorf("Finish() with email_verified %v err = %v, want %v", emailVerified, err, ErrOIDCEmailUnverified)
+			}
+		}
+	})
+	t.Run("account not verified", func(t *testing.T) {
+		_, err := finish(claims("subject-"+unverified.Email, unverified.Email, true))
+		if !errors.Is(err, ErrOIDCAccountUnverified) {
+			t.Errorf("Finish() err = %v, want %v", err, ErrOIDCAccountUnverified)
+		}
+	})
+	t.Run("no account", func(t *testing.T) {
+		_, err := finish(claims("subject-nobody", "nobody-"+verified.Email, true))
+		if !errors.Is(err, ErrOIDCNoAccount) {
+			t.Errorf("Finish() err = %v, want %v", err, ErrOIDCNoAccount)
+		}
+	})
+	t.Run("linked", func(t *testing.T) {
+		subject := "subject-" + verified.Email
+		user, err := finish(claims(subject, verified.Email, true))
+		if err != nil {
+			t.Fatalf("Finish() err = %v", err)
+		}
+		if user.ID != verified.ID {
+			t.Errorf("Finish() user = %d, want %d", user.ID, verified.ID)
+		}
+		// Once linked, the identity signs in whatever its email address.
+		user, err = finish(claims(subject, "changed-"+verified.Email, false))
+		if err != nil {
+			t.Fatalf("Finish() linked err = %v", err)
+		}
+		if user.ID != verified.ID {
+			t.Errorf("Finish() linked user = %d, want %d", user.ID, verified.ID)
+		}
+	})
+	t.Run("nonce mismatch", func(t *testing.T) {
+		c := claims("subject-"+verified.Email, verified.Email, true)
+		c["nonce"] = "another nonce"
+		_, err := finish(c)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("Finish() err = %v, want %v", err, ErrInvalidIDToken)
+		}
+	})
+	t.Run("state used twice", func(t *testing.T) {
+		login, err := oc.Begin("fake")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := fake.authorize(t, login.URL, claims("subject-"+verified.Email, verified.Email, true))
+		_, err = oc.Finish("fake", login.State, code)
+		if err != nil {
+			t.Fatalf("Finish() err = %v", err)
+		}
+		_, err = oc.Finish("fake", login.State, code)
+		if !errors.Is(err, ErrChallengeExpired) {
+			t.Errorf("Finish() twice err = %v, want %v", err, ErrChallengeExpired)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		login, err := oc.Begin("fake")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := fake.authorize(t, login.URL, claims("subject-"+verified.Email, verified.Email, true))
+		later := now.Add(DefaultOIDCLoginDuration)
+		oc.Now = fixedClock(&later)
+		defer func() { oc.Now = fixedClock(&now) }()
+		_, err = oc.Finish("fake", login.State, code)
+		if !errors.Is(err, ErrChallengeExpired) {
+			t.Errorf("Finish() err = %v, want %v", err, ErrChallengeExpired)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package models
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// Page selects part of a list. Number starts at 1.
+type Page struct {
+	Number int
+	Size   int
+}
+
+// NewPage returns the page with the given number and size, replacing values
+// that are out of range with the defaults.
+func NewPage(number, size int) Page {
+	if number < 1 {
+		number = 1
+	}
+	if size < 1 {
+		size = DefaultPageSize
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	return Page{Number: number, Size: size}
+}
+
+func (p Page) Limit() int {
+	return p.Size
+}
+
+func (p Page) Offset() int {
+	return (p.Number - 1) * p.Size
+}
+
+// Pages returns how many pages are needed to list total items.
+func (p Page) Pages(total int) int {
+	if p.Size < 1 {
+		return 0
+	}
+	return (total + p.Size - 1) / p.Size
+}
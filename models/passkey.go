@@ -0,0 +1,738 @@
+package models
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+const (
+	// DefaultPasskeyTimeout is how long a passkey registration or sign in may
+	// take, from asking for the options to sending back the credential.
+	DefaultPasskeyTimeout   = 5 * time.Minute
+	DefaultRelyingPartyName = "Lenslocked"
+
+	// The COSE identifiers of the signature algorithms passkeys may use.
+	COSEAlgorithmES256 = -7
+	COSEAlgorithmRS256 = -257
+
+	passkeyChallengeBytes = 32
+	maxCredentialIDBytes  = 1023
+	minRSAKeyBits         = 2048
+)
+
+// The flags of the authenticator data.
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+	authFlagExtensions   = 0x80
+)
+
+// Passkey is a WebAuthn public key credential a user signs in with. The
+// private key never leaves the authenticator, only signatures of the
+// challenges are sent to the server.
+type Passkey struct {
+	ID           int    `db:"id"`
+	UserID       int    `db:"user_id"`
+	Name         string `db:"name"`
+	CredentialID []byte `db:"credential_id"`
+	// PublicKey is the COSE_Key the authenticator returned when the passkey
+	// was registered.
+	PublicKey []byte `db:"public_key"`
+	Algorithm int    `db:"algorithm"`
+	// SignCount is the signature counter of the authenticator. It only ever
+	// goes up, unless the authenticator doesn't keep one and leaves it at 0.
+	SignCount  int64        `db:"sign_count"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+}
+
+// passkeyChallenge is a registration, when it has a UserID, or a sign in
+// that was started and not finished yet.
+type passkeyChallenge struct {
+	ID        int           `db:"id"`
+	UserID    sql.NullInt64 `db:"user_id"`
+	Challenge []byte        `db:"challenge"`
+	ExpiresAt time.Time     `db:"expires_at"`
+}
+
+// PasskeyRegistration is a registration that was started. The Options are
+// passed to navigator.credentials.create in the browser, and the Token is
+// needed to finish the registration.
+type PasskeyRegistration struct {
+	Token   string
+	Options PasskeyCreationOptions
+}
+
+// PasskeySignIn is a sign in that was started. The Options are passed to
+// navigator.credentials.get in the browser, and the Token is needed to
+// finish the sign in.
+type PasskeySignIn struct {
+	Token   string
+	Options PasskeyRequestOptions
+}
+
+// PasskeyCreationOptions are the JSON form of
+// PublicKeyCredentialCreationOptions. Binary values are base64url encoded.
+type PasskeyCreationOptions struct {
+	Challenge              string              `json:"challenge"`
+	RP                     passkeyRP           `json:"rp"`
+	User                   passkeyUser         `json:"user"`
+	PubKeyCredParams       []passkeyParameters `json:"pubKeyCredParams"`
+	Timeout                int64               `json:"timeout"`
+	ExcludeCredentials     []passkeyDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection passkeySelection    `json:"authenticatorSelection"`
+	Attestation            string              `json:"attestation"`
+}
+
+// PasskeyRequestOptions are the JSON form of
+// PublicKeyCredentialRequestOptions. Binary values are base64url encoded.
+type PasskeyRequestOptions struct {
+	Challenge        string              `json:"challenge"`
+	Timeout          int64               `json:"timeout"`
+	RPID             string              `json:"rpId"`
+	AllowCredentials []passkeyDescriptor `json:"allowCredentials"`
+	UserVerification string              `json:"userVerification"`
+}
+
+type passkeyRP struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type passkeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type passkeyParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type passkeyDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type passkeySelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// PasskeyAttestation is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.create. Binary values are base64url encoded.
+type PasskeyAttestation struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// PasskeyAssertion is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.get. Binary values are base64url encoded.
+type PasskeyAssertion struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+//go:embed passkey.sql
+var passkeyQueriesFile string
+
+var passkeyQueries map[string]string
+
+func init() {
+	passkeyQueries = sqlf.Load(passkeyQueriesFile)
+}
+
+// PasskeyService runs the WebAuthn registration and authentication
+// ceremonies. Attestation statements are not verified ("none" attestation),
+// so any authenticator can be used. User verification, with a PIN or
+// biometrics, is required, which makes a passkey enough to sign in without
+// a second factor.
+type PasskeyService struct {
+	DB *sqlx.DB
+	// Origin is the scheme, host and port of the site, e.g.
+	// "https://www.lenslocked.com". Ceremonies run on any other origin fail.
+	Origin string
+	// RPID is the domain passkeys are scoped to, e.g. "lenslocked.com". It
+	// defaults to the host of Origin.
+	RPID string
+	// RPName is shown by authenticators. It defaults to
+	// DefaultRelyingPartyName.
+	RPName        string
+	BytesPerToken int
+	// Timeout defaults to DefaultPasskeyTimeout.
+	Timeout time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// ByUser returns the passkeys of the user, oldest first.
+func (ps *PasskeyService) ByUser(userID int) ([]Passkey, error) {
+	var passkeys []Passkey
+	err := ps.DB.Select(&passkeys, passkeyQueries["by_user"], userID)
+	if err != nil {
+		return nil, fmt.Errorf("query passkeys by user: %w", err)
+	}
+	return passkeys, nil
+}
+
+// Delete removes a passkey of the user. Passkeys of other users are left
+// alone.
+func (ps *PasskeyService) Delete(userID, id int) error {
+	_, err := ps.DB.Exec(passkeyQueries["delete"], id, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	return nil
+}
+
+// BeginRegistration starts adding a passkey to the account of the user.
+// Authenticators are asked for a discoverable credential, so that it can be
+// used to sign in without entering the email address.
+func (ps *PasskeyService) BeginRegistration(user *User) (*PasskeyRegistration, error) {
+	passkeys, err := ps.ByUser(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	token, challenge, err := ps.createChallenge(sql.NullInt64{Int64: int64(user.ID), Valid: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	registration := PasskeyRegistration{
+		Token: token,
+		Options: PasskeyCreationOptions{
+			Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+			RP: passkeyRP{
+				ID:   ps.rpID(),
+				Name: ps.rpName(),
+			},
+			User: passkeyUser{
+				ID:          base64.RawURLEncoding.EncodeToString(userHandle(user.ID)),
+				Name:        user.Email,
+				DisplayName: user.Email,
+			},
+			PubKeyCredParams: []passkeyParameters{
+				{Type: "public-key", Alg: COSEAlgorithmES256},
+				{Type: "public-key", Alg: COSEAlgorithmRS256},
+			},
+			Timeout: ps.timeout().Milliseconds(),
+			// Registering the same authenticator twice would only leave the
+			// user with a passkey that can't be told apart from the other.
+			ExcludeCredentials: []passkeyDescriptor{},
+			AuthenticatorSelection: passkeySelection{
+				ResidentKey:        "required",
+				RequireResidentKey: true,
+				UserVerification:   "required",
+			},
+			Attestation: "none",
+		},
+	}
+	for _, passkey := range passkeys {
+		registration.Options.ExcludeCredentials = append(registration.Options.ExcludeCredentials, passkeyDescriptor{
+			Type: "public-key",
+			ID:   base64.RawURLEncoding.EncodeToString(passkey.CredentialID),
+		})
+	}
+	return &registration, nil
+}
+
+// FinishRegistration verifies the credential created for the registration
+// identified by token, and stores it as a passkey of the user.
+func (ps *PasskeyService) FinishRegistration(userID int, token, name string, attestation PasskeyAttestation) (*Passkey, error) {
+	challenge, err := ps.consumeChallenge(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	if !challenge.UserID.Valid || challenge.UserID.Int64 != int64(userID) {
+		return nil, fmt.Errorf("finish passkey registration: %w", ErrChallengeExpired)
+	}
+	passkey, err := ps.verifyAttestation(challenge.Challenge, attestation)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey.UserID = userID
+	passkey.Name = name
+	row := ps.DB.QueryRow(passkeyQueries["create"], passkey.UserID, passkey.Name, passkey.CredentialID,
+		passkey.PublicKey, passkey.Algorithm, passkey.SignCount)
+	err = row.Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return nil, fmt.Errorf("finish passkey registration: %w", ErrPasskeyRegistered)
+		}
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	return passkey, nil
+}
+
+// verifyAttestation checks the credential created for the challenge, and
+// returns the passkey it holds. Only the fields of the credential are set.
+func (ps *PasskeyService) verifyAttestation(challenge []byte, attestation PasskeyAttestation) (*Passkey, error) {
+	if attestation.Type != "public-key" {
+		return nil, fmt.Errorf("%w: type %q", ErrInvalidPasskey, attestation.Type)
+	}
+	clientDataJSON, err := decodeBase64URL(attestation.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidPasskey, err)
+	}
+	err = ps.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	attestationObject, err := decodeBase64URL(attestation.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidPasskey, err)
+	}
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidPasskey, err)
+	}
+	object, _ := value.(map[any]any)
+	format, _ := object["fmt"].(string)
+	authData, _ := object["authData"].([]byte)
+	if format == "" || authData == nil {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidPasskey)
+	}
+	// As the attestation is not verified, whatever statement the authenticator
+	// sent along is ignored.
+	ad, err := ps.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&authFlagAttested == 0 {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidPasskey)
+	}
+	rawID, err := decodeBase64URL(attestation.RawID)
+	if err != nil || !bytes.Equal(rawID, ad.credentialID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidPasskey)
+	}
+	_, algorithm, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Passkey{
+		CredentialID: ad.credentialID,
+		PublicKey:    ad.publicKey,
+		Algorithm:    algorithm,
+		SignCount:    int64(ad.signCount),
+	}, nil
+}
+
+// BeginSignIn starts signing in with a passkey. No credentials are listed in
+// the options, the user picks one of the passkeys their authenticator holds
+// for the site.
+func (ps *PasskeyService) BeginSignIn() (*PasskeySignIn, error) {
+	token, challenge, err := ps.createChallenge(sql.NullInt64{})
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey sign in: %w", err)
+	}
+	signIn := PasskeySignIn{
+		Token: token,
+		Options: PasskeyRequestOptions{
+			Challenge:        base64.RawURLEncoding.EncodeToString(challenge),
+			Timeout:          ps.timeout().Milliseconds(),
+			RPID:             ps.rpID(),
+			AllowCredentials: []passkeyDescriptor{},
+			UserVerification: "required",
+		},
+	}
+	return &signIn, nil
+}
+
+// FinishSignIn verifies the assertion made for the sign in identified by
+// token, and returns the user the passkey belongs to. Assertions that can't
+// be verified are reported as ErrInvalidPasskey.
+func (ps *PasskeyService) FinishSignIn(token string, assertion PasskeyAssertion) (*User, error) {
+	challenge, err := ps.consumeChallenge(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	if challenge.UserID.Valid {
+		return nil, fmt.Errorf("finish passkey sign in: %w", ErrChallengeExpired)
+	}
+	if assertion.Type != "public-key" {
+		return nil, fmt.Errorf("finish passkey sign in: %w: type %q", ErrInvalidPasskey, assertion.Type)
+	}
+	credentialID, err := decodeBase64URL(assertion.RawID)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w: credential id: %v", ErrInvalidPasskey, err)
+	}
+	var passkey Passkey
+	err = ps.DB.Get(&passkey, passkeyQueries["by_credential_id"], credentialID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("finish passkey sign in: %w: unknown credential", ErrInvalidPasskey)
+		}
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	signCount, err := ps.verifyAssertion(challenge.Challenge, &passkey, assertion)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	result, err := ps.DB.Exec(passkeyQueries["use"], passkey.ID, signCount, ps.now(), passkey.SignCount)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	if updated == 0 {
+		// The passkey was used or deleted in the meantime.
+		return nil, fmt.Errorf("finish passkey sign in: %w: passkey changed", ErrInvalidPasskey)
+	}
+
+	var user User
+	err = ps.DB.Get(&user, passkeyQueries["user"], passkey.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey sign in: %w", err)
+	}
+	return &user, nil
+}
+
+// verifyAssertion checks the assertion was made for the challenge with the
+// passkey, and returns the new signature counter of the passkey.
+func (ps *PasskeyService) verifyAssertion(challenge []byte, passkey *Passkey, assertion PasskeyAssertion) (int64, error) {
+	if assertion.Response.UserHandle != "" {
+		handle, err := decodeBase64URL(assertion.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle(passkey.UserID)) {
+			return 0, fmt.Errorf("%w: user handle mismatch", ErrInvalidPasskey)
+		}
+	}
+
+	clientDataJSON, err := decodeBase64URL(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return 0, fmt.Errorf("%w: client data: %v", ErrInvalidPasskey, err)
+	}
+	err = ps.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := decodeBase64URL(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return 0, fmt.Errorf("%w: authenticator data: %v", ErrInvalidPasskey, err)
+	}
+	ad, err := ps.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	signature, err := decodeBase64URL(assertion.Response.Signature)
+	if err != nil {
+		return 0, fmt.Errorf("%w: signature: %v", ErrInvalidPasskey, err)
+	}
+	publicKey, _, err := parseCOSEKey(passkey.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if !verifySignature(publicKey, signed, signature) {
+		return 0, fmt.Errorf("%w: bad signature", ErrInvalidPasskey)
+	}
+
+	// A counter that doesn't go up means the authenticator may have been
+	// cloned. Authenticators without a counter always send 0.
+	signCount := int64(ad.signCount)
+	if (signCount != 0 || passkey.SignCount != 0) && signCount <= passkey.SignCount {
+		return 0, fmt.Errorf("%w: sign count went from %d to %d", ErrInvalidPasskey, passkey.SignCount, signCount)
+	}
+	return signCount, nil
+}
+
+// createChallenge stores a new challenge and returns it with the token that
+// identifies it. Expired challenges are cleaned up on the way.
+func (ps *PasskeyService) createChallenge(userID sql.NullInt64) (string, []byte, error) {
+	now := ps.now()
+	_, err := ps.DB.Exec(passkeyQueries["delete_expired_challenges"], now)
+	if err != nil {
+		return "", nil, fmt.Errorf("create challenge: %w", err)
+	}
+	bytesPerToken := ps.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("create challenge: %w", err)
+	}
+	challenge, err := rand.Bytes(passkeyChallengeBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("create challenge: %w", err)
+	}
+	var id int
+	err = ps.DB.Get(&id, passkeyQueries["create_challenge"], userID, ps.hash(token), challenge, now.Add(ps.timeout()))
+	if err != nil {
+		return "", nil, fmt.Errorf("create challenge: %w", err)
+	}
+	return token, challenge, nil
+}
+
+// consumeChallenge deletes the challenge identified by token and returns it.
+// Every challenge can only be answered once, whether that works or not.
+func (ps *PasskeyService) consumeChallenge(token string) (*passkeyChallenge, error) {
+	var challenge passkeyChallenge
+	err := ps.DB.Get(&challenge, passkeyQueries["consume_challenge"], ps.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrChallengeExpired
+		}
+		return nil, fmt.Errorf("consume challenge: %w", err)
+	}
+	if !ps.now().Before(challenge.ExpiresAt) {
+		return nil, ErrChallengeExpired
+	}
+	return &challenge, nil
+}
+
+// verifyClientData checks the client data the authenticator signed was made
+// for the ceremony, the challenge and this site.
+func (ps *PasskeyService) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalidPasskey, err)
+	}
+	if clientData.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidPasskey, clientData.Type)
+	}
+	got, err := decodeBase64URL(clientData.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidPasskey)
+	}
+	if clientData.Origin != ps.Origin {
+		return fmt.Errorf("%w: origin %q", ErrInvalidPasskey, clientData.Origin)
+	}
+	if clientData.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremony", ErrInvalidPasskey)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// credentialID and publicKey are only set if the authenticator attested
+	// a new credential.
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses authData and checks it was made for the
+// relying party with the user present and verified.
+func (ps *PasskeyService) parseAuthenticatorData(authData []byte) (*authenticatorData, error) {
+	if len(authData) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidPasskey)
+	}
+	ad := authenticatorData{
+		rpIDHash:  authData[:32],
+		flags:     authData[32],
+		signCount: binary.BigEndian.Uint32(authData[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(ps.rpID()))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, rpIDHash[:]) != 1 {
+		return nil, fmt.Errorf("%w: relying party id mismatch", ErrInvalidPasskey)
+	}
+	if ad.flags&authFlagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidPasskey)
+	}
+	if ad.flags&authFlagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidPasskey)
+	}
+	rest := authData[37:]
+	if ad.flags&authFlagAttested != 0 {
+		// The AAGUID of the authenticator, then the length of the credential
+		// ID, the ID, and the public key.
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidPasskey)
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > maxCredentialIDBytes || len(rest) < idLen {
+			return nil, fmt.Errorf("%w: invalid credential id length", ErrInvalidPasskey)
+		}
+		ad.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: public key: %v", ErrInvalidPasskey, err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if ad.flags&authFlagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extensions: %v", ErrInvalidPasskey, err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidPasskey)
+	}
+	return &ad, nil
+}
+
+// parseCOSEKey parses a COSE_Key holding an ES256 or RS256 public key, and
+// returns it with its algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: public key: %v", ErrInvalidPasskey, err)
+	}
+	key, ok := value.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, 0, fmt.Errorf("%w: public key is not a COSE key", ErrInvalidPasskey)
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == COSEAlgorithmES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("%w: invalid ES256 key", ErrInvalidPasskey)
+		}
+		// crypto/ecdh rejects points that are not on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		_, err = ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid ES256 key: %v", ErrInvalidPasskey, err)
+		}
+		publicKey := ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		return &publicKey, COSEAlgorithmES256, nil
+	case kty == 3 && alg == COSEAlgorithmRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, 0, fmt.Errorf("%w: invalid RS256 key", ErrInvalidPasskey)
+		}
+		publicKey := rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if publicKey.N.BitLen() < minRSAKeyBits || publicKey.E < 3 || publicKey.E%2 == 0 {
+			return nil, 0, fmt.Errorf("%w: invalid RS256 key", ErrInvalidPasskey)
+		}
+		return &publicKey, COSEAlgorithmRS256, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported key type %d with algorithm %d", ErrInvalidPasskey, kty, alg)
+	}
+}
+
+// verifySignature reports whether signature is a valid ES256 or RS256
+// signature of data by publicKey.
+func verifySignature(publicKey crypto.PublicKey, data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
+
+// userHandle identifies the user to authenticators. It is returned when
+// signing in with a discoverable credential.
+func userHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// decodeBase64URL decodes base64url, with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (ps *PasskeyService) rpID() string {
+	if ps.RPID != "" {
+		return ps.RPID
+	}
+	origin, err := url.Parse(ps.Origin)
+	if err != nil {
+		return ""
+	}
+	return origin.Hostname()
+}
+
+func (ps *PasskeyService) rpName() string {
+	if ps.RPName == "" {
+		return DefaultRelyingPartyName
+	}
+	return ps.RPName
+}
+
+func (ps *PasskeyService) timeout() time.Duration {
+	if ps.Timeout <= 0 {
+		return DefaultPasskeyTimeout
+	}
+	return ps.Timeout
+}
+
+func (ps *PasskeyService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (ps *PasskeyService) now() time.Time {
+	if ps.Now == nil {
+		return time.Now()
+	}
+	return ps.Now()
+}
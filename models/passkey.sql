@@ -0,0 +1,49 @@
+-- name: create_challenge
+INSERT INTO passkey_challenges (user_id, token_hash, challenge, expires_at)
+VALUES ($1, $2, $3, $4)
+RETURNING id;
+
+-- name: consume_challenge
+DELETE
+FROM passkey_challenges
+WHERE token_hash = $1
+RETURNING id, user_id, challenge, expires_at;
+
+-- name: delete_expired_challenges
+DELETE
+FROM passkey_challenges
+WHERE expires_at <= $1;
+
+-- name: create
+INSERT INTO passkeys (user_id, name, credential_id, public_key, algorithm, sign_count)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at;
+
+-- name: by_user
+SELECT id, user_id, name, credential_id, public_key, algorithm, sign_count, created_at, last_used_at
+FROM passkeys
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: by_credential_id
+SELECT id, user_id, name, credential_id, public_key, algorithm, sign_count, created_at, last_used_at
+FROM passkeys
+WHERE credential_id = $1;
+
+-- name: use
+UPDATE passkeys
+SET sign_count   = $2,
+    last_used_at = $3
+WHERE id = $1
+  AND sign_count = $4;
+
+-- name: delete
+DELETE
+FROM passkeys
+WHERE id = $1
+  AND user_id = $2;
+
+-- name: user
+SELECT *
+FROM users
+WHERE id = $1;
@@ -0,0 +1,429 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testPasskeyOrigin = "https://www.lenslocked.com"
+
+// softAuthenticator is an authenticator in software. It creates the same
+// responses a security key or a phone would, so the ceremonies can be tested
+// without a browser.
+type softAuthenticator struct {
+	algorithm    int
+	key          crypto.Signer
+	rpID         string
+	credentialID []byte
+	signCount    uint32
+	// flags are set in the authenticator data. They default to user present
+	// and user verified.
+	flags byte
+}
+
+func newSoftAuthenticator(t *testing.T, algorithm int, rpID string) *softAuthenticator {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case COSEAlgorithmES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case COSEAlgorithmRS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		t.Fatalf("unsupported algorithm %d", algorithm)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{
+		algorithm:    algorithm,
+		key:          key,
+		rpID:         rpID,
+		credentialID: credentialID,
+		flags:        authFlagUserPresent | authFlagUserVerified,
+	}
+}
+
+func (a *softAuthenticator) coseKeyMap() cborMap {
+	switch key := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return cborMap{
+			{1, 2},
+			{3, COSEAlgorithmES256},
+			{-1, 1},
+			{-2, key.X.FillBytes(make([]byte, 32))},
+			{-3, key.Y.FillBytes(make([]byte, 32))},
+		}
+	case *rsa.PublicKey:
+		return cborMap{
+			{1, 3},
+			{3, COSEAlgorithmRS256},
+			{-1, key.N.Bytes()},
+			{-2, big.NewInt(int64(key.E)).Bytes()},
+		}
+	default:
+		panic(fmt.Sprintf("unsupported key %T", key))
+	}
+}
+
+// coseKey returns the public key as a COSE_Key.
+func (a *softAuthenticator) coseKey() []byte {
+	return encodeCBOR(a.coseKeyMap())
+}
+
+// authenticatorData returns the authenticator data for the relying party,
+// with the attested credential data if attested is set.
+func (a *softAuthenticator) authenticatorData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= authFlagAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(t *testing.T, ceremony string, challenge []byte, origin string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create with a new credential for the
+// challenge, like a browser at origin would.
+func (a *softAuthenticator) create(t *testing.T, challenge []byte, origin string) PasskeyAttestation {
+	t.Helper()
+	attestationObject := encodeCBOR(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", a.authenticatorData(true)},
+	})
+	var attestation PasskeyAttestation
+	attestation.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	attestation.RawID = attestation.ID
+	attestation.Type = "public-key"
+	attestation.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON(t, "webauthn.create", challenge, origin))
+	attestation.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestationObject)
+	return attestation
+}
+
+// get answers navigator.credentials.get for the challenge, like a browser at
+// origin would. The sign count goes up by one first.
+func (a *softAuthenticator) get(t *testing.T, challenge []byte, origin string, userID int) PasskeyAssertion {
+	t.Helper()
+	a.signCount++
+	authData := a.authenticatorData(false)
+	clientData := clientDataJSON(t, "webauthn.get", challenge, origin)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := a.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assertion PasskeyAssertion
+	assertion.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	assertion.RawID = assertion.ID
+	assertion.Type = "public-key"
+	assertion.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	assertion.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	assertion.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	assertion.Response.UserHandle = base64.RawURLEncoding.EncodeToString(userHandle(userID))
+	return assertion
+}
+
+var passkeyAlgorithms = map[string]int{
+	"ES256": COSEAlgorithmES256,
+	"RS256": COSEAlgorithmRS256,
+}
+
+func TestPasskeyVerify(t *testing.T) {
+	ps := &PasskeyService{Origin: testPasskeyOrigin}
+	challenge := []byte("a challenge of 32 bytes for test")
+	for name, algorithm := range passkeyAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, algorithm, "www.lenslocked.com")
+			passkey, err := ps.verifyAttestation(challenge, authenticator.create(t, challenge, testPasskeyOrigin))
+			if err != nil {
+				t.Fatalf("verifyAttestation() err = %v", err)
+			}
+			if passkey.Algorithm != algorithm {
+				t.Errorf("Algorithm = %d, want %d", passkey.Algorithm, algorithm)
+			}
+			if string(passkey.CredentialID) != string(authenticator.credentialID) {
+				t.Errorf("CredentialID = %x, want %x", passkey.CredentialID, authenticator.credentialID)
+			}
+			passkey.UserID = 7
+
+			for i := 1; i <= 2; i++ {
+				signCount, err := ps.verifyAssertion(challenge, passkey, authenticator.get(t, challenge, testPasskeyOrigin, 7))
+				if err != nil {
+					t.Fatalf("verifyAssertion() err = %v", err)
+				}
+				if signCount != int64(i) {
+					t.Errorf("verifyAssertion() = %d, want %d", signCount, i)
+				}
+				passkey.SignCount = signCount
+			}
+		})
+	}
+}
+
+func TestPasskeyVerifyAttestationInvalid(t *testing.T) {
+	ps := &PasskeyService{Origin: testPasskeyOrigin}
+	challenge := []byte("a challenge of 32 bytes for test")
+	tests := map[string]func(a *softAuthenticator) PasskeyAttestation{
+		"wrong origin": func(a *softAuthenticator) PasskeyAttestation {
+			return a.create(t, challenge, "https://lenslocked.example.com")
+		},
+		"wrong challenge": func(a *softAuthenticator) PasskeyAttestation {
+			return a.create(t, []byte("another challenge"), testPasskeyOrigin)
+		},
+		"wrong ceremony": func(a *softAuthenticator) PasskeyAttestation {
+			attestation := a.create(t, challenge, testPasskeyOrigin)
+			attestation.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON(t, "webauthn.get", challenge, testPasskeyOrigin))
+			return attestation
+		},
+		"wrong rp id hash": func(a *softAuthenticator) PasskeyAttestation {
+			a.rpID = "lenslocked.example.com"
+			return a.create(t, challenge, testPasskeyOrigin)
+		},
+		"user not verified": func(a *softAuthenticator) PasskeyAttestation {
+			a.flags = authFlagUserPresent
+			return a.create(t, challenge, testPasskeyOrigin)
+		},
+		"user not present": func(a *softAuthenticator) PasskeyAttestation {
+			a.flags = authFlagUserVerified
+			return a.create(t, challenge, testPasskeyOrigin)
+		},
+		"other credential id": func(a *softAuthenticator) PasskeyAttestation {
+			attestation := a.create(t, challenge, testPasskeyOrigin)
+			attestation.RawID = base64.RawURLEncoding.EncodeToString([]byte("another credential"))
+			return attestation
+		},
+		"no attested credential": func(a *softAuthenticator) PasskeyAttestation {
+			attestation := a.create(t, challenge, testPasskeyOrigin)
+			attestation.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR(cborMap{
+				{"fmt", "none"},
+				{"attStmt", cborMap{}},
+				{"authData", a.authenticatorData(false)},
+			}))
+			return attestation
+		},
+		"trailing authenticator data": func(a *softAuthenticator) PasskeyAttestation {
+			attestation := a.create(t, challenge, testPasskeyOrigin)
+			attestation.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR(cborMap{
+				{"fmt", "none"},
+				{"attStmt", cborMap{}},
+				{"authData", append(a.authenticatorData(true), 0)},
+			}))
+			return attestation
+		},
+		"malformed attestation object": func(a *softAuthenticator) PasskeyAttestation {
+			attestation := a.create(t, challenge, testPasskeyOrigin)
+			attestation.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR(cborMap{{"fmt", "none"}}))
+			return attestation
+		},
+	}
+	for name, attest := range tests {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, COSEAlgorithmES256, "www.lenslocked.com")
+			_, err := ps.verifyAttestation(challenge, attest(authenticator))
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("verifyAttestation() err = %v, want %v", err, ErrInvalidPasskey)
+			}
+		})
+	}
+}
+
+func TestPasskeyVerifyAssertionInvalid(t *testing.T) {
+	ps := &PasskeyService{Origin: testPasskeyOrigin}
+	challenge := []byte("a challenge of 32 bytes for test")
+	tests := map[string]func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion{
+		"wrong origin": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			return a.get(t, challenge, "https://lenslocked.example.com", passkey.UserID)
+		},
+		"wrong challenge": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			return a.get(t, []byte("another challenge"), testPasskeyOrigin, passkey.UserID)
+		},
+		"wrong rp id hash": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			a.rpID = "lenslocked.example.com"
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+		"user not verified": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			a.flags = authFlagUserPresent
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+		"other user": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID+1)
+		},
+		"bad signature": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			assertion := a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+			signature, _ := decodeBase64URL(assertion.Response.Signature)
+			signature[len(signature)-1] ^= 1
+			assertion.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+			return assertion
+		},
+		"signed by another key": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			other := newSoftAuthenticator(t, COSEAlgorithmES256, a.rpID)
+			other.credentialID = a.credentialID
+			return other.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+		"sign count went back": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			passkey.SignCount = 10
+			a.signCount = 8
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+		"sign count stayed the same": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			passkey.SignCount = 10
+			a.signCount = 9
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+		"sign count dropped to zero": func(a *softAuthenticator, passkey *Passkey) PasskeyAssertion {
+			passkey.SignCount = 10
+			// get counts up before signing, so this wraps around to 0.
+			a.signCount = ^uint32(0)
+			return a.get(t, challenge, testPasskeyOrigin, passkey.UserID)
+		},
+	}
+	for name, assert := range tests {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, COSEAlgorithmES256, "www.lenslocked.com")
+			passkey := Passkey{
+				UserID:       7,
+				CredentialID: authenticator.credentialID,
+				PublicKey:    authenticator.coseKey(),
+				Algorithm:    COSEAlgorithmES256,
+			}
+			_, err := ps.verifyAssertion(challenge, &passkey, assert(authenticator, &passkey))
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("verifyAssertion() err = %v, want %v", err, ErrInvalidPasskey)
+			}
+		})
+	}
+}
+
+// TestPasskeyWithoutSignCount checks authenticators that always send a sign
+// count of 0 can keep signing in.
+func TestPasskeyWithoutSignCount(t *testing.T) {
+	ps := &PasskeyService{Origin: testPasskeyOrigin}
+	challenge := []byte("a challenge of 32 bytes for test")
+	authenticator := newSoftAuthenticator(t, COSEAlgorithmES256, "www.lenslocked.com")
+	passkey := Passkey{UserID: 7, PublicKey: authenticator.coseKey()}
+	for i := 0; i < 2; i++ {
+		// get counts up before signing, so this wraps around to 0.
+		authenticator.signCount = ^uint32(0)
+		signCount, err := ps.verifyAssertion(challenge, &passkey, authenticator.get(t, challenge, testPasskeyOrigin, 7))
+		if err != nil {
+			t.Fatalf("verifyAssertion() err = %v", err)
+		}
+		if signCount != 0 {
+			t.Errorf("verifyAssertion() = %d, want 0", signCount)
+		}
+	}
+}
+
+func TestPasskeyService(t *testing.T) {
+	db := testDB(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ps := &PasskeyService{DB: db, Origin: testPasskeyOrigin, Now: fixedClock(&now)}
+	user := testUser(t, db)
+
+	for name, algorithm := range passkeyAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, algorithm, "www.lenslocked.com")
+			registration, err := ps.BeginRegistration(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge, _ := decodeBase64URL(registration.Options.Challenge)
+			passkey, err := ps.FinishRegistration(user.ID, registration.Token, " Phone ", authenticator.create(t, challenge, testPasskeyOrigin))
+			if err != nil {
+				t.Fatalf("FinishRegistration() err = %v", err)
+			}
+			if passkey.Name != "Phone" || passkey.UserID != user.ID {
+				t.Errorf("FinishRegistration() = %+v", passkey)
+			}
+			_, err = ps.FinishRegistration(user.ID, registration.Token, "Phone", authenticator.create(t, challenge, testPasskeyOrigin))
+			if !errors.Is(err, ErrChallengeExpired) {
+				t.Errorf("FinishRegistration() twice err = %v, want %v", err, ErrChallengeExpired)
+			}
+
+			signIn, err := ps.BeginSignIn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge, _ = decodeBase64URL(signIn.Options.Challenge)
+			got, err := ps.FinishSignIn(signIn.Token, authenticator.get(t, challenge, testPasskeyOrigin, user.ID))
+			if err != nil {
+				t.Fatalf("FinishSignIn() err = %v", err)
+			}
+			if got.ID != user.ID {
+				t.Errorf("FinishSignIn() user = %d, want %d", got.ID, user.ID)
+			}
+
+			// A clone of the authenticator still has the old sign count.
+			signIn, err = ps.BeginSignIn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge, _ = decodeBase64URL(signIn.Options.Challenge)
+			authenticator.signCount--
+			_, err = ps.FinishSignIn(signIn.Token, authenticator.get(t, challenge, testPasskeyOrigin, user.ID))
+			if !errors.Is(err, ErrInvalidPasskey) {
+				t.Errorf("FinishSignIn() with old sign count err = %v, want %v", err, ErrInvalidPasskey)
+			}
+		})
+	}
+}
+
+func TestPasskeyServiceChallengeExpires(t *testing.T) {
+	db := testDB(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ps := &PasskeyService{DB: db, Origin: testPasskeyOrigin, Now: fixedClock(&now)}
+	user := testUser(t, db)
+	authenticator := newSoftAuthenticator(t, COSEAlgorithmES256, "www.lenslocked.com")
+
+	registration, err := ps.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _ := decodeBase64URL(registration.Options.Challenge)
+	now = now.Add(ps.timeout() + time.Second)
+	_, err = ps.FinishRegistration(user.ID, registration.Token, "Phone", authenticator.create(t, challenge, testPasskeyOrigin))
+	if !errors.Is(err, ErrChallengeExpired) {
+		t.Errorf("FinishRegistration() err = %v, want %v", err, ErrChallengeExpired)
+	}
+}
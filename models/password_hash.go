@@ -0,0 +1,266 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownPasswordHash is returned for password hashes made by an algorithm
+// the PasswordHasher doesn't know.
+var ErrUnknownPasswordHash = errors.New("models: unknown password hash algorithm")
+
+// PasswordHashAlgorithm is one way of hashing passwords. Hashes are strings
+// in the PHC format, "$<id>$<params>$<salt>$<hash>", which carry everything
+// needed to verify them, so an algorithm can verify hashes made with other
+// parameters than its own.
+type PasswordHashAlgorithm interface {
+	// ID identifies the algorithm in hashes, e.g. "argon2id".
+	ID() string
+	Hash(password string) (string, error)
+	// Verify reports whether password matches hash.
+	Verify(hash, password string) (bool, error)
+	// Current reports whether hash was made with the parameters of the
+	// algorithm.
+	Current(hash string) bool
+}
+
+// PasswordHasher hashes new passwords with its Preferred algorithm, and
+// verifies hashes made by any algorithm it knows. Hashes made by another
+// algorithm, or with weaker parameters, are reported so they can be replaced
+// while the password is at hand.
+type PasswordHasher struct {
+	// Preferred defaults to Argon2id with the default parameters.
+	Preferred PasswordHashAlgorithm
+}
+
+type PasswordHashConfig struct {
+	// Algorithm is either "argon2id" (the default) or "bcrypt".
+	Algorithm string
+	Bcrypt    Bcrypt
+	Argon2id  Argon2id
+}
+
+// NewPasswordHasher returns a PasswordHasher preferring config.Algorithm.
+func NewPasswordHasher(config PasswordHashConfig) (PasswordHasher, error) {
+	switch config.Algorithm {
+	case "", "argon2id":
+		return PasswordHasher{Preferred: config.Argon2id}, nil
+	case "bcrypt":
+		if config.Bcrypt.Cost != 0 && (config.Bcrypt.Cost < bcrypt.MinCost || config.Bcrypt.Cost > bcrypt.MaxCost) {
+			return PasswordHasher{}, fmt.Errorf("new password hasher: invalid bcrypt cost %d", config.Bcrypt.Cost)
+		}
+		return PasswordHasher{Preferred: config.Bcrypt}, nil
+	default:
+		return PasswordHasher{}, fmt.Errorf("new password hasher: unknown algorithm %q", config.Algorithm)
+	}
+}
+
+func (ph PasswordHasher) Hash(password string) (string, error) {
+	hash, err := ph.preferred().Hash(password)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return hash, nil
+}
+
+// Verify reports whether password matches hash, and if so, whether the
+// password should be hashed again with the preferred algorithm.
+func (ph PasswordHasher) Verify(hash, password string) (ok, rehash bool, err error) {
+	algorithm, err := ph.algorithm(hash)
+	if err != nil {
+		return false, false, fmt.Errorf("verify password: %w", err)
+	}
+	ok, err = algorithm.Verify(hash, password)
+	if err != nil {
+		return false, false, fmt.Errorf("verify password: %w", err)
+	}
+	if !ok {
+		return false, false, nil
+	}
+	preferred := ph.preferred()
+	rehash = algorithm.ID() != preferred.ID() || !preferred.Current(hash)
+	return true, rehash, nil
+}
+
+// algorithm picks the algorithm that made hash. Parameters are read from the
+// hash, so the algorithms don't need to be configured.
+func (ph PasswordHasher) algorithm(hash string) (PasswordHashAlgorithm, error) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(hash, "$"), "$")
+	switch id {
+	case "2a", "2b", "2y":
+		return Bcrypt{}, nil
+	case "argon2id":
+		return Argon2id{}, nil
+	default:
+		return nil, ErrUnknownPasswordHash
+	}
+}
+
+func (ph PasswordHasher) preferred() PasswordHashAlgorithm {
+	if ph.Preferred == nil {
+		return Argon2id{}
+	}
+	return ph.Preferred
+}
+
+// Bcrypt hashes passwords with bcrypt. Its hashes predate the PHC format but
+// follow the same layout, "$2a$<cost>$<salt and hash>".
+type Bcrypt struct {
+	// Cost defaults to bcrypt.DefaultCost.
+	Cost int
+}
+
+func (b Bcrypt) ID() string {
+	return "2a"
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(hashedBytes), nil
+}
+
+func (b Bcrypt) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b Bcrypt) Current(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost >= b.cost()
+}
+
+func (b Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+// The default Argon2id parameters follow the OWASP recommendation of 19 MiB
+// of memory and 2 passes.
+const (
+	DefaultArgon2idMemory  = 19 * 1024
+	DefaultArgon2idTime    = 2
+	DefaultArgon2idThreads = 1
+	argon2idSaltLen        = 16
+	argon2idKeyLen         = 32
+)
+
+// Argon2id hashes passwords with Argon2id. Hashes look like
+// "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>".
+type Argon2id struct {
+	// Memory is in KiB. It defaults to DefaultArgon2idMemory.
+	Memory uint32
+	// Time is the number of passes. It defaults to DefaultArgon2idTime.
+	Time uint32
+	// Threads defaults to DefaultArgon2idThreads.
+	Threads uint8
+}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (a Argon2id) ID() string {
+	return "argon2id"
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	memory, time, threads := a.params()
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2idKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2id) Verify(hash, password string) (bool, error) {
+	p, err := a.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (a Argon2id) Current(hash string) bool {
+	p, err := a.parse(hash)
+	if err != nil {
+		return false
+	}
+	memory, time, threads := a.params()
+	return p.memory >= memory && p.time >= time && p.threads >= threads
+}
+
+func (a Argon2id) params() (memory, time uint32, threads uint8) {
+	memory, time, threads = a.Memory, a.Time, a.Threads
+	if memory == 0 {
+		memory = DefaultArgon2idMemory
+	}
+	if time == 0 {
+		time = DefaultArgon2idTime
+	}
+	if threads == 0 {
+		threads = DefaultArgon2idThreads
+	}
+	return memory, time, threads
+}
+
+func (a Argon2id) parse(hash string) (*argon2idParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != a.ID() {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var p argon2idParams
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	// argon2.IDKey panics without at least one pass and one thread.
+	if p.time == 0 || p.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id hash: t and p must be at least 1")
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if len(p.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	return &p, nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast. They are never the defaults.
+var (
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+	testArgon2id = Argon2id{Memory: 64, Time: 1, Threads: 1}
+)
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	tests := map[string]PasswordHashAlgorithm{
+		"bcrypt":   testBcrypt,
+		"argon2id": testArgon2id,
+	}
+	for name, algorithm := range tests {
+		t.Run(name, func(t *testing.T) {
+			ph := PasswordHasher{Preferred: algorithm}
+			hash, err := ph.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, "$"+algorithm.ID()+"$") {
+				t.Errorf("Hash() = %q, want a hash starting with $%s$", hash, algorithm.ID())
+			}
+			ok, rehash, err := ph.Verify(hash, "correct horse battery staple")
+			if err != nil || !ok || rehash {
+				t.Errorf("Verify() of the password = %v, %v, %v, want true, false, nil", ok, rehash, err)
+			}
+			ok, rehash, err = ph.Verify(hash, "correct horse battery stapler")
+			if err != nil || ok || rehash {
+				t.Errorf("Verify() of another password = %v, %v, %v, want false, false, nil", ok, rehash, err)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRehash(t *testing.T) {
+	bcryptHash, err := testBcrypt.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2idHash, err := testArgon2id.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		preferred PasswordHashAlgorithm
+		hash      string
+		want      bool
+	}{
+		{"bcrypt hash, argon2id preferred", testArgon2id, bcryptHash, true},
+		{"argon2id hash, bcrypt preferred", testBcrypt, argon2idHash, true},
+		{"same parameters", testArgon2id, argon2idHash, false},
+		{"weaker argon2id memory", Argon2id{Memory: 128, Time: 1, Threads: 1}, argon2idHash, true},
+		{"weaker argon2id time", Argon2id{Memory: 64, Time: 2, Threads: 1}, argon2idHash, true},
+		{"stronger argon2id hash", Argon2id{Memory: 32, Time: 1, Threads: 1}, argon2idHash, false},
+		{"lower bcrypt cost", Bcrypt{Cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"same bcrypt cost", testBcrypt, bcryptHash, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ph := PasswordHasher{Preferred: tt.preferred}
+			ok, rehash, err := ph.Verify(tt.hash, "secret")
+			if err != nil || !ok {
+				t.Fatalf("Verify() = %v, %v, want true, nil", ok, err)
+			}
+			if rehash != tt.want {
+				t.Errorf("Verify() rehash = %v, want %v", rehash, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":              "",
+		"unknown algorithm":  "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5",
+		"truncated bcrypt":   "$2a$04$short",
+		"missing parts":      "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+		"other version":      "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"bad parameters":     "$argon2id$v=19$m=64,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"zero passes":        "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"zero threads":       "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"salt not base64":    "$argon2id$v=19$m=64,t=1,p=1$not base64$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"key not base64":     "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$not base64",
+		"empty argon2id key": "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+	}
+	for name, hash := range tests {
+		t.Run(name, func(t *testing.T) {
+			ok, rehash, err := PasswordHasher{}.Verify(hash, "secret")
+			if err == nil || ok || rehash {
+				t.Errorf("Verify() = %v, %v, %v, want false, false and an error", ok, rehash, err)
+			}
+		})
+	}
+	_, _, err := PasswordHasher{}.Verify("$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5", "secret")
+	if !errors.Is(err, ErrUnknownPasswordHash) {
+		t.Errorf("Verify() of an scrypt hash err = %v, want %v", err, ErrUnknownPasswordHash)
+	}
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMinPasswordLength is the shortest password, in characters, a
+	// user can set.
+	DefaultMinPasswordLength = 8
+	// MaxPasswordBytes is the longest password bcrypt can hash. Anything past
+	// it would silently be ignored.
+	MaxPasswordBytes = 72
+)
+
+// PasswordPolicy decides which passwords users may set. The zero value
+// enforces the default lengths and doesn't check for breached passwords.
+type PasswordPolicy struct {
+	// MinLength defaults to DefaultMinPasswordLength.
+	MinLength int
+	// MaxBytes defaults to, and can't be more than, MaxPasswordBytes.
+	MaxBytes int
+	// Breached is checked for passwords that are known to have leaked. It is
+	// optional.
+	Breached *BreachedPasswords
+}
+
+// Check returns a PasswordError if password breaks the policy for the user
+// with the email address.
+func (pp PasswordPolicy) Check(email, password string) error {
+	if utf8.RuneCountInString(password) < pp.minLength() {
+		return PasswordError{Err: ErrPasswordTooShort, Limit: pp.minLength()}
+	}
+	if len(password) > pp.maxBytes() {
+		return PasswordError{Err: ErrPasswordTooLong, Limit: pp.maxBytes()}
+	}
+	if email != "" {
+		localPart, _, _ := strings.Cut(email, "@")
+		if strings.EqualFold(password, email) || strings.EqualFold(password, localPart) {
+			return PasswordError{Err: ErrPasswordIsEmail}
+		}
+	}
+	if pp.Breached != nil {
+		breached, err := pp.Breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("check password: %w", err)
+		}
+		if breached {
+			return PasswordError{Err: ErrPasswordBreached}
+		}
+	}
+	return nil
+}
+
+func (pp PasswordPolicy) minLength() int {
+	if pp.MinLength <= 0 {
+		return DefaultMinPasswordLength
+	}
+	return pp.MinLength
+}
+
+func (pp PasswordPolicy) maxBytes() int {
+	if pp.MaxBytes <= 0 || pp.MaxBytes > MaxPasswordBytes {
+		return MaxPasswordBytes
+	}
+	return pp.MaxBytes
+}
+
+// BreachedPasswords looks passwords up in a local copy of a breached password
+// list, such as Pwned Passwords. The list is split by the first 5 hex digits
+// of the SHA-1 hash of the passwords, the way the k-anonymity range API
+// serves it: Dir holds one file per prefix, named after it (e.g. "5BAA6" or
+// "5BAA6.txt"), with a "SUFFIX:COUNT" line per password. Only the file of the
+// prefix being checked is ever read.
+type BreachedPasswords struct {
+	Dir string
+}
+
+// LoadBreachedPasswords makes sure dir can be used as a BreachedPasswords
+// list.
+func LoadBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("load breached passwords: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("load breached passwords: %s is not a directory", dir)
+	}
+	return &BreachedPasswords{Dir: dir}, nil
+}
+
+// Contains reports whether password is in the list.
+func (bp *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	var f *os.File
+	var err error
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		f, err = os.Open(filepath.Join(bp.Dir, name))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// No password in the list has this prefix.
+			return false, nil
+		}
+		return false, fmt.Errorf("breached passwords: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Lists padded against traffic analysis have entries with a count of
+		// zero, which are not real passwords.
+		if strings.EqualFold(lineSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return false, fmt.Errorf("breached passwords: %w", err)
+	}
+	return false, nil
+}
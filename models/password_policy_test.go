@@ -0,0 +1,122 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyLength(t *testing.T) {
+	// "é" is 2 bytes and "😀" is 4 bytes in UTF-8.
+	tests := []struct {
+		name      string
+		policy    PasswordPolicy
+		password  string
+		wantErr   error
+		wantLimit int
+	}{
+		{"default minimum", PasswordPolicy{}, "abcdefgh", nil, 0},
+		{"shorter than the default", PasswordPolicy{}, "abcdefg", ErrPasswordTooShort, DefaultMinPasswordLength},
+		{"characters, not bytes", PasswordPolicy{}, strings.Repeat("é", 7), ErrPasswordTooShort, DefaultMinPasswordLength},
+		{"multibyte minimum", PasswordPolicy{}, strings.Repeat("é", 8), nil, 0},
+		{"configured minimum", PasswordPolicy{MinLength: 12}, "abcdefghijk", ErrPasswordTooShort, 12},
+		{"72 bytes", PasswordPolicy{}, strings.Repeat("a", MaxPasswordBytes), nil, 0},
+		{"73 bytes", PasswordPolicy{}, strings.Repeat("a", MaxPasswordBytes+1), ErrPasswordTooLong, MaxPasswordBytes},
+		{"72 bytes of multibyte characters", PasswordPolicy{}, strings.Repeat("😀", 18), nil, 0},
+		{"19 characters over 72 bytes", PasswordPolicy{}, strings.Repeat("😀", 19), ErrPasswordTooLong, MaxPasswordBytes},
+		{"36 characters over 72 bytes", PasswordPolicy{}, strings.Repeat("é", 36) + "a", ErrPasswordTooLong, MaxPasswordBytes},
+		{"configured maximum", PasswordPolicy{MaxBytes: 16}, strings.Repeat("a", 17), ErrPasswordTooLong, 16},
+		{"maximum capped at bcrypt's", PasswordPolicy{MaxBytes: 100}, strings.Repeat("a", 73), ErrPasswordTooLong, MaxPasswordBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check("", tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Check() err = %v, want %v", err, tt.wantErr)
+			}
+			var pwErr PasswordError
+			if errors.As(err, &pwErr) && pwErr.Limit != tt.wantLimit {
+				t.Errorf("Check() limit = %d, want %d", pwErr.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"email address", "jon.calhoun@example.com", "jon.calhoun@example.com", ErrPasswordIsEmail},
+		{"email address in other case", "jon.calhoun@example.com", "Jon.Calhoun@Example.com", ErrPasswordIsEmail},
+		{"local part", "jon.calhoun@example.com", "jon.calhoun", ErrPasswordIsEmail},
+		{"local part in other case", "jon.calhoun@example.com", "JON.CALHOUN", ErrPasswordIsEmail},
+		{"contains the local part", "jon.calhoun@example.com", "jon.calhoun1", nil},
+		{"domain", "someone@lenslocked.com", "lenslocked.com", nil},
+		{"no email address", "", "jon.calhoun", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := PasswordPolicy{}.Check(tt.email, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Check() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	// The SHA-1 hashes of "password", "Password" and "letmein123" are
+	// 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8,
+	// 8BE3C943B1609FFFBFC51AAD666D0A04ADF83C9D and
+	// E286977B13F1A89E20D0459207545D15FE1EBA08.
+	dir := t.TempDir()
+	files := map[string]string{
+		"5BAA6": "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n",
+		// Some lists use lower case hex digits.
+		"8BE3C.txt": "943b1609fffbfc51aad666d0a04adf83c9d:112\n",
+		// Padding entries have a count of zero.
+		"E2869": "77B13F1A89E20D0459207545D15FE1EBA08:0\n",
+	}
+	for name, contents := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bp, err := LoadBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"letmein123", false},
+		// No file for the prefix.
+		{"correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got, err := bp.Contains(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	err = PasswordPolicy{Breached: bp}.Check("", "password")
+	if !errors.Is(err, ErrPasswordBreached) {
+		t.Errorf("Check() of a breached password err = %v, want %v", err, ErrPasswordBreached)
+	}
+}
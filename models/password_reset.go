@@ -83,7 +83,28 @@ func (p *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	return &pwReset, nil
 }
 
+// User returns the user the token was issued to, without using the token up.
+func (p *PasswordResetService) User(token string) (*User, error) {
+	user, _, err := p.lookup(token)
+	if err != nil {
+		return nil, fmt.Errorf("user by reset token: %w", err)
+	}
+	return user, nil
+}
+
 func (p *PasswordResetService) Consume(token string) (*User, error) {
+	user, pwReset, err := p.lookup(token)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	err = p.delete(pwReset.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	return user, nil
+}
+
+func (p *PasswordResetService) lookup(token string) (*User, *PasswordReset, error) {
 	tokenHash := p.hash(token)
 	var dao struct {
 		User    User          `db:"user"`
@@ -92,20 +113,13 @@ func (p *PasswordResetService) Consume(token string) (*User, error) {
 	// TODO: use this as example on retrieval of multiple items from single query
 	err := p.DB.Get(&dao, passwordResetQueries["consume"], tokenHash)
 	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
+		return nil, nil, err
 	}
 
 	if time.Now().After(dao.PwReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", token)
+		return nil, nil, fmt.Errorf("token expired: %v", token)
 	}
-	err = p.delete(dao.PwReset.ID)
-	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
-	}
-
-	out := dao.User
-
-	return &out, nil
+	return &dao.User, &dao.PwReset, nil
 }
 
 func (p *PasswordResetService) delete(id int) error {
@@ -0,0 +1,129 @@
+package models
+
+// Role decides what a user is allowed to do besides managing their own
+// account and galleries.
+type Role string
+
+const (
+	// RoleUser is what everyone signs up as.
+	RoleUser Role = "user"
+	// RoleModerator users can see every gallery and take galleries down.
+	RoleModerator Role = "moderator"
+	// RoleAdmin users can moderate galleries and manage users.
+	RoleAdmin Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// Permission is something only some roles are allowed to do.
+type Permission string
+
+const (
+	// PermissionModerateGalleries allows seeing every gallery, and taking
+	// galleries down or restoring them.
+	PermissionModerateGalleries Permission = "moderate_galleries"
+	// PermissionManageUsers allows suspending users, signing them out and
+	// changing their role.
+	PermissionManageUsers Permission = "manage_users"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleModerator: {PermissionModerateGalleries},
+	RoleAdmin:     {PermissionModerateGalleries, PermissionManageUsers},
+}
+
+// Can reports whether the user has the permission. user is nil for visitors
+// that are not signed in. Suspended users have no permissions at all.
+func Can(user *User, p Permission) bool {
+	if user == nil || user.Suspended() {
+		return false
+	}
+	for _, permission := range rolePermissions[user.Role] {
+		if permission == p {
+			return true
+		}
+	}
+	return false
+}
+
+// GalleryPermission is something only some of the users of a gallery are
+// allowed to do.
+type GalleryPermission string
+
+const (
+	GalleryPermissionView GalleryPermission = "view"
+	// GalleryPermissionEditImages allows uploading and deleting images.
+	GalleryPermissionEditImages GalleryPermission = "edit_images"
+	// GalleryPermissionManage allows changing the settings of the gallery,
+	// sharing it, managing its members and deleting it.
+	GalleryPermissionManage GalleryPermission = "manage"
+)
+
+var galleryRolePermissions = map[GalleryRole][]GalleryPermission{
+	GalleryRoleOwner:  {GalleryPermissionView, GalleryPermissionEditImages, GalleryPermissionManage},
+	GalleryRoleEditor: {GalleryPermissionView, GalleryPermissionEditImages},
+	GalleryRoleViewer: {GalleryPermissionView},
+}
+
+// CanInGallery reports whether the user, who has role in the gallery, has the
+// permission. role is what GalleryMemberService.Role returns for them. Only
+// the owner keeps their permissions once the gallery was taken down.
+func CanInGallery(user *User, gallery *Gallery, role GalleryRole, p GalleryPermission) bool {
+	if user == nil || user.Suspended() {
+		return false
+	}
+	if gallery.TakenDown() && role != GalleryRoleOwner {
+		return false
+	}
+	for _, permission := range galleryRolePermissions[role] {
+		if permission == p {
+			return true
+		}
+	}
+	return false
+}
+
+// CanViewGallery reports whether the user can see the gallery when it is
+// accessed by its ID. Unlisted galleries can only be seen by others through
+// their slug, and galleries that were taken down only by their owner and
+// moderators.
+func CanViewGallery(user *User, gallery *Gallery, role GalleryRole) bool {
+	if CanInGallery(user, gallery, role, GalleryPermissionView) || Can(user, PermissionModerateGalleries) {
+		return true
+	}
+	return !gallery.TakenDown() && gallery.Visibility == VisibilityPublic
+}
+
+// CanViewGalleryBySlug reports whether the user can see the gallery when it
+// is accessed by its slug.
+func CanViewGalleryBySlug(user *User, gallery *Gallery, role GalleryRole) bool {
+	if !gallery.TakenDown() && gallery.Visibility == VisibilityUnlisted {
+		return true
+	}
+	return CanViewGallery(user, gallery, role)
+}
+
+// CanShareGallery reports whether share links of the gallery grant access.
+// Taking a gallery down revokes them along with everything else.
+func CanShareGallery(gallery *Gallery) bool {
+	return !gallery.TakenDown()
+}
+
+// CanSkipGalleryPassword reports whether the user can see a password
+// protected gallery without entering the password.
+func CanSkipGalleryPassword(user *User, gallery *Gallery, role GalleryRole) bool {
+	return CanInGallery(user, gallery, role, GalleryPermissionView) || Can(user, PermissionModerateGalleries)
+}
+
+// CanManageUser reports whether the user can suspend, sign out or change the
+// role of target. Nobody can do so to themselves, so that the last admin
+// can't lock everyone out by accident.
+func CanManageUser(user *User, target *User) bool {
+	return Can(user, PermissionManageUsers) && user.ID != target.ID
+}
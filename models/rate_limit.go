@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit is a token bucket that holds up to Requests tokens and refills
+// them evenly over Period. Each request takes a token, so bursts of Requests
+// are allowed but the long term rate is Requests per Period.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// perSecond is how many tokens are added to the bucket every second.
+func (rl RateLimit) perSecond() float64 {
+	return float64(rl.Requests) / rl.Period.Seconds()
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long to wait for the next token when the request
+	// was not allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the token buckets. Take has to be atomic, as many
+// requests for the same key can arrive at once.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type RateLimitConfig struct {
+	// Driver is either "memory" (the default) or "redis".
+	Driver string
+	Redis  RedisConfig
+}
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+// NewRateLimitStore returns the RateLimitStore selected by config.Driver.
+func NewRateLimitStore(config RateLimitConfig) (RateLimitStore, error) {
+	switch config.Driver {
+	case "", "memory":
+		return &MemoryRateLimitStore{}, nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     config.Redis.Addr,
+			Password: config.Redis.Password,
+			DB:       config.Redis.DB,
+		})
+		err := client.Ping(context.Background()).Err()
+		if err != nil {
+			return nil, fmt.Errorf("new rate limit store: %w", err)
+		}
+		return &RedisRateLimitStore{Client: client}, nil
+	default:
+		return nil, fmt.Errorf("new rate limit store: unknown driver %q", config.Driver)
+	}
+}
+
+// MemoryRateLimitStore keeps the buckets in memory. It is only correct when a
+// single server is running.
+type MemoryRateLimitStore struct {
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.buckets == nil {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+	s.sweep(now)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Requests), updated: now}
+		s.buckets[key] = bucket
+	}
+	bucket.period = limit.Period
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Requests), bucket.tokens+elapsed*limit.perSecond())
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / limit.perSecond()
+		return RateLimitResult{
+			RetryAfter: time.Duration(math.Ceil(wait * float64(time.Second))),
+		}, nil
+	}
+	bucket.tokens--
+	return RateLimitResult{Allowed: true, Remaining: int(bucket.tokens)}, nil
+}
+
+// sweep drops the buckets that have been refilled completely, as they are the
+// same as no bucket at all. It runs at most once a minute.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updated) > bucket.period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *MemoryRateLimitStore) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// RedisRateLimitStore keeps the buckets in Redis, so that every server shares
+// them.
+type RedisRateLimitStore struct {
+	Client *redis.Client
+	// Prefix is put in front of every key. Defaults to "ratelimit:".
+	Prefix string
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// tokenBucketScript does the same as MemoryRateLimitStore.Take, inside Redis
+// so that it is atomic.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil then
+	tokens = burst
+	updated = now
+end
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) * rate)
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {allowed, math.floor(tokens), retry}
+`)
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	// Times are in milliseconds, so the rate is in tokens per millisecond.
+	perMilli := limit.perSecond() / 1000
+	res, err := tokenBucketScript.Run(ctx, s.Client, []string{prefix + key},
+		limit.Requests, perMilli, now().UnixMilli(), limit.Period.Milliseconds()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take rate limit token: %w", err)
+	}
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := &MemoryRateLimitStore{Now: fixedClock(&now)}
+	limit := RateLimit{Requests: 3, Period: 3 * time.Second}
+	ctx := context.Background()
+
+	for i := 0; i < limit.Requests; i++ {
+		res, err := store.Take(ctx, "a", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != limit.Requests-1-i {
+			t.Fatalf("Take() %d = %+v, want allowed with %d remaining", i+1, res, limit.Requests-1-i)
+		}
+	}
+	res, err := store.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.RetryAfter != time.Second {
+		t.Errorf("Take() of an empty bucket = %+v, want refused with a retry after 1s", res)
+	}
+	res, err = store.Take(ctx, "b", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed {
+		t.Errorf("Take() of another key = %+v, want allowed", res)
+	}
+
+	// Tokens come back one per second, never more than the bucket holds.
+	now = now.Add(1500 * time.Millisecond)
+	res, err = store.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed || res.Remaining != 0 {
+		t.Errorf("Take() after 1.5s = %+v, want allowed with 0 remaining", res)
+	}
+	res, err = store.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Take() of half a token = %+v, want refused with a retry after 500ms", res)
+	}
+	now = now.Add(time.Hour)
+	res, err = store.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed || res.Remaining != limit.Requests-1 {
+		t.Errorf("Take() after an hour = %+v, want allowed with %d remaining", res, limit.Requests-1)
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := &MemoryRateLimitStore{Now: fixedClock(&now)}
+	ctx := context.Background()
+	_, err := store.Take(ctx, "short", RateLimit{Requests: 1, Period: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Take(ctx, "long", RateLimit{Requests: 1, Period: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	_, err = store.Take(ctx, "other", RateLimit{Requests: 1, Period: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.buckets["short"]; ok {
+		t.Error("bucket refilled a while ago was kept, want it dropped")
+	}
+	if _, ok := store.buckets["long"]; !ok {
+		t.Error("bucket still refilling was dropped, want it kept")
+	}
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ReconcileReport describes the differences found between the images table
+// and the files in the gallery Storage.
+type ReconcileReport struct {
+	// Imported holds the keys of the files that had no row and were added to
+	// the images table.
+	Imported []string
+	// OrphanFiles holds the keys of files that could not be imported, for
+	// example because their gallery no longer exists.
+	OrphanFiles []string
+	// OrphanRows holds the images whose file is missing from the Storage.
+	OrphanRows []Image
+}
+
+// Reconcile imports every image file in the Storage that is not in the images
+// table yet, and reports orphans in either direction. Nothing is written when
+// dryRun is true, files that would be imported are still reported as such.
+func (g *GalleryService) Reconcile(dryRun bool) (*ReconcileReport, error) {
+	objects, err := g.storage().List("gallery-")
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+	rows, err := g.AllImages()
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+
+	var report ReconcileReport
+	known := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		known[row.Path] = true
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+		if known[object.Key] || !hasExtension(object.Key, g.extensions()) || isRenditionPath(object.Key) {
+			continue
+		}
+		var galleryID int
+		_, err = fmt.Sscanf(object.Key, "gallery-%d/", &galleryID)
+		if err != nil || path.Dir(object.Key) != fmt.Sprintf("gallery-%d", galleryID) {
+			report.OrphanFiles = append(report.OrphanFiles, object.Key)
+			continue
+		}
+		var exists bool
+		err = g.DB.Get(&exists, galleryQueries["exists"], galleryID)
+		if err != nil {
+			return nil, fmt.Errorf("reconcile: %w", err)
+		}
+		if !exists {
+			report.OrphanFiles = append(report.OrphanFiles, object.Key)
+			continue
+		}
+		if !dryRun {
+			err = g.importImage(galleryID, object)
+			if err != nil {
+				fmt.Printf("reconcile: importing %v: %v\n", object.Key, err)
+				report.OrphanFiles = append(report.OrphanFiles, object.Key)
+				continue
+			}
+		}
+		report.Imported = append(report.Imported, object.Key)
+	}
+
+	for _, row := range rows {
+		if !stored[row.Path] {
+			report.OrphanRows = append(report.OrphanRows, row)
+		}
+	}
+	return &report, nil
+}
+
+// importImage records the metadata of a file that is already in the Storage.
+func (g *GalleryService) importImage(galleryID int, object ObjectInfo) error {
+	rc, _, err := g.storage().Get(object.Key)
+	if err != nil {
+		return fmt.Errorf("import image: %w", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("import image: %w", err)
+	}
+	contents := bytes.NewReader(data)
+	contentType, err := checkContentType(contents, g.imageContentTypes())
+	if err != nil {
+		return fmt.Errorf("import image: %w", err)
+	}
+	image, err := readImageMetadata(contents)
+	if err != nil {
+		return fmt.Errorf("import image: %w", err)
+	}
+	image.GalleryID = galleryID
+	image.Filename = path.Base(object.Key)
+	image.Path = object.Key
+	image.ContentType = contentType
+	image.UploadedAt = object.ModTime
+	if image.UploadedAt.IsZero() {
+		image.UploadedAt = time.Now()
+	}
+	_, err = g.DB.NamedExec(galleryQueries["create_image"], image)
+	if err != nil {
+		return fmt.Errorf("import image: %w", err)
+	}
+	return nil
+}
+
+// isRenditionPath reports whether key belongs to a rendition rather than to an
+// original upload. Renditions are not tracked in the images table.
+func isRenditionPath(key string) bool {
+	return strings.Contains(key, "/renditions/")
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// Rendition is a resized copy of every uploaded image, so pages don't need to
+// download the original upload to show a small preview.
+type Rendition struct {
+	Name string
+	// MaxSize is the maximum width and height of the rendition. Images are
+	// never scaled up.
+	MaxSize int
+}
+
+var (
+	RenditionThumbnail = Rendition{Name: "thumb", MaxSize: 320}
+	RenditionMedium    = Rendition{Name: "medium", MaxSize: 1024}
+	RenditionLarge     = Rendition{Name: "large", MaxSize: 2048}
+
+	// Renditions holds every rendition generated for an image, from smallest to
+	// largest.
+	Renditions = []Rendition{RenditionThumbnail, RenditionMedium, RenditionLarge}
+)
+
+// RenditionByName returns the rendition with the given name.
+func RenditionByName(name string) (Rendition, bool) {
+	for _, r := range Renditions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rendition{}, false
+}
+
+// Dimensions returns the width and height of the rendition of an image with
+// the given size, keeping its aspect ratio.
+func (r Rendition) Dimensions(width, height int) (int, int) {
+	if width <= r.MaxSize && height <= r.MaxSize {
+		return width, height
+	}
+	if width >= height {
+		return r.MaxSize, max(1, height*r.MaxSize/width)
+	}
+	return max(1, width*r.MaxSize/height), r.MaxSize
+}
+
+func (g *GalleryService) renditionPath(image Image, rendition Rendition) string {
+	return g.galleryPrefix(image.GalleryID) + "renditions/" + rendition.Name + "/" + image.Filename
+}
+
+// OpenRendition returns the contents of a rendition of the image. Images that
+// were uploaded before renditions existed, and haven't been backfilled yet,
+// fall back to the original.
+func (g *GalleryService) OpenRendition(image Image, rendition Rendition) (io.ReadCloser, *ObjectInfo, error) {
+	contents, info, err := g.storage().Get(g.renditionPath(image, rendition))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return g.OpenImage(image)
+		}
+		return nil, nil, fmt.Errorf("opening rendition: %w", err)
+	}
+	if info.ContentType == "" {
+		info.ContentType = image.ContentType
+	}
+	return contents, info, nil
+}
+
+// GenerateRenditions (re)creates every rendition of an image from the stored
+// original.
+func (g *GalleryService) GenerateRenditions(image Image) error {
+	contents, _, err := g.OpenImage(image)
+	if err != nil {
+		return fmt.Errorf("generate renditions: %w", err)
+	}
+	defer contents.Close()
+	src, _, err := decodeImage(contents)
+	if err != nil {
+		return fmt.Errorf("generate renditions: %w", err)
+	}
+	err = g.storeRenditions(image, src)
+	if err != nil {
+		return fmt.Errorf("generate renditions: %w", err)
+	}
+	return nil
+}
+
+// HasRenditions reports whether every rendition of the image exists.
+func (g *GalleryService) HasRenditions(image Image) (bool, error) {
+	for _, rendition := range Renditions {
+		_, err := g.storage().Stat(g.renditionPath(image, rendition))
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return false, nil
+			}
+			return false, fmt.Errorf("has renditions: %w", err)
+		}
+	}
+	return true, nil
+}
+
+func (g *GalleryService) storeRenditions(image Image, src image.Image) error {
+	for _, rendition := range Renditions {
+		var buf bytes.Buffer
+		err := encodeImage(&buf, resizeImage(src, rendition), image.ContentType)
+		if err != nil {
+			return fmt.Errorf("rendition %v: %w", rendition.Name, err)
+		}
+		err = g.storage().Put(g.renditionPath(image, rendition), &buf, int64(buf.Len()), image.ContentType)
+		if err != nil {
+			return fmt.Errorf("rendition %v: %w", rendition.Name, err)
+		}
+	}
+	return nil
+}
+
+func (g *GalleryService) deleteRenditions(image Image) error {
+	for _, rendition := range Renditions {
+		err := g.storage().Delete(g.renditionPath(image, rendition))
+		if err != nil {
+			return fmt.Errorf("delete renditions: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeImage decodes r after making sure the image isn't larger than
+// MaxImagePixels.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	// The bytes DecodeConfig reads are kept, so Decode can start over without
+	// r having to be seekable.
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", FileError{Issue: fmt.Sprintf("image could not be decoded: %v", err)}
+	}
+	err = checkDimensions(config.Width, config.Height)
+	if err != nil {
+		return nil, "", err
+	}
+	src, format, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", FileError{Issue: fmt.Sprintf("image could not be decoded: %v", err)}
+	}
+	return src, format, nil
+}
+
+func resizeImage(src image.Image, rendition Rendition) image.Image {
+	bounds := src.Bounds()
+	width, height := rendition.Dimensions(bounds.Dx(), bounds.Dy())
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// encodeImage writes img in the same format as the original upload so the
+// rendition can be served with the original content type.
+func encodeImage(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported content type %v", contentType)
+	}
+}
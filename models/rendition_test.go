@@ -0,0 +1,131 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pngWithSize encodes a tiny PNG and then rewrites its header to claim the
+// given dimensions, the way a decompression bomb would.
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length, type, then width
+	// and height, and its CRC after the 13 bytes of data.
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestDecodeImage(t *testing.T) {
+	src, format, err := decodeImage(bytes.NewReader(pngWithSize(t, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || src.Bounds().Dx() != 1 || src.Bounds().Dy() != 1 {
+		t.Errorf("decodeImage = %s %v, want a 1x1 png", format, src.Bounds())
+	}
+}
+
+func TestDecodeImageRejectsTooManyPixels(t *testing.T) {
+	_, _, err := decodeImage(bytes.NewReader(pngWithSize(t, 10000, 10000)))
+	var fileErr FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("decodeImage of a 100 MP image = %v, want a FileError", err)
+	}
+}
+
+func TestCreateImageRejectsTooManyPixels(t *testing.T) {
+	storage := &MemoryStorage{}
+	g := &GalleryService{Storage: storage}
+	_, err := g.CreateImage(1, "bomb.png", bytes.NewReader(pngWithSize(t, 100000, 100000)))
+	var fileErr FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("CreateImage of a 10 GP image = %v, want a FileError", err)
+	}
+	objects, err := storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("CreateImage stored %v, want nothing stored", objectKeys(objects))
+	}
+}
+
+func TestGenerateRenditionsRejectsTooManyPixels(t *testing.T) {
+	storage := &MemoryStorage{}
+	data := pngWithSize(t, 10000, 10000)
+	err := storage.Put("gallery-1/bomb.png", bytes.NewReader(data), int64(len(data)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &GalleryService{Storage: storage}
+	err = g.GenerateRenditions(Image{GalleryID: 1, Filename: "bomb.png", Path: "gallery-1/bomb.png", ContentType: "image/png"})
+	var fileErr FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("GenerateRenditions of a 100 MP image = %v, want a FileError", err)
+	}
+}
+
+// failingRenditionStorage is a MemoryStorage that can't store renditions.
+type failingRenditionStorage struct {
+	*MemoryStorage
+}
+
+func (s failingRenditionStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	if strings.Contains(key, "/renditions/") {
+		return errors.New("storage unavailable")
+	}
+	return s.MemoryStorage.Put(key, r, size, contentType)
+}
+
+func TestCreateImageDiscardsStoredFilesOnError(t *testing.T) {
+	storage := &MemoryStorage{}
+	g := &GalleryService{Storage: failingRenditionStorage{storage}}
+	_, err := g.CreateImage(1, "beach.png", bytes.NewReader(pngWithSize(t, 1, 1)))
+	if err == nil {
+		t.Fatal("CreateImage with a failing storage = nil, want an error")
+	}
+	objects, err := storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("CreateImage left %v, want nothing stored", objectKeys(objects))
+	}
+}
+
+func TestCreateImageRejectsUndecodableImages(t *testing.T) {
+	storage := &MemoryStorage{}
+	g := &GalleryService{Storage: storage}
+	// A valid PNG header followed by garbage passes the content type and
+	// dimension checks, and only fails once it is decoded.
+	data := pngWithSize(t, 1, 1)
+	data = append(data[:8+8+13+4], bytes.Repeat([]byte{0xff}, 64)...)
+	_, err := g.CreateImage(1, "broken.png", bytes.NewReader(data))
+	var fileErr FileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("CreateImage of a broken png = %v, want a FileError", err)
+	}
+	objects, err := storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("CreateImage stored %v, want nothing stored", objectKeys(objects))
+	}
+}
@@ -2,9 +2,12 @@ package models
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	_ "embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Zelinzky/go-sqlf"
 	"github.com/jmoiron/sqlx"
@@ -14,19 +17,39 @@ import (
 
 const MinBytesPerToken = 32
 
+const (
+	// DefaultSessionDuration is the absolute lifetime of a session, no matter
+	// how active it is.
+	DefaultSessionDuration = 30 * 24 * time.Hour
+	// DefaultSessionIdleTimeout is how long a session can go unused before it
+	// is no longer valid.
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
+)
+
 type Session struct {
 	ID     int `db:"id"`
 	UserID int `db:"user_id"`
 	// Token is only set when createing a news session. When looking upa seddsion
 	// this will be left empaty, as we only store the hash of a session token
 	// in our db, and we are not able to reverse it into a raw token.
-	Token     string `db:"token"`
-	TokenHash string `db:"token_hash"`
+	Token      string    `db:"token"`
+	TokenHash  string    `db:"token_hash"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+	UserAgent  string    `db:"user_agent"`
+	IPAddress  string    `db:"ip_address"`
 }
 
 type SessionService struct {
 	DB            *sqlx.DB
 	BytesPerToken int
+	// Duration is the absolute lifetime of a session. Defaults to
+	// DefaultSessionDuration.
+	Duration time.Duration
+	// IdleTimeout is how long a session may go without being used. Defaults
+	// to DefaultSessionIdleTimeout.
+	IdleTimeout time.Duration
 }
 
 //go:embed session.sql
@@ -38,7 +61,11 @@ func init() {
 	sessionQueries = sqlf.Load(sessionQueriesFile)
 }
 
-func (s *SessionService) Create(userID int) (*Session, error) {
+// Create starts a new session for the user. A user can have as many
+// concurrent sessions as they want, one for each device they sign in from.
+// Suspended users can't start sessions, ErrAccountSuspended is returned for
+// them.
+func (s *SessionService) Create(userID int, userAgent, ipAddress string) (*Session, error) {
 	bytesPerToken := s.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -48,28 +75,86 @@ func (s *SessionService) Create(userID int) (*Session, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
+	now := time.Now()
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: s.hash(token),
+		UserID:     userID,
+		Token:      token,
+		TokenHash:  s.hash(token),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.duration()),
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
 	}
 
 	err = sqlf.NamedDB{DB: s.DB}.NamedGet(&session.ID, sessionQueries["create"], session)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ErrAccountSuspended)
+		}
 		return nil, fmt.Errorf("create: %w", err)
 	}
 
 	return &session, nil
 }
 
+// User looks up the user for the session token. Sessions past their absolute
+// expiry or idle timeout are deleted and treated as invalid, otherwise the
+// session's last seen time is refreshed.
 func (s *SessionService) User(token string) (*User, error) {
+	user, _, err := s.UserSession(token)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UserSession is User, but also returns the session the token belongs to.
+// Only the ID and times of the session are set.
+func (s *SessionService) UserSession(token string) (*User, *Session, error) {
 	tokenHash := s.hash(token)
-	var user User
-	err := s.DB.Get(&user, sessionQueries["user"], tokenHash)
+	var dao struct {
+		User    User    `db:"user"`
+		Session Session `db:"session"`
+	}
+	err := s.DB.Get(&dao, sessionQueries["user"], tokenHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user: %w", err)
+	}
+
+	now := time.Now()
+	if now.After(dao.Session.ExpiresAt) || now.After(dao.Session.LastSeenAt.Add(s.idleTimeout())) {
+		err = s.Delete(token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user: %w", err)
+		}
+		return nil, nil, fmt.Errorf("user: session expired")
+	}
+
+	_, err = s.DB.Exec(sessionQueries["touch"], dao.Session.ID, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user: %w", err)
+	}
+
+	user, session := dao.User, dao.Session
+	return &user, &session, nil
+}
+
+// ByUserID returns every active session of the user, most recently used
+// first.
+func (s *SessionService) ByUserID(userID int) ([]Session, error) {
+	now := time.Now()
+	var sessions []Session
+	err := s.DB.Select(&sessions, sessionQueries["by_user_id"], userID, now, now.Add(-s.idleTimeout()))
 	if err != nil {
-		return nil, fmt.Errorf("user: %w", err)
+		return nil, fmt.Errorf("sessions by user: %w", err)
 	}
-	return &user, nil
+	return sessions, nil
+}
+
+// IsToken reports whether the session was created for the given raw token.
+func (s *SessionService) IsToken(session Session, token string) bool {
+	return session.TokenHash == s.hash(token)
 }
 
 func (s *SessionService) Delete(token string) error {
@@ -81,6 +166,49 @@ func (s *SessionService) Delete(token string) error {
 	return nil
 }
 
+// DeleteByID revokes a single session. The user ID is required so that users
+// can only revoke their own sessions.
+func (s *SessionService) DeleteByID(userID, id int) error {
+	_, err := s.DB.Exec(sessionQueries["delete_by_id"], id, userID)
+	if err != nil {
+		return fmt.Errorf("delete session by id: %w", err)
+	}
+	return nil
+}
+
+// DeleteOthers revokes every session of the user except the one belonging to
+// token.
+func (s *SessionService) DeleteOthers(userID int, token string) error {
+	_, err := s.DB.Exec(sessionQueries["delete_others"], userID, s.hash(token))
+	if err != nil {
+		return fmt.Errorf("delete other sessions: %w", err)
+	}
+	return nil
+}
+
+// DeleteAll signs the user out everywhere.
+func (s *SessionService) DeleteAll(userID int) error {
+	_, err := s.DB.Exec(sessionQueries["delete_all"], userID)
+	if err != nil {
+		return fmt.Errorf("delete all sessions: %w", err)
+	}
+	return nil
+}
+
+func (s *SessionService) duration() time.Duration {
+	if s.Duration == 0 {
+		return DefaultSessionDuration
+	}
+	return s.Duration
+}
+
+func (s *SessionService) idleTimeout() time.Duration {
+	if s.IdleTimeout == 0 {
+		return DefaultSessionIdleTimeout
+	}
+	return s.IdleTimeout
+}
+
 func (s *SessionService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
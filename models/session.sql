@@ -1,17 +1,57 @@
 -- name: create
-INSERT INTO sessions (user_id, token_hash)
-VALUES (:user_id, :token_hash)
-ON CONFLICT (user_id) DO UPDATE
-    SET token_hash = :token_hash
+INSERT INTO sessions (user_id, token_hash, created_at, last_seen_at, expires_at, user_agent, ip_address)
+SELECT id, :token_hash, :created_at, :last_seen_at, :expires_at, :user_agent, :ip_address
+FROM users
+WHERE id = :user_id
+  AND suspended_at IS NULL
 RETURNING id;
 
 -- name: user
-SELECT u.id, u.email, u.password_hash
+SELECT s.id            "session.id",
+       s.last_seen_at  "session.last_seen_at",
+       s.expires_at    "session.expires_at",
+       u.id            "user.id",
+       u.email         "user.email",
+       u.password_hash "user.password_hash",
+       u.verified_at   "user.verified_at",
+       u.role          "user.role",
+       u.suspended_at  "user.suspended_at"
 FROM sessions s
          JOIN users u ON u.id = s.user_id
-WHERE s.token_hash = $1;
+WHERE s.token_hash = $1
+  AND u.suspended_at IS NULL;
+
+-- name: touch
+UPDATE sessions
+SET last_seen_at = $2
+WHERE id = $1;
+
+-- name: by_user_id
+SELECT id, user_id, token_hash, created_at, last_seen_at, expires_at, user_agent, ip_address
+FROM sessions
+WHERE user_id = $1
+  AND expires_at > $2
+  AND last_seen_at > $3
+ORDER BY last_seen_at DESC;
 
 -- name: delete
 DELETE
 FROM sessions
-WHERE token_hash = $1;
\ No newline at end of file
+WHERE token_hash = $1;
+
+-- name: delete_by_id
+DELETE
+FROM sessions
+WHERE id = $1
+  AND user_id = $2;
+
+-- name: delete_others
+DELETE
+FROM sessions
+WHERE user_id = $1
+  AND token_hash <> $2;
+
+-- name: delete_all
+DELETE
+FROM sessions
+WHERE user_id = $1;
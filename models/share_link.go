@@ -0,0 +1,156 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+// ShareLink grants access to a single gallery to whoever has its token,
+// regardless of the gallery visibility.
+type ShareLink struct {
+	ID        int `db:"id"`
+	GalleryID int `db:"gallery_id"`
+	// Token is only set when a ShareLink is being created.
+	Token     string `db:"token"`
+	TokenHash string `db:"token_hash"`
+	Label     string `db:"label"`
+	// AllowDownload lets visitors get the original uploads instead of only
+	// the resized renditions.
+	AllowDownload bool `db:"allow_download"`
+	// MaxViews is the number of times the gallery can be viewed through the
+	// link. Links without it can be used any number of times.
+	MaxViews  sql.NullInt32 `db:"max_views"`
+	Views     int           `db:"views"`
+	ExpiresAt sql.NullTime  `db:"expires_at"`
+	CreatedAt time.Time     `db:"created_at"`
+}
+
+//go:embed share_link.sql
+var shareLinkQueriesFile string
+
+var shareLinkQueries map[string]string
+
+func init() {
+	shareLinkQueries = sqlf.Load(shareLinkQueriesFile)
+}
+
+const DefaultShareLinkDuration = 14 * 24 * time.Hour
+
+type ShareLinkService struct {
+	DB            *sqlx.DB
+	BytesPerToken int
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+type ShareLinkOptions struct {
+	Label         string
+	AllowDownload bool
+	// Duration is how long the link is valid for. Zero means it never
+	// expires.
+	Duration time.Duration
+	// MaxViews limits how many times the link can be used. Zero means there
+	// is no limit.
+	MaxViews int
+}
+
+func (sl *ShareLinkService) Create(galleryID int, opts ShareLinkOptions) (*ShareLink, error) {
+	bytesPerToken := sl.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	now := sl.now()
+	link := ShareLink{
+		GalleryID:     galleryID,
+		Token:         token,
+		TokenHash:     sl.hash(token),
+		Label:         opts.Label,
+		AllowDownload: opts.AllowDownload,
+		CreatedAt:     now,
+	}
+	if opts.Duration > 0 {
+		link.ExpiresAt = sql.NullTime{Time: now.Add(opts.Duration), Valid: true}
+	}
+	if opts.MaxViews > 0 {
+		link.MaxViews = sql.NullInt32{Int32: int32(opts.MaxViews), Valid: true}
+	}
+	err = sqlf.NamedDB{DB: sl.DB}.NamedGet(&link.ID, shareLinkQueries["create"], link)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	return &link, nil
+}
+
+func (sl *ShareLinkService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	var links []ShareLink
+	err := sl.DB.Select(&links, shareLinkQueries["by_gallery_id"], galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("share links by gallery: %w", err)
+	}
+	return links, nil
+}
+
+// Check returns the share link for the gallery if token is still valid,
+// without counting it as a view. Like View, it refuses links that reached
+// their view limit.
+func (sl *ShareLinkService) Check(galleryID int, token string) (*ShareLink, error) {
+	var link ShareLink
+	err := sl.DB.Get(&link, shareLinkQueries["check"], galleryID, sl.hash(token), sl.now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("check share link: %w", err)
+	}
+	return &link, nil
+}
+
+// View is like Check, but also counts a view of the gallery. Links that
+// reached their view limit are no longer valid.
+func (sl *ShareLinkService) View(galleryID int, token string) (*ShareLink, error) {
+	var link ShareLink
+	err := sl.DB.Get(&link, shareLinkQueries["view"], galleryID, sl.hash(token), sl.now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("view share link: %w", err)
+	}
+	return &link, nil
+}
+
+// Delete revokes the share link. The gallery ID is required so that links can
+// only be revoked through the gallery they belong to.
+func (sl *ShareLinkService) Delete(galleryID, id int) error {
+	_, err := sl.DB.Exec(shareLinkQueries["delete"], id, galleryID)
+	if err != nil {
+		return fmt.Errorf("delete share link: %w", err)
+	}
+	return nil
+}
+
+func (sl *ShareLinkService) now() time.Time {
+	if sl.Now == nil {
+		return time.Now()
+	}
+	return sl.Now()
+}
+
+func (sl *ShareLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
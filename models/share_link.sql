@@ -0,0 +1,33 @@
+-- name: create
+INSERT INTO share_links (gallery_id, token_hash, label, allow_download, max_views, expires_at, created_at)
+VALUES (:gallery_id, :token_hash, :label, :allow_download, :max_views, :expires_at, :created_at)
+RETURNING id;
+
+-- name: by_gallery_id
+SELECT id, gallery_id, token_hash, label, allow_download, max_views, views, expires_at, created_at
+FROM share_links
+WHERE gallery_id = $1
+ORDER BY created_at DESC;
+
+-- name: check
+SELECT id, gallery_id, token_hash, label, allow_download, max_views, views, expires_at, created_at
+FROM share_links
+WHERE gallery_id = $1
+  AND token_hash = $2
+  AND (expires_at IS NULL OR expires_at > $3)
+  AND (max_views IS NULL OR views < max_views);
+
+-- name: view
+UPDATE share_links
+SET views = views + 1
+WHERE gallery_id = $1
+  AND token_hash = $2
+  AND (expires_at IS NULL OR expires_at > $3)
+  AND (max_views IS NULL OR views < max_views)
+RETURNING id, gallery_id, token_hash, label, allow_download, max_views, views, expires_at, created_at;
+
+-- name: delete
+DELETE
+FROM share_links
+WHERE id = $1
+  AND gallery_id = $2;
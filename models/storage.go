@@ -0,0 +1,272 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSignedURLUnsupported is returned by storages that cannot hand out URLs
+// for clients to download objects directly.
+var ErrSignedURLUnsupported = errors.New("models: storage does not support signed urls")
+
+// Storage is where the contents of files (such as gallery images) are kept.
+// Keys are slash separated paths, e.g. "gallery-1/cat.png". Implementations
+// return ErrNotFound when a key does not exist.
+type Storage interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+	Stat(key string) (*ObjectInfo, error)
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	Delete(key string) error
+	// SignedURL returns a URL that can be used to download the object without
+	// any other credentials until it expires.
+	SignedURL(key string, expires time.Duration) (string, error)
+}
+
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+type StorageConfig struct {
+	// Driver is either "disk" (the default) or "s3".
+	Driver    string
+	ImagesDir string
+	S3        S3Config
+}
+
+// NewStorage returns the Storage selected by config.Driver.
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Driver {
+	case "", "disk":
+		return &DiskStorage{Dir: config.ImagesDir}, nil
+	case "s3":
+		storage := NewS3Storage(config.S3)
+		err := storage.EnsureBucket()
+		if err != nil {
+			return nil, fmt.Errorf("new storage: %w", err)
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("new storage: unknown driver %q", config.Driver)
+	}
+}
+
+// DiskStorage keeps objects as files inside Dir.
+type DiskStorage struct {
+	Dir string
+}
+
+func (d *DiskStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	p := d.path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	dst, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+func (d *DiskStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	return f, d.info(key, stat), nil
+}
+
+func (d *DiskStorage) Stat(key string) (*ObjectInfo, error) {
+	stat, err := os.Stat(d.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("stat %v: %w", key, err)
+	}
+	return d.info(key, stat), nil
+}
+
+func (d *DiskStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	root := d.dir()
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *d.info(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+func (d *DiskStorage) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+func (d *DiskStorage) SignedURL(key string, expires time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+func (d *DiskStorage) dir() string {
+	if d.Dir == "" {
+		return "images"
+	}
+	return d.Dir
+}
+
+func (d *DiskStorage) path(key string) string {
+	// Cleaning the key as an absolute path keeps it from escaping Dir.
+	return filepath.Join(d.dir(), filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (d *DiskStorage) info(key string, stat fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:     key,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}
+}
+
+// MemoryStorage keeps objects in memory. It is meant for development and
+// tests, everything is lost when the process exits.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+func (m *MemoryStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string]memoryObject)
+	}
+	m.objects[key] = memoryObject{
+		info: ObjectInfo{
+			Key:         key,
+			Size:        int64(len(data)),
+			ModTime:     time.Now(),
+			ContentType: contentType,
+		},
+		data: data,
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	info := obj.info
+	return readSeekNopCloser{bytes.NewReader(obj.data)}, &info, nil
+}
+
+func (m *MemoryStorage) Stat(key string) (*ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := obj.info
+	return &info, nil
+}
+
+func (m *MemoryStorage) List(prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var objects []ObjectInfo
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (m *MemoryStorage) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryStorage) SignedURL(key string, expires time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+// readSeekNopCloser lets callers of Get seek the contents, like they can with
+// the files returned by DiskStorage.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
@@ -0,0 +1,391 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the S3 compatible API, for example
+	// http://localhost:9000 for the MinIO service in compose.yaml.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Storage keeps objects in a bucket of an S3 compatible service. Requests
+// use path style addressing and are signed with AWS Signature Version 4.
+type S3Storage struct {
+	S3Config
+	Client *http.Client
+	// Now returns the time used to sign requests. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func NewS3Storage(config S3Config) *S3Storage {
+	return &S3Storage{S3Config: config}
+}
+
+// EnsureBucket creates the bucket if it does not exist yet.
+func (s *S3Storage) EnsureBucket() error {
+	resp, err := s.do(http.MethodHead, "", nil, nil, -1, nil)
+	if err != nil {
+		return fmt.Errorf("ensure bucket: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	resp, err = s.do(http.MethodPut, "", nil, nil, 0, nil)
+	if err != nil {
+		return fmt.Errorf("ensure bucket: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ensure bucket: %w", s3Error(resp))
+	}
+	return nil
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(http.MethodPut, key, nil, header, size, r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("put %v: %w", key, s3Error(resp))
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, -1, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("get %v: %w", key, s3Error(resp))
+	}
+	return resp.Body, s.info(key, resp), nil
+}
+
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, -1, nil)
+	if err != nil {
+		return nil, fmt.Errorf("stat %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("stat %v: %w", key, s3Error(resp))
+	}
+	return s.info(key, resp), nil
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	var continuation string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, -1, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuation = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, -1, nil)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete %v: %w", key, s3Error(resp))
+	}
+	return nil
+}
+
+// SignedURL returns a presigned GET URL for the object.
+func (s *S3Storage) SignedURL(key string, expires time.Duration) (string, error) {
+	u, err := s.url(key, nil)
+	if err != nil {
+		return "", fmt.Errorf("signed url %v: %w", key, err)
+	}
+	now := s.now().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.AccessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = s3Query(query)
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := s.signature(http.MethodGet, u, header, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, size int64, body io.Reader) (*http.Response, error) {
+	u, err := s.url(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	payload := s3EmptyPayload
+	if body != nil {
+		payload = s3UnsignedPayload
+	}
+	s.sign(req, payload)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (s *S3Storage) url(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3Query(query)
+	return u, nil
+}
+
+// sign adds the Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	header := req.Header.Clone()
+	header.Set("Host", req.URL.Host)
+	signature := s.signature(req.Method, req.URL, header, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, s.scope(now), s3SignedHeaders(header), signature))
+}
+
+func (s *S3Storage) signature(method string, u *url.URL, header http.Header, payloadHash string, t time.Time) string {
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		s3CanonicalHeaders(header),
+		s3SignedHeaders(header),
+		payloadHash,
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3TimeFormat),
+		s.scope(t),
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.SecretKey), t.Format(s3DateFormat))
+	key = s3HMAC(key, s.region())
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func (s *S3Storage) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + s.region() + "/s3/aws4_request"
+}
+
+func (s *S3Storage) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+func (s *S3Storage) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s *S3Storage) info(key string, resp *http.Response) *ObjectInfo {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ModTime:     modTime,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+}
+
+func s3Error(resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	if err != nil || body.Code == "" {
+		return fmt.Errorf("s3: unexpected status %s", resp.Status)
+	}
+	return fmt.Errorf("s3: %s: %s", body.Code, body.Message)
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalHeaders(header http.Header) string {
+	var b strings.Builder
+	for _, k := range s3HeaderNames(header) {
+		values := header.Values(k)
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(strings.ToLower(k) + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+func s3SignedHeaders(header http.Header) string {
+	names := s3HeaderNames(header)
+	for i, name := range names {
+		names[i] = strings.ToLower(name)
+	}
+	return strings.Join(names, ";")
+}
+
+func s3HeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for k := range header {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	return names
+}
+
+// s3Query encodes query the way Signature Version 4 expects it: sorted by
+// key, with every character but the unreserved ones percent encoded.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, false)
+}
+
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
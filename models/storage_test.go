@@ -0,0 +1,155 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage checks that a Storage behaves the way the rest of the models
+// expect every implementation to.
+func testStorage(t *testing.T, storage Storage) {
+	t.Helper()
+	objects := map[string]string{
+		"gallery-1/cat.png":      "meow",
+		"gallery-1/dog.png":      "woof",
+		"gallery-1/fish.png":     "",
+		"gallery-1/nested/x.png": "nested",
+		"gallery-10/bird.png":    "tweet",
+		"exports/1.zip":          "zip",
+	}
+	for key, data := range objects {
+		err := storage.Put(key, strings.NewReader(data), int64(len(data)), "image/png")
+		if err != nil {
+			t.Fatalf("Put(%q) = %v", key, err)
+		}
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		for key, data := range objects {
+			r, info, err := storage.Get(key)
+			if err != nil {
+				t.Fatalf("Get(%q) = %v", key, err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("reading %q: %v", key, err)
+			}
+			if string(got) != data {
+				t.Errorf("Get(%q) = %q, want %q", key, got, data)
+			}
+			if info.Key != key || info.Size != int64(len(data)) {
+				t.Errorf("Get(%q) info = %+v, want key %q and size %d", key, info, key, len(data))
+			}
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := storage.Stat("gallery-1/dog.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "gallery-1/dog.png" || info.Size != 4 {
+			t.Errorf("Stat info = %+v, want key gallery-1/dog.png and size 4", info)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, _, err := storage.Get("gallery-1/missing.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a missing key = %v, want ErrNotFound", err)
+		}
+		_, err = storage.Stat("gallery-1/missing.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat of a missing key = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		got, err := storage.List("gallery-1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"gallery-1/cat.png", "gallery-1/dog.png", "gallery-1/fish.png", "gallery-1/nested/x.png"}
+		keys := objectKeys(got)
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("List = %v, want %v", keys, want)
+		}
+		got, err = storage.List("gallery-2/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Errorf("List of an unused prefix = %v, want nothing", objectKeys(got))
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		err := storage.Put("gallery-1/cat.png", strings.NewReader("purr"), 4, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _, err := storage.Get("gallery-1/cat.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "purr" {
+			t.Errorf("Get after overwriting = %q, want %q", got, "purr")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := storage.Delete("gallery-1/dog.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = storage.Stat("gallery-1/dog.png")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat of a deleted key = %v, want ErrNotFound", err)
+		}
+		// Deleting what isn't there is not an error, so cleanups can be
+		// retried.
+		err = storage.Delete("gallery-1/dog.png")
+		if err != nil {
+			t.Errorf("Delete of a missing key = %v, want nil", err)
+		}
+	})
+}
+
+func objectKeys(objects []ObjectInfo) []string {
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, &MemoryStorage{})
+}
+
+func TestDiskStorage(t *testing.T) {
+	testStorage(t, &DiskStorage{Dir: t.TempDir()})
+}
+
+func TestDiskStorageKeysStayInDir(t *testing.T) {
+	dir := t.TempDir()
+	storage := &DiskStorage{Dir: dir + "/images"}
+	err := storage.Put("../escaped.png", strings.NewReader("x"), 1, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&DiskStorage{Dir: dir}).Stat("escaped.png")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Put of ../escaped.png wrote outside of Dir")
+	}
+}
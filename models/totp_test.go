@@ -0,0 +1,76 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestTOTPValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	tests := []struct {
+		step int64
+		ok   bool
+	}{
+		{current - 2, false},
+		{current - 1, true},
+		{current, true},
+		{current + 1, true},
+		{current + 2, false},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(rfc6238Secret, tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := totpValidate(rfc6238Secret, code, now)
+		if ok != tt.ok {
+			t.Errorf("totpValidate of step %+d = %v, want %v", tt.step-current, ok, tt.ok)
+		}
+		if ok && step != tt.step {
+			t.Errorf("totpValidate of step %+d returned step %d, want %d", tt.step-current, step, tt.step)
+		}
+	}
+}
+
+func TestTOTPValidateFormat(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"287 082", " 287082 "} {
+		if _, ok := totpValidate(rfc6238Secret, code, now); !ok {
+			t.Errorf("totpValidate(%q) = false, want true", code)
+		}
+	}
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := totpValidate(rfc6238Secret, code, now); ok {
+			t.Errorf("totpValidate(%q) = true, want false", code)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zelinzky/go-sqlf"
+	"github.com/jmoiron/sqlx"
+
+	"lenslocked/rand"
+)
+
+const (
+	DefaultTwoFactorIssuer   = "Lenslocked"
+	DefaultChallengeDuration = 5 * time.Minute
+	MaxTwoFactorAttempts     = 5
+	RecoveryCodeCount        = 10
+	totpSecretBytes          = 20
+	recoveryCodeBytes        = 10
+)
+
+// TOTPCredential is the shared secret used to generate the time based codes of
+// a user. A credential is only used for sign in once ConfirmedAt is set.
+type TOTPCredential struct {
+	ID           int          `db:"id"`
+	UserID       int          `db:"user_id"`
+	Secret       string       `db:"secret"`
+	LastUsedStep int64        `db:"last_used_step"`
+	ConfirmedAt  sql.NullTime `db:"confirmed_at"`
+}
+
+// TOTPEnrollment holds what the user needs to add an account to their
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// TwoFactorChallenge is created after a user with two-factor authentication
+// enabled has entered a correct password. The session is only created once
+// the challenge is completed with a valid code.
+type TwoFactorChallenge struct {
+	ID     int `db:"id"`
+	UserID int `db:"user_id"`
+	// Token is only set when a TwoFactorChallenge is being created.
+	Token     string    `db:"token"`
+	TokenHash string    `db:"token_hash"`
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+//go:embed two_factor.sql
+var twoFactorQueriesFile string
+
+var twoFactorQueries map[string]string
+
+func init() {
+	twoFactorQueries = sqlf.Load(twoFactorQueriesFile)
+}
+
+type TwoFactorService struct {
+	DB *sqlx.DB
+	// Issuer is the name shown in authenticator apps.
+	Issuer            string
+	BytesPerToken     int
+	ChallengeDuration time.Duration
+	// Now returns the current time. It defaults to time.Now and can be
+	// replaced to control the clock used to generate and validate codes.
+	Now func() time.Time
+}
+
+// Setup generates a new, unconfirmed secret for the user. Calling it again
+// before the secret is confirmed replaces the secret.
+func (tf *TwoFactorService) Setup(userID int, email string) (*TOTPEnrollment, error) {
+	secretBytes, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("setup two factor: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+	var id int
+	err = tf.DB.Get(&id, twoFactorQueries["setup"], userID, secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTwoFactorEnabled
+		}
+		return nil, fmt.Errorf("setup two factor: %w", err)
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(tf.issuer(), email, secret),
+	}, nil
+}
+
+// Confirm enables two-factor authentication once the user proves their
+// authenticator app is generating valid codes. It returns the recovery codes,
+// which are only ever available here as we only store their hashes.
+func (tf *TwoFactorService) Confirm(userID int, code string) ([]string, error) {
+	credential, err := tf.credential(userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	if credential.ConfirmedAt.Valid {
+		return nil, ErrTwoFactorEnabled
+	}
+	now := tf.now()
+	step, ok := totpValidate(credential.Secret, code, now)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	tx, err := tf.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(twoFactorQueries["confirm"], credential.ID, now, step)
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	codes, err := tf.createRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("confirm two factor: %w", err)
+	}
+	return codes, nil
+}
+
+// Enabled reports whether the user has a confirmed TOTP credential.
+func (tf *TwoFactorService) Enabled(userID int) (bool, error) {
+	credential, err := tf.credential(userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("two factor enabled: %w", err)
+	}
+	return credential.ConfirmedAt.Valid, nil
+}
+
+// Disable removes the TOTP credential and every recovery code of the user.
+// Callers are responsible for re-confirming the user's password first.
+func (tf *TwoFactorService) Disable(userID int) error {
+	tx, err := tf.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(twoFactorQueries["disable"], userID)
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	_, err = tx.Exec(twoFactorQueries["delete_recovery_codes"], userID)
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("disable two factor: %w", err)
+	}
+	return nil
+}
+
+// Verify checks a code from the user's authenticator app, falling back to
+// their unused recovery codes. Every code can only be used once.
+func (tf *TwoFactorService) Verify(userID int, code string) error {
+	credential, err := tf.credential(userID)
+	if err != nil {
+		return fmt.Errorf("verify two factor: %w", err)
+	}
+	if !credential.ConfirmedAt.Valid {
+		return fmt.Errorf("verify two factor: %w", ErrNotFound)
+	}
+	step, ok := totpValidate(credential.Secret, code, tf.now())
+	if ok {
+		res, err := tf.DB.Exec(twoFactorQueries["use_step"], credential.ID, step)
+		if err != nil {
+			return fmt.Errorf("verify two factor: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("verify two factor: %w", err)
+		}
+		if rows == 0 {
+			// The code was already used, this is most likely a replay.
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	res, err := tf.DB.Exec(twoFactorQueries["use_recovery_code"], userID, tf.hash(normalizeRecoveryCode(code)), tf.now())
+	if err != nil {
+		return fmt.Errorf("verify two factor: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("verify two factor: %w", err)
+	}
+	if rows == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// CreateChallenge starts the second step of signing in for the user.
+func (tf *TwoFactorService) CreateChallenge(userID int) (*TwoFactorChallenge, error) {
+	bytesPerToken := tf.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create challenge: %w", err)
+	}
+	duration := tf.ChallengeDuration
+	if duration == 0 {
+		duration = DefaultChallengeDuration
+	}
+	challenge := TwoFactorChallenge{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: tf.hash(token),
+		ExpiresAt: tf.now().Add(duration),
+	}
+	err = sqlf.NamedDB{DB: tf.DB}.NamedGet(&challenge.ID, twoFactorQueries["create_challenge"], challenge)
+	if err != nil {
+		return nil, fmt.Errorf("create challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// CompleteChallenge verifies the code for the challenge identified by token
+// and returns the ID of the user that is now fully authenticated. Challenges
+// are deleted once they are completed, expired or have been failed too many
+// times. Along with ErrInvalidCode it returns the ID of the user the challenge
+// is for, so the failure can be counted against their account.
+func (tf *TwoFactorService) CompleteChallenge(token, code string) (int, error) {
+	var challenge TwoFactorChallenge
+	err := tf.DB.Get(&challenge, twoFactorQueries["challenge"], tf.hash(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrChallengeExpired
+		}
+		return 0, fmt.Errorf("complete challenge: %w", err)
+	}
+	if tf.now().After(challenge.ExpiresAt) || challenge.Attempts >= MaxTwoFactorAttempts {
+		err = tf.deleteChallenge(challenge.ID)
+		if err != nil {
+			return 0, fmt.Errorf("complete challenge: %w", err)
+		}
+		return 0, ErrChallengeExpired
+	}
+
+	err = tf.Verify(challenge.UserID, code)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			_, dbErr := tf.DB.Exec(twoFactorQueries["fail_challenge"], challenge.ID)
+			if dbErr != nil {
+				return 0, fmt.Errorf("complete challenge: %w", dbErr)
+			}
+			return challenge.UserID, fmt.Errorf("complete challenge: %w", err)
+		}
+		return 0, fmt.Errorf("complete challenge: %w", err)
+	}
+
+	err = tf.deleteChallenge(challenge.ID)
+	if err != nil {
+		return 0, fmt.Errorf("complete challenge: %w", err)
+	}
+	return challenge.UserID, nil
+}
+
+func (tf *TwoFactorService) deleteChallenge(id int) error {
+	_, err := tf.DB.Exec(twoFactorQueries["delete_challenge"], id)
+	if err != nil {
+		return fmt.Errorf("delete challenge: %w", err)
+	}
+	return nil
+}
+
+func (tf *TwoFactorService) credential(userID int) (*TOTPCredential, error) {
+	var credential TOTPCredential
+	err := tf.DB.Get(&credential, twoFactorQueries["credential"], userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("credential: %w", err)
+	}
+	return &credential, nil
+}
+
+func (tf *TwoFactorService) createRecoveryCodes(tx *sqlx.Tx, userID int) ([]string, error) {
+	_, err := tx.Exec(twoFactorQueries["delete_recovery_codes"], userID)
+	if err != nil {
+		return nil, fmt.Errorf("recovery codes: %w", err)
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("recovery codes: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		_, err = tx.Exec(twoFactorQueries["create_recovery_code"], userID, tf.hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("recovery codes: %w", err)
+		}
+		codes = append(codes, code[:len(code)/2]+"-"+code[len(code)/2:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes recovery codes forgiving about case and the
+// separator we display them with.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func (tf *TwoFactorService) issuer() string {
+	if tf.Issuer == "" {
+		return DefaultTwoFactorIssuer
+	}
+	return tf.Issuer
+}
+
+func (tf *TwoFactorService) now() time.Time {
+	if tf.Now == nil {
+		return time.Now()
+	}
+	return tf.Now()
+}
+
+func (tf *TwoFactorService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
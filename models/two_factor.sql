@@ -0,0 +1,66 @@
+-- name: setup
+INSERT INTO totp_credentials (user_id, secret)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET secret         = $2,
+                                    last_used_step = 0,
+                                    confirmed_at   = NULL
+WHERE totp_credentials.confirmed_at IS NULL
+RETURNING id;
+
+-- name: credential
+SELECT id, user_id, secret, last_used_step, confirmed_at
+FROM totp_credentials
+WHERE user_id = $1;
+
+-- name: confirm
+UPDATE totp_credentials
+SET confirmed_at   = $2,
+    last_used_step = $3
+WHERE id = $1;
+
+-- name: use_step
+UPDATE totp_credentials
+SET last_used_step = $2
+WHERE id = $1
+  AND last_used_step < $2;
+
+-- name: disable
+DELETE
+FROM totp_credentials
+WHERE user_id = $1;
+
+-- name: delete_recovery_codes
+DELETE
+FROM recovery_codes
+WHERE user_id = $1;
+
+-- name: create_recovery_code
+INSERT INTO recovery_codes (user_id, code_hash)
+VALUES ($1, $2);
+
+-- name: use_recovery_code
+UPDATE recovery_codes
+SET used_at = $3
+WHERE user_id = $1
+  AND code_hash = $2
+  AND used_at IS NULL;
+
+-- name: create_challenge
+INSERT INTO two_factor_challenges (user_id, token_hash, expires_at)
+VALUES (:user_id, :token_hash, :expires_at)
+RETURNING id;
+
+-- name: challenge
+SELECT id, user_id, token_hash, attempts, expires_at
+FROM two_factor_challenges
+WHERE token_hash = $1;
+
+-- name: fail_challenge
+UPDATE two_factor_challenges
+SET attempts = attempts + 1
+WHERE id = $1;
+
+-- name: delete_challenge
+DELETE
+FROM two_factor_challenges
+WHERE id = $1;
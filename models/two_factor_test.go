@@ -0,0 +1,165 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableTwoFactor sets up and confirms two-factor authentication for the user
+// at *now, returning the secret and the recovery codes.
+func enableTwoFactor(t *testing.T, tf *TwoFactorService, user *User) (string, []string) {
+	t.Helper()
+	enrollment, err := tf.Setup(user.ID, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totpCode(enrollment.Secret, totpStep(tf.now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := tf.Confirm(user.ID, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("Confirm returned %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+	return enrollment.Secret, codes
+}
+
+func TestTwoFactorVerifyRefusesReplay(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Unix(1700000000, 0)
+	tf := &TwoFactorService{DB: db, Now: fixedClock(&now)}
+	secret, _ := enableTwoFactor(t, tf, user)
+
+	// The code used to confirm can't be used again.
+	code, err := totpCode(secret, totpStep(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tf.Verify(user.ID, code)
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify with the confirmation code = %v, want ErrInvalidCode", err)
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+	code, err = totpCode(secret, totpStep(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tf.Verify(user.ID, code)
+	if err != nil {
+		t.Fatalf("Verify with the next code = %v, want nil", err)
+	}
+	err = tf.Verify(user.ID, code)
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify with a used code = %v, want ErrInvalidCode", err)
+	}
+
+	// A code of an earlier step is refused even while it is within the
+	// allowed skew.
+	code, err = totpCode(secret, totpStep(now)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tf.Verify(user.ID, code)
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify with an earlier code = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestTwoFactorRecoveryCodesAreSingleUse(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Unix(1700000000, 0)
+	tf := &TwoFactorService{DB: db, Now: fixedClock(&now)}
+	_, codes := enableTwoFactor(t, tf, user)
+
+	err := tf.Verify(user.ID, codes[0])
+	if err != nil {
+		t.Fatalf("Verify with a recovery code = %v, want nil", err)
+	}
+	err = tf.Verify(user.ID, codes[0])
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Verify with a used recovery code = %v, want ErrInvalidCode", err)
+	}
+	// Recovery codes are forgiving about case and the separator.
+	err = tf.Verify(user.ID, " "+strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))+" ")
+	if err != nil {
+		t.Fatalf("Verify with a reformatted recovery code = %v, want nil", err)
+	}
+}
+
+func TestTwoFactorChallengeAttemptLimit(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Unix(1700000000, 0)
+	tf := &TwoFactorService{DB: db, Now: fixedClock(&now)}
+	secret, _ := enableTwoFactor(t, tf, user)
+
+	challenge, err := tf.CreateChallenge(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxTwoFactorAttempts; i++ {
+		userID, err := tf.CompleteChallenge(challenge.Token, "000000")
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: CompleteChallenge = %v, want ErrInvalidCode", i+1, err)
+		}
+		if userID != user.ID {
+			t.Fatalf("attempt %d: CompleteChallenge returned user %d, want %d to count the failure against", i+1, userID, user.ID)
+		}
+	}
+	// Once the attempts are used up even a valid code is refused.
+	now = now.Add(totpPeriod * time.Second)
+	code, err := totpCode(secret, totpStep(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tf.CompleteChallenge(challenge.Token, code)
+	if !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("CompleteChallenge after %d failures = %v, want ErrChallengeExpired", MaxTwoFactorAttempts, err)
+	}
+
+	challenge, err = tf.CreateChallenge(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := tf.CompleteChallenge(challenge.Token, code)
+	if err != nil {
+		t.Fatalf("CompleteChallenge = %v, want nil", err)
+	}
+	if userID != user.ID {
+		t.Errorf("CompleteChallenge returned user %d, want %d", userID, user.ID)
+	}
+	_, err = tf.CompleteChallenge(challenge.Token, code)
+	if !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("CompleteChallenge of a completed challenge = %v, want ErrChallengeExpired", err)
+	}
+}
+
+func TestTwoFactorChallengeExpires(t *testing.T) {
+	db := testDB(t)
+	user := testUser(t, db)
+	now := time.Unix(1700000000, 0)
+	tf := &TwoFactorService{DB: db, Now: fixedClock(&now)}
+	secret, _ := enableTwoFactor(t, tf, user)
+
+	challenge, err := tf.CreateChallenge(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(DefaultChallengeDuration + time.Second)
+	code, err := totpCode(secret, totpStep(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tf.CompleteChallenge(challenge.Token, code)
+	if !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("CompleteChallenge after it expired = %v, want ErrChallengeExpired", err)
+	}
+}
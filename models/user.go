@@ -1,26 +1,51 @@
 package models
 
 import (
+	"database/sql"
 	_ "embed"
 	"errors"
 	"fmt"
+	"log"
+	"net/mail"
 	"strings"
+	"time"
 
 	"github.com/Zelinzky/go-sqlf"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID           int    `db:"id"`
-	Email        string `db:"email"`
-	PasswordHash string `db:"password_hash"`
+	ID           int          `db:"id"`
+	Email        string       `db:"email"`
+	PasswordHash string       `db:"password_hash"`
+	VerifiedAt   sql.NullTime `db:"verified_at"`
+	// DeletionRequestedAt is set while the account is waiting to be deleted.
+	DeletionRequestedAt sql.NullTime `db:"deletion_requested_at"`
+	Role                Role         `db:"role"`
+	// SuspendedAt is set while staff have suspended the account.
+	SuspendedAt sql.NullTime `db:"suspended_at"`
+}
+
+// Verified reports whether the user has confirmed they own their email
+// address.
+func (u User) Verified() bool {
+	return u.VerifiedAt.Valid
+}
+
+// Suspended reports whether the user is kept from signing in.
+func (u User) Suspended() bool {
+	return u.SuspendedAt.Valid
 }
 
 type UserService struct {
 	DB *sqlx.DB
+	// PasswordPolicy is what new passwords are checked against.
+	PasswordPolicy PasswordPolicy
+	// Hasher hashes the passwords. Hashes of any algorithm it knows are
+	// accepted, and replaced by one of the preferred algorithm on sign in.
+	Hasher PasswordHasher
 }
 
 //go:embed user.sql
@@ -34,12 +59,19 @@ func init() {
 
 func (us *UserService) Create(email, password string) (*User, error) {
 	email = strings.ToLower(email)
+	err := validateEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	err = us.ValidatePassword(email, password)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
 
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	passwordHash, err := us.Hasher.Hash(password)
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 	user := User{
 		Email:        email,
 		PasswordHash: passwordHash,
@@ -64,24 +96,151 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	var user User
 	err := us.DB.Get(&user, userQueries["authenticate"], email)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", ErrInvalidCredentials)
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	ok, rehash, err := us.Hasher.Verify(user.PasswordHash, password)
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
+	if !ok {
+		return nil, fmt.Errorf("authenticate: %w", ErrInvalidCredentials)
+	}
+	// Only those who know the password learn the account is suspended.
+	if user.Suspended() {
+		return nil, fmt.Errorf("authenticate: %w", ErrAccountSuspended)
+	}
+	if rehash {
+		// The password is only ever available here, so this is where old
+		// hashes are upgraded. Failing to do so can wait for the next sign in.
+		passwordHash, err := us.Hasher.Hash(password)
+		if err == nil {
+			_, err = us.DB.Exec(userQueries["updatePass"], user.ID, passwordHash)
+		}
+		if err != nil {
+			log.Printf("authenticate: rehash password of user %d: %v", user.ID, err)
+		} else {
+			user.PasswordHash = passwordHash
+		}
+	}
 	return &user, nil
 }
 
+func (us *UserService) ByID(id int) (*User, error) {
+	var user User
+	err := us.DB.Get(&user, userQueries["by_id"], id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+	return &user, nil
+}
+
+func (us *UserService) ByEmail(email string) (*User, error) {
+	var user User
+	err := us.DB.Get(&user, userQueries["by_email"], strings.ToLower(email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by email: %w", err)
+	}
+	return &user, nil
+}
+
+// Page returns one page of every user, together with the total amount of
+// users.
+func (us *UserService) Page(page Page) ([]User, int, error) {
+	var total int
+	err := us.DB.Get(&total, userQueries["count"])
+	if err != nil {
+		return nil, 0, fmt.Errorf("count users: %w", err)
+	}
+	users := []User{}
+	err = us.DB.Select(&users, userQueries["page"], page.Limit(), page.Offset())
+	if err != nil {
+		return nil, 0, fmt.Errorf("query users: %w", err)
+	}
+	return users, total, nil
+}
+
+func (us *UserService) SetRole(userID int, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("set role: %w", ErrInvalidRole)
+	}
+	_, err := us.DB.Exec(userQueries["set_role"], userID, role)
+	if err != nil {
+		return fmt.Errorf("set role: %w", err)
+	}
+	return nil
+}
+
+// Suspend keeps the user from signing in and signs them out everywhere. Their
+// API tokens stop working until the user is unsuspended.
+func (us *UserService) Suspend(userID int) error {
+	tx, err := us.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(userQueries["suspend"], userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	_, err = tx.Exec(userQueries["delete_sessions"], userID)
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("suspend user: %w", err)
+	}
+	return nil
+}
+
+func (us *UserService) Unsuspend(userID int) error {
+	_, err := us.DB.Exec(userQueries["unsuspend"], userID)
+	if err != nil {
+		return fmt.Errorf("unsuspend user: %w", err)
+	}
+	return nil
+}
+
+// ValidatePassword checks password against the PasswordPolicy, before it is
+// set for the user with the email address.
+func (us *UserService) ValidatePassword(email, password string) error {
+	return us.PasswordPolicy.Check(strings.ToLower(email), password)
+}
+
 func (us *UserService) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	user, err := us.ByID(userID)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	err = us.ValidatePassword(user.Email, password)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	passwordHash, err := us.Hasher.Hash(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
-	passwordHash := string(hashedBytes)
 	_, err = us.DB.Exec(userQueries["updatePass"], userID, passwordHash)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
 	return nil
 }
+
+// validateEmail makes sure email is a bare address, without a display name.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
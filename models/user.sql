@@ -8,7 +8,48 @@ SELECT *
 FROM users
 WHERE email = $1;
 
+-- name: by_id
+SELECT *
+FROM users
+WHERE id = $1;
+
 -- name: updatePass
 UPDATE users
 SET password_hash = $2
-WHERE id = $1;
\ No newline at end of file
+WHERE id = $1;
+
+-- name: by_email
+SELECT *
+FROM users
+WHERE email = $1;
+
+-- name: page
+SELECT *
+FROM users
+ORDER BY id
+LIMIT $1 OFFSET $2;
+
+-- name: count
+SELECT COUNT(*)
+FROM users;
+
+-- name: set_role
+UPDATE users
+SET role = $2
+WHERE id = $1;
+
+-- name: suspend
+UPDATE users
+SET suspended_at = $2
+WHERE id = $1
+  AND suspended_at IS NULL;
+
+-- name: unsuspend
+UPDATE users
+SET suspended_at = NULL
+WHERE id = $1;
+
+-- name: delete_sessions
+DELETE
+FROM sessions
+WHERE user_id = $1;
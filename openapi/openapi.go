@@ -0,0 +1,261 @@
+// Package openapi holds the OpenAPI document of the JSON API, along with the
+// checks that keep it in line with the routes the server registers.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi.json
+var Spec []byte
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type document struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	RequestBody *struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"responses"`
+}
+
+type mediaType struct {
+	Schema  *Schema         `json:"schema"`
+	Example json.RawMessage `json:"example"`
+}
+
+// Schema is the part of an OpenAPI schema object the examples are checked
+// against.
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Enum       []any              `json:"enum"`
+	Nullable   bool               `json:"nullable"`
+	Required   []string           `json:"required"`
+	Properties map[string]*Schema `json:"properties"`
+	Items      *Schema            `json:"items"`
+}
+
+func load() (*document, error) {
+	var doc document
+	err := json.Unmarshal(Spec, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parse openapi spec: %w", err)
+	}
+	return &doc, nil
+}
+
+// Routes returns every documented route as "METHOD /path", with the path
+// prefixed by the server URL.
+func Routes() ([]string, error) {
+	doc, err := load()
+	if err != nil {
+		return nil, err
+	}
+	var prefix string
+	if len(doc.Servers) > 0 {
+		prefix = strings.TrimSuffix(doc.Servers[0].URL, "/")
+	}
+	var routes []string
+	for path, item := range doc.Paths {
+		for _, method := range methods {
+			if _, ok := item[method]; ok {
+				routes = append(routes, strings.ToUpper(method)+" "+prefix+path)
+			}
+		}
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// CheckRoutes compares the documented routes to the routes registered on the
+// router below prefix, and reports routes that are missing from either.
+func CheckRoutes(router chi.Routes, prefix string) error {
+	documented, err := Routes()
+	if err != nil {
+		return err
+	}
+	registered := map[string]bool{}
+	err = chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.ReplaceAll(route, "/*/", "/")
+		if strings.HasPrefix(route, prefix) {
+			registered[method+" "+route] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk routes: %w", err)
+	}
+	var errs []error
+	for _, route := range documented {
+		if !registered[route] {
+			errs = append(errs, fmt.Errorf("openapi: %s is documented but not registered", route))
+		}
+		delete(registered, route)
+	}
+	var undocumented []string
+	for route := range registered {
+		undocumented = append(undocumented, route)
+	}
+	sort.Strings(undocumented)
+	for _, route := range undocumented {
+		errs = append(errs, fmt.Errorf("openapi: %s is registered but not documented", route))
+	}
+	return errors.Join(errs...)
+}
+
+// CheckExamples validates every JSON example in the document against the
+// schema next to it.
+func CheckExamples() error {
+	doc, err := load()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	check := func(where string, content map[string]mediaType) {
+		media, ok := content["application/json"]
+		if !ok || media.Example == nil || media.Schema == nil {
+			return
+		}
+		var example any
+		err := json.Unmarshal(media.Example, &example)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("openapi: %s: %w", where, err))
+			return
+		}
+		err = doc.validate(media.Schema, example, "example")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("openapi: %s: %w", where, err))
+		}
+	}
+	for path, item := range doc.Paths {
+		for _, method := range methods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op operation
+			err := json.Unmarshal(raw, &op)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("openapi: %s %s: %w", method, path, err))
+				continue
+			}
+			where := strings.ToUpper(method) + " " + path
+			if op.RequestBody != nil {
+				check(where+" request", op.RequestBody.Content)
+			}
+			for status, response := range op.Responses {
+				check(where+" "+status, response.Content)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (doc *document) validate(schema *Schema, value any, at string) error {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		ref, ok := doc.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", at, schema.Ref)
+		}
+		return doc.validate(ref, value, at)
+	}
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", at)
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, v := range schema.Enum {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, schema.Enum)
+		}
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: must be an object", at)
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", at, name)
+			}
+		}
+		for name, v := range obj {
+			prop, ok := schema.Properties[name]
+			if !ok {
+				return fmt.Errorf("%s: unknown property %s", at, name)
+			}
+			err := doc.validate(prop, v, at+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s: must be an array", at)
+		}
+		for i, v := range arr {
+			err := doc.validate(schema.Items, v, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", at)
+		}
+		if schema.Format == "date-time" {
+			_, err := time.Parse(time.RFC3339, str)
+			if err != nil {
+				return fmt.Errorf("%s: must be a date-time: %w", at, err)
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: must be an integer", at)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: must be a number", at)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", at)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package openapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestCheckExamples(t *testing.T) {
+	err := CheckExamples()
+	if err != nil {
+		t.Errorf("the OpenAPI spec has invalid examples:\n%v", err)
+	}
+}
+
+func TestCheckRoutesReportsDrift(t *testing.T) {
+	routes, err := Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) < 2 {
+		t.Fatalf("Routes = %v, want at least two documented routes", routes)
+	}
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r := chi.NewRouter()
+	// Register every documented route but the first, plus one that isn't
+	// documented.
+	for _, route := range routes[1:] {
+		method, path, _ := strings.Cut(route, " ")
+		r.Method(method, path, http.HandlerFunc(noop))
+	}
+	r.Get("/api/v1/undocumented", noop)
+
+	err = CheckRoutes(r, "/api/v1/")
+	if err == nil {
+		t.Fatal("CheckRoutes = nil, want the missing and undocumented routes")
+	}
+	for _, want := range []string{
+		routes[0] + " is documented but not registered",
+		"GET /api/v1/undocumented is registered but not documented",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("CheckRoutes = %v, want it to report %q", err, want)
+		}
+	}
+}
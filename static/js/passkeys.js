@@ -0,0 +1,113 @@
+// Passkey registration and sign in. Forms with a data-passkey attribute of
+// "register" or "signin" run the WebAuthn ceremony when submitted: the
+// options are fetched from the form action followed by "/options", and the
+// credential is posted back to the action. The server speaks the JSON form of
+// the WebAuthn options and credentials, with binary values base64url encoded.
+(function () {
+    function toBytes(base64url) {
+        const base64 = base64url.replace(/-/g, '+').replace(/_/g, '/');
+        const binary = atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, '='));
+        return Uint8Array.from(binary, function (c) {
+            return c.charCodeAt(0);
+        });
+    }
+
+    function toBase64URL(buffer) {
+        let binary = '';
+        new Uint8Array(buffer).forEach(function (b) {
+            binary += String.fromCharCode(b);
+        });
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function descriptors(list) {
+        return list.map(function (credential) {
+            return {type: credential.type, id: toBytes(credential.id)};
+        });
+    }
+
+    async function post(form, url, body) {
+        const response = await fetch(url, {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': form.querySelector('input[name="gorilla.csrf.Token"]').value,
+            },
+            body: JSON.stringify(body || {}),
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            throw new Error(data.error ? data.error.message : 'Something went wrong.');
+        }
+        return data;
+    }
+
+    async function register(form) {
+        const options = await post(form, form.action + '/options');
+        options.challenge = toBytes(options.challenge);
+        options.user.id = toBytes(options.user.id);
+        options.excludeCredentials = descriptors(options.excludeCredentials);
+        const credential = await navigator.credentials.create({publicKey: options});
+        return post(form, form.action, {
+            name: form.elements.name ? form.elements.name.value : '',
+            credential: {
+                id: credential.id,
+                rawId: toBase64URL(credential.rawId),
+                type: credential.type,
+                response: {
+                    clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                    attestationObject: toBase64URL(credential.response.attestationObject),
+                },
+            },
+        });
+    }
+
+    async function signIn(form) {
+        const options = await post(form, form.action + '/options');
+        options.challenge = toBytes(options.challenge);
+        options.allowCredentials = descriptors(options.allowCredentials);
+        const credential = await navigator.credentials.get({publicKey: options});
+        return post(form, form.action, {
+            id: credential.id,
+            rawId: toBase64URL(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.authenticatorData),
+                signature: toBase64URL(credential.response.signature),
+                userHandle: credential.response.userHandle ? toBase64URL(credential.response.userHandle) : '',
+            },
+        });
+    }
+
+    function showError(form, message) {
+        const element = form.querySelector('[data-passkey-error]');
+        element.textContent = message;
+        element.classList.remove('hidden');
+    }
+
+    document.querySelectorAll('form[data-passkey]').forEach(function (form) {
+        if (!window.PublicKeyCredential) {
+            showError(form, 'Your browser does not support passkeys.');
+            form.querySelectorAll('button').forEach(function (button) {
+                button.disabled = true;
+            });
+            return;
+        }
+        form.addEventListener('submit', async function (event) {
+            event.preventDefault();
+            try {
+                const ceremony = form.dataset.passkey === 'register' ? register : signIn;
+                const result = await ceremony(form);
+                window.location = result.redirect;
+            } catch (err) {
+                if (err.name === 'NotAllowedError' || err.name === 'AbortError') {
+                    showError(form, 'The passkey request was cancelled or timed out.');
+                    return;
+                }
+                showError(form, err.message);
+            }
+        });
+    });
+})();